@@ -5,14 +5,111 @@
 package main
 
 import "github.com/canonical/nullboot/efibootmgr"
+import "context"
+import "encoding/json"
+import "errors"
 import "flag"
 import "log"
 import "os"
 
 var noTPM = flag.Bool("no-tpm", false, "Do not do any resealing with the TPM")
 var noEfivars = flag.Bool("no-efivars", false, "Do not use or update the EFI variables")
+var maxBootEntries = flag.Int("max-boot-entries", 0, "Maximum number of boot entries to allow, or 0 for no limit")
+var stageSbatPolicy = flag.Bool("stage-sbat-policy", false, "Request shim to apply the latest SBAT revocations shipped with it on next boot")
+var tcgLog = flag.String("tcg-log", "", "Path of the TCG log of the current boot, defaults to the log of the first TPM in securityfs")
+var policyAuthKeyDir = flag.String("policy-auth-key-dir", "", "Directory with the auth key of each sealed key, to reseal without reading the auth keys from the kernel keyring (a TPM is still required)")
+var noResealOnUnchangedProfile = flag.Bool("no-reseal-on-unchanged-profile", false, "Do not reseal keys that were already resealed against the same PCR profile")
+var readOnlyEfivars = flag.Bool("read-only-efivars", false, "Read the real EFI variables but only log the changes that would be written to them")
 var outputJSON = flag.String("output-json", "", "JSON file to write (also disables writing real EFI variables)")
 
+// verify checks the boot assets installed to the ESP against the trusted
+// asset hashes, and exits with an error if any of them are untrusted.
+func verify(esp, kernelSourceDir string, shim efibootmgr.ShimConfig) {
+	assets, err := efibootmgr.ReadTrustedAssets()
+	if err != nil {
+		log.Println("cannot read trusted asset hashes:", err)
+		os.Exit(1)
+	}
+
+	km, err := efibootmgr.NewKernelManager(esp, kernelSourceDir, shim, nil)
+	if err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+
+	failed, err := assets.Verify(km.InstalledAssets())
+	if err != nil {
+		log.Println("cannot verify boot assets:", err)
+		os.Exit(1)
+	}
+	for _, path := range failed {
+		log.Println("untrusted boot asset:", path)
+	}
+	if len(failed) > 0 {
+		os.Exit(1)
+	}
+}
+
+// inspect prints the current boot state and the trusted asset hashes as JSON.
+func inspect() {
+	bm, err := efibootmgr.NewBootManagerFromSystem()
+	if err != nil {
+		log.Println("cannot load efi boot variables:", err)
+		os.Exit(1)
+	}
+	boot, err := bm.Dump()
+	if err != nil {
+		log.Println("cannot dump boot state:", err)
+		os.Exit(1)
+	}
+
+	assets, err := efibootmgr.ReadTrustedAssets()
+	if err != nil {
+		log.Println("cannot read trusted asset hashes:", err)
+		os.Exit(1)
+	}
+
+	out, err := json.MarshalIndent(struct {
+		Boot          json.RawMessage `json:"boot"`
+		TrustedAssets []string        `json:"trusted-assets"`
+	}{boot, assets.Hashes()}, "", "  ")
+	if err != nil {
+		log.Println("cannot write json:", err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(append(out, '\n'))
+}
+
+// prune deletes the boot entries created by nullboot that boot files which no
+// longer exist on the ESP.
+func prune(esp string) {
+	if err := efibootmgr.CheckPrivileges(esp, true, false); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+
+	bm, err := efibootmgr.NewBootManagerFromSystem()
+	if err != nil {
+		log.Println("cannot load efi boot variables:", err)
+		os.Exit(1)
+	}
+	bm.ESP = esp
+
+	pruned, err := bm.PruneDangling(esp)
+	for _, num := range pruned {
+		log.Printf("Removed dangling boot entry Boot%04X", num)
+	}
+	if err != nil {
+		log.Println("cannot prune boot entries:", err)
+		os.Exit(1)
+	}
+
+	if err := bm.PrependAndSetBootOrder(nil); err != nil {
+		log.Println("cannot set boot order:", err)
+		os.Exit(1)
+	}
+}
+
 func main() {
 	var assets *efibootmgr.TrustedAssets
 	var err error
@@ -25,6 +122,34 @@ func main() {
 		vendor          = "ubuntu"
 	)
 
+	shim := efibootmgr.ShimConfig{Vendor: vendor}
+	reseal := efibootmgr.ResealConfig{
+		OncePerBoot:      true,
+		PolicyAuthKeyDir: *policyAuthKeyDir,
+		SkipUnchanged:    *noResealOnUnchangedProfile,
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "verify":
+		verify(esp, kernelSourceDir, shim)
+		return
+	case "inspect":
+		inspect()
+		return
+	case "prune":
+		prune(esp)
+		return
+	default:
+		log.Printf("unknown command %s", flag.Arg(0))
+		os.Exit(2)
+	}
+
+	if err := efibootmgr.CheckPrivileges(esp, !*noEfivars && !*readOnlyEfivars && *outputJSON == "", !*noTPM); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+
 	// FIXME: Let's actually add some arg parsing and stuff?
 	if !*noTPM {
 		assets, err = efibootmgr.ReadTrustedAssets()
@@ -34,55 +159,77 @@ func main() {
 		}
 
 		for _, p := range []string{shimSourceDir, kernelSourceDir} {
-			if err := assets.TrustNewFromDir(p); err != nil {
+			records, err := assets.TrustNewFromDirWithRecords(context.Background(), p)
+			if err != nil {
 				log.Println("cannot add new assets from", p, ":", err)
 				os.Exit(1)
 			}
+			for _, r := range records {
+				if r.New {
+					log.Printf("Trusted new asset %s (%x)", r.Path, r.Hash)
+				}
+			}
 		}
 
-		if err := efibootmgr.TrustCurrentBoot(assets, esp); err != nil {
+		report, err := efibootmgr.TrustCurrentBoot(assets, esp, efibootmgr.TCGLogSource{Path: *tcgLog})
+		if err != nil {
 			log.Println("cannot trust boot assets used for current boot:", err)
 			os.Exit(1)
 		}
+		for _, path := range report.Missing {
+			log.Println("warning: boot asset used for current boot is missing and will not be trusted:", path)
+		}
+		for _, m := range report.Mismatches {
+			log.Printf("warning: boot asset used for current boot has been modified and will not be trusted: %s (measured %x, found %x)", m.Path, m.Expected, m.Computed)
+		}
 	}
 
 	var maybeBm *efibootmgr.BootManager
 	var efivars efibootmgr.EFIVariables
 	if *outputJSON != "" {
 		efivars = &efibootmgr.MockEFIVariables{}
+	} else if *readOnlyEfivars {
+		efivars = efibootmgr.ReadOnlyEFIVariables{EFIVariables: efibootmgr.RealEFIVariables{}}
 	} else {
 		efivars = efibootmgr.RealEFIVariables{}
 	}
 	if !*noEfivars {
-		if bm, err := efibootmgr.NewBootManagerForVariables(efivars); err != nil {
+		if bm, err := efibootmgr.NewBootManagerForVariables(efivars); errors.Is(err, efibootmgr.ErrVariablesNotSupported) {
+			log.Println("EFI variables are not supported, not updating boot entries")
+		} else if err != nil {
 			log.Println("cannot load efi boot variables:", err)
 			os.Exit(1)
 		} else {
+			bm.ESP = esp
+			bm.MaxEntries = *maxBootEntries
 			maybeBm = &bm
 		}
 	}
 
-	km, err := efibootmgr.NewKernelManager(esp, kernelSourceDir, vendor, maybeBm)
+	km, err := efibootmgr.NewKernelManager(esp, kernelSourceDir, shim, maybeBm)
 	if err != nil {
 		log.Print(err)
 		os.Exit(1)
 	}
 
 	if assets != nil {
-		if err := assets.Save(); err != nil {
+		if err := assets.SaveCanonical(); err != nil {
 			log.Println("cannot update list of trusted boot assets:", err)
 			os.Exit(1)
 		}
 
 		// Initial reseal against new assets
-		if err := efibootmgr.ResealKey(assets, km, esp, shimSourceDir, vendor); err != nil {
+		if err := efibootmgr.ResealKey(assets, km, esp, shimSourceDir, shim, reseal); err != nil && !errors.Is(err, efibootmgr.ErrNoSealedKey) && !errors.Is(err, efibootmgr.ErrResealNotNeeded) {
 			log.Println("initial reseal failed:", err)
 			os.Exit(1)
 		}
 	}
 
 	// Install the shim
-	updatedShim, err := efibootmgr.InstallShim(esp, shimSourceDir, vendor)
+	if *stageSbatPolicy && maybeBm != nil {
+		shim.SbatPolicyVariables = efivars
+	}
+	updatedShim, err := efibootmgr.InstallShim(esp, shimSourceDir, shim)
 	if err != nil {
 		log.Print(err)
 		os.Exit(1)
@@ -112,13 +259,13 @@ func main() {
 
 	if assets != nil {
 		assets.RemoveObsolete()
-		if err := assets.Save(); err != nil {
+		if err := assets.SaveCanonical(); err != nil {
 			log.Println("cannot update list of trusted boot assets:", err)
 			os.Exit(1)
 		}
 
 		// Final reseal to remove obsolete assets from profile
-		if err := efibootmgr.ResealKey(assets, km, esp, shimSourceDir, vendor); err != nil {
+		if err := efibootmgr.ResealKey(assets, km, esp, shimSourceDir, shim, reseal); err != nil && !errors.Is(err, efibootmgr.ErrNoSealedKey) && !errors.Is(err, efibootmgr.ErrResealNotNeeded) {
 			log.Println("final reseal failed:", err)
 			os.Exit(1)
 		}
@@ -0,0 +1,95 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EFIArch is the architecture suffix used in the names of EFI binaries, for
+// example, "x64" in shimx64.efi.
+type EFIArch string
+
+// The EFI architectures known to nullboot
+const (
+	ArchIA32        EFIArch = "ia32"
+	ArchX64         EFIArch = "x64"
+	ArchARM         EFIArch = "arm"
+	ArchAA64        EFIArch = "aa64"
+	ArchLoongArch64 EFIArch = "loongarch64"
+	ArchRISCV32     EFIArch = "riscv32"
+	ArchRISCV64     EFIArch = "riscv64"
+	ArchRISCV128    EFIArch = "riscv128"
+)
+
+// knownEFIArches is the set of valid EFI architectures
+var knownEFIArches = map[EFIArch]bool{
+	ArchIA32:        true,
+	ArchX64:         true,
+	ArchARM:         true,
+	ArchAA64:        true,
+	ArchLoongArch64: true,
+	ArchRISCV32:     true,
+	ArchRISCV64:     true,
+	ArchRISCV128:    true,
+}
+
+// ParseEFIArch returns the EFI architecture named by s, or an error if s is
+// not a known EFI architecture, for example, a GOARCH such as "amd64".
+func ParseEFIArch(s string) (EFIArch, error) {
+	arch := EFIArch(s)
+	if !knownEFIArches[arch] {
+		return "", fmt.Errorf("unknown EFI architecture %q", s)
+	}
+	return arch, nil
+}
+
+// EFIArchForGOARCH returns the EFI architecture for the specified GOARCH, or
+// an error if there is none.
+func EFIArchForGOARCH(goarch string) (EFIArch, error) {
+	arch := efiArchitectureForGOARCH(goarch)
+	if arch == "" {
+		return "", fmt.Errorf("no EFI architecture for GOARCH %q", goarch)
+	}
+	return arch, nil
+}
+
+// String returns the architecture suffix
+func (a EFIArch) String() string {
+	return string(a)
+}
+
+// ShimBasename returns the filename of shim, shim<arch>.efi
+func (a EFIArch) ShimBasename() string {
+	return "shim" + string(a) + ".efi"
+}
+
+// FallbackBasename returns the filename of shim's fallback, fb<arch>.efi
+func (a EFIArch) FallbackBasename() string {
+	return "fb" + string(a) + ".efi"
+}
+
+// MokManagerBasename returns the filename of the MOK manager, mm<arch>.efi
+func (a EFIArch) MokManagerBasename() string {
+	return "mm" + string(a) + ".efi"
+}
+
+// GrubBasename returns the filename of grub, grub<arch>.efi
+func (a EFIArch) GrubBasename() string {
+	return "grub" + string(a) + ".efi"
+}
+
+// RemovableBasename returns the filename of the removable media boot path
+// in EFI/BOOT, BOOT<ARCH>.EFI
+func (a EFIArch) RemovableBasename() string {
+	return "BOOT" + strings.ToUpper(string(a)) + ".EFI"
+}
+
+// FallbackCSVBasename returns the filename of the boot entries read by
+// fallback in the vendor directory, BOOT<ARCH>.CSV
+func (a EFIArch) FallbackCSVBasename() string {
+	return "BOOT" + strings.ToUpper(string(a)) + ".CSV"
+}
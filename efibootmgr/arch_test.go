@@ -0,0 +1,75 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"testing"
+)
+
+func TestEFIArchBasenames(t *testing.T) {
+	tests := []struct {
+		arch        EFIArch
+		shim        string
+		fallback    string
+		mokManager  string
+		grub        string
+		removable   string
+		fallbackCSV string
+	}{
+		{ArchX64, "shimx64.efi", "fbx64.efi", "mmx64.efi", "grubx64.efi", "BOOTX64.EFI", "BOOTX64.CSV"},
+		{ArchAA64, "shimaa64.efi", "fbaa64.efi", "mmaa64.efi", "grubaa64.efi", "BOOTAA64.EFI", "BOOTAA64.CSV"},
+		{ArchIA32, "shimia32.efi", "fbia32.efi", "mmia32.efi", "grubia32.efi", "BOOTIA32.EFI", "BOOTIA32.CSV"},
+		{ArchRISCV64, "shimriscv64.efi", "fbriscv64.efi", "mmriscv64.efi", "grubriscv64.efi", "BOOTRISCV64.EFI", "BOOTRISCV64.CSV"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.arch.String(), func(t *testing.T) {
+			for _, n := range []struct{ got, want string }{
+				{tc.arch.ShimBasename(), tc.shim},
+				{tc.arch.FallbackBasename(), tc.fallback},
+				{tc.arch.MokManagerBasename(), tc.mokManager},
+				{tc.arch.GrubBasename(), tc.grub},
+				{tc.arch.RemovableBasename(), tc.removable},
+				{tc.arch.FallbackCSVBasename(), tc.fallbackCSV},
+			} {
+				if n.got != n.want {
+					t.Errorf("Expected %s, got %s", n.want, n.got)
+				}
+			}
+		})
+	}
+}
+
+func TestParseEFIArch(t *testing.T) {
+	for _, s := range []string{"x64", "aa64", "ia32", "riscv64"} {
+		arch, err := ParseEFIArch(s)
+		if err != nil {
+			t.Errorf("Could not parse %s: %v", s, err)
+		}
+		if arch.String() != s {
+			t.Errorf("Expected %s, got %s", s, arch)
+		}
+	}
+
+	for _, s := range []string{"", "amd64", "arm64", "X64"} {
+		if _, err := ParseEFIArch(s); err == nil {
+			t.Errorf("Expected an error parsing %q", s)
+		}
+	}
+}
+
+func TestEFIArchForGOARCH(t *testing.T) {
+	arch, err := EFIArchForGOARCH("amd64")
+	if err != nil {
+		t.Fatalf("Could not get architecture for amd64: %v", err)
+	}
+	if arch != ArchX64 {
+		t.Errorf("Expected %s, got %s", ArchX64, arch)
+	}
+
+	if _, err := EFIArchForGOARCH("s390x"); err == nil {
+		t.Errorf("Expected an error for s390x")
+	}
+}
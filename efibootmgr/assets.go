@@ -6,14 +6,20 @@ package efibootmgr
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	_ "crypto/sha256" // ensure that sha256 is linked in
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 )
 
 const (
@@ -21,9 +27,22 @@ const (
 	trustedAssetsPath = "/var/lib/nullboot/assets"
 )
 
-func computeRootHash(alg crypto.Hash, hashes [][]byte) []byte {
+// HashBlockSize returns the size of the blocks that the leaves of the hash
+// tree of a boot asset are computed over. This is part of the format of the
+// trusted asset hashes: a different block size produces a different root hash
+// for the same file, so none of the previously trusted assets would match.
+func HashBlockSize() int {
+	return hashBlockSize
+}
+
+// computeRootHash computes the root hash of the tree with the supplied leaf
+// hashes, packing the hashes of each level into blocks of blockSize bytes.
+func computeRootHash(alg crypto.Hash, blockSize int, hashes [][]byte) []byte {
 	if len(hashes) == 0 {
-		panic("no hashes supplied!")
+		// An empty asset has no blocks. Every other root hash is the
+		// digest of a whole block, so use the digest of no data, which
+		// can't be the root hash of any other asset.
+		return alg.New().Sum(nil)
 	}
 
 	for len(hashes) != 1 {
@@ -32,8 +51,8 @@ func computeRootHash(alg crypto.Hash, hashes [][]byte) []byte {
 
 		for len(hashes) > 0 {
 			// Loop whilst we still have hashes
-			var block [hashBlockSize]byte
-			for i := 0; hashBlockSize-i >= alg.Size() && len(hashes) > 0; i += alg.Size() {
+			block := make([]byte, blockSize)
+			for i := 0; blockSize-i >= alg.Size() && len(hashes) > 0; i += alg.Size() {
 				// Loop until we've filled a block or run out of hashes.
 				copy(block[i:], hashes[0])
 				hashes = hashes[1:]
@@ -42,7 +61,7 @@ func computeRootHash(alg crypto.Hash, hashes [][]byte) []byte {
 			// Hash the current block and save it for the next
 			// outer loop iteration.
 			h := alg.New()
-			h.Write(block[:])
+			h.Write(block)
 			next = append(next, h.Sum(nil))
 		}
 
@@ -99,6 +118,21 @@ type loadedTrustedAssets struct {
 	Hashes [][]byte `json:"hashes"`
 }
 
+// validate checks that the algorithm is available and that each hash has the
+// length of a digest of that algorithm. A truncated hash would never match
+// any file.
+func (l *loadedTrustedAssets) validate() error {
+	if !l.Alg.Available() {
+		return fmt.Errorf("digest algorithm %v is not available", l.Alg)
+	}
+	for i, d := range l.Hashes {
+		if len(d) != l.Alg.Size() {
+			return fmt.Errorf("invalid length %d for hash %d, expected %d", len(d), i, l.Alg.Size())
+		}
+	}
+	return nil
+}
+
 // TrustedAssets keeps a record of boot asset hashes that are trusted for the
 // purpose of computing PCR profiles. New hashes are added by adding a directory
 // that is trusted using TrustNewFromDir - the directory will be one inside the
@@ -133,14 +167,32 @@ type loadedTrustedAssets struct {
 type TrustedAssets struct {
 	loaded    loadedTrustedAssets
 	newAssets [][]byte
+
+	// HashWorkers is the maximum number of files that TrustNewFromDir hashes
+	// concurrently. If zero, runtime.GOMAXPROCS(0) is used. The hashes are
+	// added in the same order regardless.
+	HashWorkers int
+
+	// blockSz is the block size of the hash trees, for benchmarking other
+	// block sizes. If zero, hashBlockSize is used. The block size isn't
+	// saved with the hashes, so don't save hashes computed with another
+	// block size: they won't match when they are loaded again.
+	blockSz int
 }
 
 func (t *TrustedAssets) alg() crypto.Hash {
 	return t.loaded.Alg.Hash
 }
 
+func (t *TrustedAssets) blockSize() int {
+	if t.blockSz == 0 {
+		return hashBlockSize
+	}
+	return t.blockSz
+}
+
 func (t *TrustedAssets) checkLeafHashes(hashes [][]byte) bool {
-	d := computeRootHash(t.alg(), hashes)
+	d := computeRootHash(t.alg(), t.blockSize(), hashes)
 	for _, a := range t.loaded.Hashes {
 		if bytes.Equal(d, a) {
 			return true
@@ -149,44 +201,74 @@ func (t *TrustedAssets) checkLeafHashes(hashes [][]byte) bool {
 	return false
 }
 
-func (t *TrustedAssets) maybeAddHash(d []byte) {
+func (t *TrustedAssets) maybeAddHash(d []byte) bool {
 	for _, a := range t.loaded.Hashes {
 		if bytes.Equal(d, a) {
-			return
+			return false
 		}
 	}
 
 	t.loaded.Hashes = append(t.loaded.Hashes, d)
+	return true
 }
 
-func (t *TrustedAssets) trustLeafHashes(hashes [][]byte) {
-	d := computeRootHash(t.alg(), hashes)
-	t.maybeAddHash(d)
+func (t *TrustedAssets) trustHash(d []byte) bool {
+	added := t.maybeAddHash(d)
 	t.newAssets = append(t.newAssets, d)
+	return added
 }
 
-func (t *TrustedAssets) trustFile(path string) error {
+func (t *TrustedAssets) trustLeafHashes(hashes [][]byte) {
+	t.trustHash(computeRootHash(t.alg(), t.blockSize(), hashes))
+}
+
+// hashFile returns the root hash of the file at the specified path.
+func (t *TrustedAssets) hashFile(path string) ([]byte, error) {
 	f, err := appFs.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer f.Close()
 
+	return computeAssetRootHash(f, t.alg(), t.blockSize())
+}
+
+// ComputeAssetRootHash returns the root hash of the boot asset read from r,
+// which is how boot assets are identified in the list of trusted hashes. The
+// root hash is computed as follows, so it must not change:
+//
+//   - The asset is split into blocks of HashBlockSize bytes, and the last
+//     block is padded with zeros. The digest of each block is a leaf hash.
+//   - If there is no leaf hash because the asset is empty, the root hash is
+//     the digest of no data.
+//   - If there is a single leaf hash, it is the root hash.
+//   - Otherwise, the hashes are packed into blocks of HashBlockSize bytes
+//     in order, with as many hashes per block as fit whole, and the last
+//     block is padded with zeros. The digests of these blocks are the hashes
+//     of the next level of the tree, which is repeated until a single hash
+//     remains.
+func ComputeAssetRootHash(r io.Reader, alg crypto.Hash) ([]byte, error) {
+	return computeAssetRootHash(r, alg, hashBlockSize)
+}
+
+// computeAssetRootHash is like ComputeAssetRootHash, but uses blocks of the
+// specified size.
+func computeAssetRootHash(r io.Reader, alg crypto.Hash, blockSize int) ([]byte, error) {
 	var hashes [][]byte
 
-	h := t.alg().New()
+	h := alg.New()
 	for {
-		var block [hashBlockSize]byte
-		_, err := io.ReadFull(f, block[:])
+		block := make([]byte, blockSize)
+		_, err := io.ReadFull(r, block)
 		if err == io.EOF {
 			break
 		}
 		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
-			return err
+			return nil, err
 		}
 
 		h.Reset()
-		h.Write(block[:])
+		h.Write(block)
 		hashes = append(hashes, h.Sum(nil))
 
 		if err != nil {
@@ -194,36 +276,102 @@ func (t *TrustedAssets) trustFile(path string) error {
 		}
 	}
 
-	t.trustLeafHashes(hashes)
-	return nil
+	return computeRootHash(alg, blockSize, hashes), nil
 }
 
-func (t *TrustedAssets) trustDir(path string) error {
+// listFiles returns the paths of the files under the specified directory, in
+// lexical order.
+func listFiles(path string) ([]string, error) {
 	dirents, err := appFs.ReadDir(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	var paths []string
 	for _, e := range dirents {
 		p := filepath.Join(path, e.Name())
-		if err := t.trustPath(p); err != nil {
-			return fmt.Errorf("cannot process path %s: %w", p, err)
+		fi, err := appFs.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("cannot process path %s: %w", p, err)
+		}
+		if !fi.IsDir() {
+			paths = append(paths, p)
+			continue
 		}
+		sub, err := listFiles(p)
+		if err != nil {
+			return nil, fmt.Errorf("cannot process path %s: %w", p, err)
+		}
+		paths = append(paths, sub...)
 	}
 
-	return nil
+	return paths, nil
+}
+
+// TrustedAssetRecord describes a file trusted by TrustNewFromDirWithRecords.
+type TrustedAssetRecord struct {
+	Path string // path of the file
+	Hash []byte // root hash of the file
+
+	// New indicates whether the hash wasn't trusted before.
+	New bool
 }
 
-func (t *TrustedAssets) trustPath(path string) error {
-	fi, err := appFs.Stat(path)
+func (t *TrustedAssets) trustDir(ctx context.Context, path string) ([]TrustedAssetRecord, error) {
+	paths, err := listFiles(path)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	workers := t.HashWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	// Hash the files concurrently, and then add the hashes in the order
+	// of the files so that the result doesn't depend on scheduling.
+	digests := make([][]byte, len(paths))
+	errs := make([]error, len(paths))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				if err := ctx.Err(); err != nil {
+					errs[i] = err
+					continue
+				}
+				digests[i], errs[i] = t.hashFile(paths[i])
+			}
+		}()
+	}
+dispatch:
+	for i := range paths {
+		select {
+		case work <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
 	}
+	close(work)
+	wg.Wait()
 
-	if fi.IsDir() {
-		return t.trustDir(path)
+	// Don't trust some of the files if hashing the others was cancelled
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var records []TrustedAssetRecord
+	for i, p := range paths {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("cannot process path %s: %w", p, errs[i])
+		}
+		records = append(records, TrustedAssetRecord{Path: p, Hash: digests[i], New: t.trustHash(digests[i])})
 	}
-	return t.trustFile(path)
+
+	return records, nil
 }
 
 // TrustNewFromDir adds hashes of the files under the specified path to the list
@@ -231,24 +379,116 @@ func (t *TrustedAssets) trustPath(path string) error {
 // be within the encrypted container, writable only by root and managed by the
 // package manager.
 func (t *TrustedAssets) TrustNewFromDir(path string) error {
+	return t.TrustNewFromDirContext(context.Background(), path)
+}
+
+// TrustNewFromDirContext is like TrustNewFromDir, but stops hashing files once
+// ctx is done and returns ctx.Err(), in which case none of the files are
+// trusted.
+func (t *TrustedAssets) TrustNewFromDirContext(ctx context.Context, path string) error {
+	_, err := t.TrustNewFromDirWithRecords(ctx, path)
+	return err
+}
+
+// TrustNewFromDirWithRecords is like TrustNewFromDirContext, but also returns
+// a record of each file that it trusted, in lexical order of the paths.
+func (t *TrustedAssets) TrustNewFromDirWithRecords(ctx context.Context, path string) ([]TrustedAssetRecord, error) {
 	if !filepath.IsAbs(path) {
-		return errors.New("path is not absolute")
+		return nil, errors.New("path is not absolute")
 	}
-	return t.trustDir(filepath.Clean(path))
+	return t.trustDir(ctx, filepath.Clean(path))
 }
 
 // RemoveObsolete drops all asset hashes that haven't been added in this context
 // via a call to TrustNewFromDir. This should be called after newly trusted assets
 // have been properly committed and obsolete assets have been removed.
+//
+// Afterwards, the trusted hashes and the hashes added in this context are the
+// same deduplicated list, so that a subsequent call is a no-op.
 func (t *TrustedAssets) RemoveObsolete() {
 	t.loaded.Hashes = nil
 	for _, d := range t.newAssets {
 		t.maybeAddHash(d)
 	}
+	t.newAssets = append([][]byte(nil), t.loaded.Hashes...)
+}
+
+// Merge adds the hashes trusted by other to the list of trusted hashes. The
+// hashes that weren't already trusted are treated as if they were added in
+// this context, so that RemoveObsolete keeps them.
+func (t *TrustedAssets) Merge(other *TrustedAssets) error {
+	if other.alg() != t.alg() {
+		return fmt.Errorf("cannot merge trusted assets with digest algorithm %v into %v", other.loaded.Alg, t.loaded.Alg)
+	}
+	if other.blockSize() != t.blockSize() {
+		return fmt.Errorf("cannot merge trusted assets with block size %d into %d", other.blockSize(), t.blockSize())
+	}
+	for _, d := range other.loaded.Hashes {
+		if t.maybeAddHash(d) {
+			t.newAssets = append(t.newAssets, d)
+		}
+	}
+	return nil
+}
+
+// Hashes returns the trusted hashes as hex strings.
+func (t *TrustedAssets) Hashes() []string {
+	var hashes []string
+	for _, d := range t.loaded.Hashes {
+		hashes = append(hashes, hex.EncodeToString(d))
+	}
+	return hashes
 }
 
 // Save persists the list of trusted hashes to disk.
-func (t *TrustedAssets) Save() (err error) {
+func (t *TrustedAssets) Save() error {
+	return t.save(t.loaded)
+}
+
+// SaveCanonical persists the list of trusted hashes to disk like Save, but
+// with the hashes sorted so that identical sets of trusted hashes produce
+// identical files regardless of the order in which they were added.
+func (t *TrustedAssets) SaveCanonical() error {
+	return t.save(t.canonical())
+}
+
+// canonical returns the trusted hashes sorted, see SaveCanonical.
+func (t *TrustedAssets) canonical() loadedTrustedAssets {
+	loaded := loadedTrustedAssets{
+		Alg:    t.loaded.Alg,
+		Hashes: append([][]byte(nil), t.loaded.Hashes...),
+	}
+	sort.Slice(loaded.Hashes, func(i, j int) bool {
+		return bytes.Compare(loaded.Hashes[i], loaded.Hashes[j]) < 0
+	})
+	return loaded
+}
+
+// Export returns the list of trusted hashes in the same form that
+// SaveCanonical persists it to disk.
+func (t *TrustedAssets) Export() ([]byte, error) {
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(t.canonical()); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// ImportTrustedAssets returns the list of trusted hashes from data, in the
+// form produced by Export.
+func ImportTrustedAssets(data []byte) (*TrustedAssets, error) {
+	assets := new(TrustedAssets)
+	if err := json.Unmarshal(data, &assets.loaded); err != nil {
+		return nil, err
+	}
+	if err := assets.loaded.validate(); err != nil {
+		return nil, err
+	}
+
+	return assets, nil
+}
+
+func (t *TrustedAssets) save(loaded loadedTrustedAssets) (err error) {
 	if err := appFs.MkdirAll(filepath.Dir(trustedAssetsPath), 0600); err != nil {
 		return fmt.Errorf("cannot make directory: %v", err)
 	}
@@ -266,7 +506,7 @@ func (t *TrustedAssets) Save() (err error) {
 		os.Remove(name)
 	}()
 
-	if err := json.NewEncoder(f).Encode(t.loaded); err != nil {
+	if err := json.NewEncoder(f).Encode(loaded); err != nil {
 		return err
 	}
 
@@ -294,8 +534,8 @@ func ReadTrustedAssets() (*TrustedAssets, error) {
 	if err := json.NewDecoder(f).Decode(&assets.loaded); err != nil {
 		return nil, err
 	}
-	if !assets.loaded.Alg.Available() {
-		return nil, fmt.Errorf("digest algorithm %v is not available", assets.loaded.Alg)
+	if err := assets.loaded.validate(); err != nil {
+		return nil, err
 	}
 
 	return assets, nil
@@ -306,7 +546,87 @@ func ReadTrustedAssets() (*TrustedAssets, error) {
 // as to whether the file's contents are included in the supplied set
 // of trusted boot assets
 func newCheckedHashedFile(f File, assets *TrustedAssets, closeNotify func(bool)) (*hashedFile, error) {
-	return newHashedFile(f, assets.alg(), func(leafHashes [][]byte) {
+	return newHashedFile(f, assets.alg(), assets.blockSize(), func(leafHashes [][]byte) {
 		closeNotify(assets.checkLeafHashes(leafHashes))
 	})
 }
+
+// isTrustedFile indicates whether the contents of the file at the specified
+// path are included in the set of trusted boot assets.
+func (t *TrustedAssets) isTrustedFile(path string) (trusted bool, err error) {
+	f, err := appFs.Open(path)
+	if err != nil {
+		return false, err
+	}
+
+	hf, err := newCheckedHashedFile(f, t, func(ok bool) {
+		trusted = ok
+	})
+	if err != nil {
+		f.Close()
+		return false, err
+	}
+	if err := hf.Close(); err != nil {
+		return false, err
+	}
+
+	return trusted, nil
+}
+
+// Verify checks the files at the specified paths against the set of trusted
+// boot assets in the same way as ResealKey does, and returns the paths of the
+// files that aren't trusted.
+func (t *TrustedAssets) Verify(paths []string) ([]string, error) {
+	pctx := new(pcrProfileComputeContext)
+
+	for _, path := range paths {
+		f, err := newTrustedEFIImage(t, pctx, path).Open()
+		if err != nil {
+			return nil, fmt.Errorf("cannot open %s: %w", path, err)
+		}
+		if err := f.Close(); err != nil {
+			return nil, fmt.Errorf("cannot close %s: %w", path, err)
+		}
+	}
+
+	if leaked := pctx.leaked(); len(leaked) > 0 {
+		return nil, fmt.Errorf("leaked open files from verifying assets: %v", leaked)
+	}
+
+	return pctx.failed(), nil
+}
+
+// AuditInstalled checks the shim and kernel images installed to the ESP
+// against the set of trusted boot assets, and returns the paths of the images
+// that aren't trusted. This catches images that were installed without
+// trusting the directory they were installed from.
+func AuditInstalled(esp, vendor string, assets *TrustedAssets) ([]string, error) {
+	arch := GetEfiArchitecture()
+
+	var paths []string
+	for _, name := range []string{arch.RemovableBasename(), arch.FallbackBasename(), arch.MokManagerBasename(), arch.GrubBasename()} {
+		p := filepath.Join(esp, "EFI", "BOOT", name)
+		switch _, err := appFs.Stat(p); {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, fmt.Errorf("cannot check for %s: %w", p, err)
+		default:
+			paths = append(paths, p)
+		}
+	}
+
+	vendorDir := filepath.Join(esp, "EFI", vendor)
+	dirents, err := appFs.ReadDir(vendorDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list %s: %w", vendorDir, err)
+	}
+	for _, e := range dirents {
+		name := e.Name()
+		if e.IsDir() || !(strings.HasSuffix(strings.ToLower(name), ".efi") || strings.HasPrefix(name, "kernel.efi-")) {
+			continue
+		}
+		paths = append(paths, filepath.Join(vendorDir, name))
+	}
+
+	return assets.Verify(paths)
+}
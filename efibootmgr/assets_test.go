@@ -5,8 +5,13 @@
 package efibootmgr
 
 import (
+	"bytes"
+	"context"
 	"crypto"
+	"fmt"
+	"testing"
 
+	"github.com/spf13/afero"
 	"gopkg.in/check.v1"
 )
 
@@ -45,6 +50,18 @@ func (s *assetsSuite) TestReadTrustedAssets(c *check.C) {
 	c.Check(assets.newAssets, check.DeepEquals, [][]byte(nil))
 }
 
+func (s *assetsSuite) TestHashes(c *check.C) {
+	assets := newTrustedAssets()
+	c.Check(assets.Hashes(), check.IsNil)
+
+	assets.maybeAddHash(decodeHexString(c, "b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c"))
+	assets.maybeAddHash(decodeHexString(c, "7d865e959b2466918c9863afca942d0fb89d7c9ac0c99bafc3749504ded97730"))
+	c.Check(assets.Hashes(), check.DeepEquals, []string{
+		"b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c",
+		"7d865e959b2466918c9863afca942d0fb89d7c9ac0c99bafc3749504ded97730",
+	})
+}
+
 func (s *assetsSuite) TestReadTrustedAssetsNoFile(c *check.C) {
 	assets, err := ReadTrustedAssets()
 	c.Assert(err, check.IsNil)
@@ -82,6 +99,21 @@ func (s *assetsSuite) TestReadTrustedAssetsInvalidAlg(c *check.C) {
 	c.Assert(err, check.ErrorMatches, "unsupported hash algorithm: foo")
 }
 
+func (s *assetsSuite) TestReadTrustedAssetsInvalidHashLength(c *check.C) {
+	payload := []byte(`
+{
+	"alg": "sha256",
+	"hashes": [
+		"tbudgBSg+bHWHiHnlteNzN8TUvI80ygS9IULh4rklEw=",
+		"AAECAwQFBgcICQoLDA0ODw=="
+	]
+}`)
+	c.Check(s.fs.WriteFile(trustedAssetsPath, payload, 0644), check.IsNil)
+
+	_, err := ReadTrustedAssets()
+	c.Assert(err, check.ErrorMatches, "invalid length 16 for hash 1, expected 32")
+}
+
 func (s *assetsSuite) TestTrustNewFromDir(c *check.C) {
 	// Write some files with a repeating payload to test file hashing - the
 	// payload size is selected to not repeat on block boundaries and not
@@ -119,6 +151,96 @@ func (s *assetsSuite) TestTrustNewFromDir(c *check.C) {
 	})
 }
 
+// The root hashes of boot assets are persisted in the list of trusted hashes,
+// so these must never change.
+func (s *assetsSuite) TestComputeAssetRootHashGolden(c *check.C) {
+	pattern := func(n, mod int) []byte {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = byte(i % mod)
+		}
+		return data
+	}
+
+	for _, t := range []struct {
+		desc     string
+		data     []byte
+		expected string
+	}{
+		{"one block", pattern(hashBlockSize, 256), "c8f5d0341d54d951a71b136e6e2afcb14d11ed8489a7ae126a8fee0df6ecf193"},
+		{"partial block", []byte("hello world\n"), "933bb79e8993643274675407aa6514a32f901ae8fcfc7d61a8f91d3521b77c48"},
+		{"partial final block", pattern(hashBlockSize*3/2, 251), "dfc5a32134f8f4403f216e04c7450e50d95c6ef57761065cb33bdfce1da13bf9"},
+		{"two levels", pattern(hashBlockSize*200, 251), "dcab35c7d7961ea3bbd0785d07f60b0854a188fcddc5ca849de119a3c3240baf"},
+	} {
+		root, err := ComputeAssetRootHash(bytes.NewReader(t.data), crypto.SHA256)
+		c.Check(err, check.IsNil, check.Commentf(t.desc))
+		c.Check(root, check.DeepEquals, decodeHexString(c, t.expected), check.Commentf(t.desc))
+
+		// hashedFile produces the same leaf hashes.
+		c.Check(s.fs.WriteFile("/foo", t.data, 0644), check.IsNil)
+		_, leafHashes, err := hashFileBlocks("/foo", crypto.SHA256)
+		c.Check(err, check.IsNil, check.Commentf(t.desc))
+		c.Check(computeRootHash(crypto.SHA256, hashBlockSize, leafHashes), check.DeepEquals, root, check.Commentf(t.desc))
+	}
+}
+
+func (s *assetsSuite) TestComputeAssetRootHashEmpty(c *check.C) {
+	root, err := ComputeAssetRootHash(bytes.NewReader(nil), crypto.SHA256)
+	c.Check(err, check.IsNil)
+	c.Check(root, check.DeepEquals, decodeHexString(c, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"))
+
+	// This doesn't collide with a block of zeros.
+	zeros, err := ComputeAssetRootHash(bytes.NewReader(make([]byte, hashBlockSize)), crypto.SHA256)
+	c.Check(err, check.IsNil)
+	c.Check(zeros, check.DeepEquals, decodeHexString(c, "ad7facb2586fc6e966c004d7d1d16b024f5805ff7cb47c7a85dabd8b48892ca7"))
+}
+
+func (s *assetsSuite) TestVerifyEmpty(c *check.C) {
+	c.Check(s.fs.WriteFile("/usr/lib/linux/empty", nil, 0644), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/empty", nil, 0644), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/zeros", make([]byte, hashBlockSize), 0644), check.IsNil)
+
+	assets := newTrustedAssets()
+	c.Check(assets.TrustNewFromDir("/usr/lib/linux"), check.IsNil)
+
+	failed, err := assets.Verify([]string{"/boot/efi/EFI/ubuntu/empty", "/boot/efi/EFI/ubuntu/zeros"})
+	c.Check(err, check.IsNil)
+	c.Check(failed, check.DeepEquals, []string{"/boot/efi/EFI/ubuntu/zeros"})
+}
+
+func (s *assetsSuite) TestNonDefaultBlockSize(c *check.C) {
+	// 39 blocks of 512 bytes, which is a tree of 2 levels at that size.
+	s.writeFile(c, "/usr/lib/linux/kernel.efi-1.0-1-generic", 0, 199, 100)
+	s.writeFile(c, "/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", 0, 199, 100)
+
+	assets := newTrustedAssets()
+	assets.blockSz = 512
+	c.Check(assets.TrustNewFromDir("/usr/lib/linux"), check.IsNil)
+
+	data, err := s.fs.ReadFile("/usr/lib/linux/kernel.efi-1.0-1-generic")
+	c.Assert(err, check.IsNil)
+	root, err := computeAssetRootHash(bytes.NewReader(data), crypto.SHA256, 512)
+	c.Check(err, check.IsNil)
+	c.Check(assets.loaded.Hashes, check.DeepEquals, [][]byte{root})
+
+	// The root hash depends on the block size.
+	defaultRoot, err := ComputeAssetRootHash(bytes.NewReader(data), crypto.SHA256)
+	c.Check(err, check.IsNil)
+	c.Check(defaultRoot, check.Not(check.DeepEquals), root)
+
+	// Images are checked with the block size of the assets.
+	failed, err := assets.Verify([]string{"/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic"})
+	c.Check(err, check.IsNil)
+	c.Check(failed, check.HasLen, 0)
+
+	// So the hashes don't match with the default block size.
+	defaultAssets := newTrustedAssets()
+	defaultAssets.loaded.Hashes = assets.loaded.Hashes
+	failed, err = defaultAssets.Verify([]string{"/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic"})
+	c.Check(err, check.IsNil)
+	c.Check(failed, check.DeepEquals, []string{"/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic"})
+}
+
 func (s *assetsSuite) TestTrustNewFromDirDeDup(c *check.C) {
 	c.Check(s.fs.WriteFile("/foo/1", []byte("some contents"), 0644), check.IsNil)
 
@@ -143,6 +265,78 @@ func (s *assetsSuite) TestTrustNewFromDirDeDup(c *check.C) {
 	})
 }
 
+func (s *assetsSuite) TestTrustNewFromDirWithRecords(c *check.C) {
+	c.Check(s.fs.WriteFile("/foo/1", []byte("some contents"), 0644), check.IsNil)
+	s.writeFile(c, "/foo/bar/2", 0, 199, 200)
+
+	assets, err := ReadTrustedAssets()
+	c.Assert(err, check.IsNil)
+
+	assets.loaded.Hashes = [][]byte{
+		decodeHexString(c, "8c3bb60fb858eccd3e85ba8fd3a85d9014f468defbdf6bc0c46891b2049eca46"),
+	}
+
+	records, err := assets.TrustNewFromDirWithRecords(context.Background(), "/foo")
+	c.Check(err, check.IsNil)
+	c.Check(records, check.DeepEquals, []TrustedAssetRecord{
+		{Path: "/foo/1", Hash: decodeHexString(c, "8c3bb60fb858eccd3e85ba8fd3a85d9014f468defbdf6bc0c46891b2049eca46"), New: false},
+		{Path: "/foo/bar/2", Hash: decodeHexString(c, "73e60cb7e2d9c8ba47a507c647f9b388900f5a5dc33c24d4a95f84f4dd85dcec"), New: true},
+	})
+
+	var hashes [][]byte
+	for _, r := range records {
+		hashes = append(hashes, r.Hash)
+	}
+	c.Check(hashes, check.DeepEquals, assets.newAssets)
+}
+
+func (s *assetsSuite) TestTrustNewFromDirParallel(c *check.C) {
+	s.writeFile(c, "/foo/1", 0, 199, 200)
+	s.writeFile(c, "/foo/2", 0, 199, 3500)
+	s.writeFile(c, "/foo/bar/3", 7, 99, 1000)
+	s.writeFile(c, "/foo/bar/4", 3, 50, 20)
+	s.writeFile(c, "/foo/5", 0, 199, 200)
+
+	serial, err := ReadTrustedAssets()
+	c.Assert(err, check.IsNil)
+	serial.HashWorkers = 1
+	c.Check(serial.TrustNewFromDir("/foo"), check.IsNil)
+
+	parallel, err := ReadTrustedAssets()
+	c.Assert(err, check.IsNil)
+	parallel.HashWorkers = 4
+	c.Check(parallel.TrustNewFromDir("/foo"), check.IsNil)
+
+	c.Check(parallel.loaded.Hashes, check.DeepEquals, serial.loaded.Hashes)
+	c.Check(parallel.newAssets, check.DeepEquals, serial.newAssets)
+	c.Check(parallel.loaded.Hashes, check.HasLen, 4)
+	c.Check(parallel.newAssets, check.HasLen, 5)
+}
+
+func (s *assetsSuite) TestTrustNewFromDirContextCancel(c *check.C) {
+	s.writeFile(c, "/foo/1", 0, 199, 200)
+	s.writeFile(c, "/foo/2", 0, 199, 3500)
+	s.writeFile(c, "/foo/bar/3", 7, 99, 1000)
+
+	assets, err := ReadTrustedAssets()
+	c.Assert(err, check.IsNil)
+	assets.HashWorkers = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var opened []string
+	appFs = openHookFS{MapFS{s.fs.Fs}, func(path string) {
+		opened = append(opened, path)
+		cancel()
+	}}
+
+	c.Check(assets.TrustNewFromDirContext(ctx, "/foo"), check.Equals, context.Canceled)
+	c.Check(opened, check.DeepEquals, []string{"/foo/1"})
+	c.Check(assets.loaded.Hashes, check.HasLen, 0)
+	c.Check(assets.newAssets, check.HasLen, 0)
+}
+
 func (s *assetsSuite) TestRemoveObsolete(c *check.C) {
 	assets, err := ReadTrustedAssets()
 	c.Assert(err, check.IsNil)
@@ -161,17 +355,55 @@ func (s *assetsSuite) TestRemoveObsolete(c *check.C) {
 
 	assets.RemoveObsolete()
 
+	// Only the hashes added in this context remain trusted, and both lists
+	// are deduplicated so that they stay the same.
 	c.Check(assets.loaded.Hashes, check.DeepEquals, [][]byte{
 		decodeHexString(c, "73e60cb7e2d9c8ba47a507c647f9b388900f5a5dc33c24d4a95f84f4dd85dcec"),
 		decodeHexString(c, "6c05c5017b4e584ce0e4e77b42e7399c0392407216803f24233def5c038adc7c"),
 	})
+	c.Check(assets.newAssets, check.DeepEquals, assets.loaded.Hashes)
+
+	assets.RemoveObsolete()
+	c.Check(assets.loaded.Hashes, check.HasLen, 2)
+	c.Check(assets.newAssets, check.DeepEquals, assets.loaded.Hashes)
+}
+
+func (s *assetsSuite) TestMerge(c *check.C) {
+	assets := newTrustedAssets()
+	assets.maybeAddHash(decodeHexString(c, "b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c"))
+	assets.maybeAddHash(decodeHexString(c, "7d865e959b2466918c9863afca942d0fb89d7c9ac0c99bafc3749504ded97730"))
+
+	other := newTrustedAssets()
+	other.maybeAddHash(decodeHexString(c, "7d865e959b2466918c9863afca942d0fb89d7c9ac0c99bafc3749504ded97730"))
+	other.maybeAddHash(decodeHexString(c, "73e60cb7e2d9c8ba47a507c647f9b388900f5a5dc33c24d4a95f84f4dd85dcec"))
+
+	c.Check(assets.Merge(other), check.IsNil)
+	c.Check(assets.loaded.Hashes, check.DeepEquals, [][]byte{
+		decodeHexString(c, "b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c"),
+		decodeHexString(c, "7d865e959b2466918c9863afca942d0fb89d7c9ac0c99bafc3749504ded97730"),
+		decodeHexString(c, "73e60cb7e2d9c8ba47a507c647f9b388900f5a5dc33c24d4a95f84f4dd85dcec"),
+	})
 	c.Check(assets.newAssets, check.DeepEquals, [][]byte{
 		decodeHexString(c, "73e60cb7e2d9c8ba47a507c647f9b388900f5a5dc33c24d4a95f84f4dd85dcec"),
-		decodeHexString(c, "6c05c5017b4e584ce0e4e77b42e7399c0392407216803f24233def5c038adc7c"),
-		decodeHexString(c, "6c05c5017b4e584ce0e4e77b42e7399c0392407216803f24233def5c038adc7c"),
 	})
 }
 
+func (s *assetsSuite) TestMergeAlgMismatch(c *check.C) {
+	assets := newTrustedAssets()
+	other := &TrustedAssets{loaded: loadedTrustedAssets{Alg: hashAlg{Hash: crypto.SHA384}}}
+
+	c.Check(assets.Merge(other), check.ErrorMatches, "cannot merge trusted assets with digest algorithm SHA-384 into SHA-256")
+	c.Check(assets.loaded.Hashes, check.HasLen, 0)
+}
+
+func (s *assetsSuite) TestMergeBlockSizeMismatch(c *check.C) {
+	assets := newTrustedAssets()
+	other := newTrustedAssets()
+	other.blockSz = 512
+
+	c.Check(assets.Merge(other), check.ErrorMatches, "cannot merge trusted assets with block size 512 into 4096")
+}
+
 func (s *assetsSuite) TestSave(c *check.C) {
 	assets, err := ReadTrustedAssets()
 	c.Assert(err, check.IsNil)
@@ -190,3 +422,166 @@ func (s *assetsSuite) TestSave(c *check.C) {
 	c.Check(data, check.DeepEquals, []byte(`{"alg":"sha256","hashes":["tbudgBSg+bHWHiHnlteNzN8TUvI80ygS9IULh4rklEw=","fYZelZskZpGMmGOvypQtD7idfJrAyZuvw3SVBN7ZdzA=","c+YMt+LZyLpHpQfGR/mziJAPWl3DPCTUqV+E9N2F3Ow=","bAXFAXtOWEzg5Od7Quc5nAOSQHIWgD8kIz3vXAOK3Hw="]}
 `))
 }
+
+func (s *assetsSuite) TestSaveCanonical(c *check.C) {
+	hashes := [][]byte{
+		decodeHexString(c, "b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c"),
+		decodeHexString(c, "7d865e959b2466918c9863afca942d0fb89d7c9ac0c99bafc3749504ded97730"),
+		decodeHexString(c, "73e60cb7e2d9c8ba47a507c647f9b388900f5a5dc33c24d4a95f84f4dd85dcec"),
+		decodeHexString(c, "6c05c5017b4e584ce0e4e77b42e7399c0392407216803f24233def5c038adc7c"),
+	}
+
+	assets := newTrustedAssets()
+	for _, h := range hashes {
+		assets.maybeAddHash(h)
+	}
+	c.Check(assets.SaveCanonical(), check.IsNil)
+	data1, err := s.fs.ReadFile(trustedAssetsPath)
+	c.Check(err, check.IsNil)
+
+	assets = newTrustedAssets()
+	for i := len(hashes) - 1; i >= 0; i-- {
+		assets.maybeAddHash(hashes[i])
+	}
+	c.Check(assets.SaveCanonical(), check.IsNil)
+	data2, err := s.fs.ReadFile(trustedAssetsPath)
+	c.Check(err, check.IsNil)
+
+	c.Check(data1, check.DeepEquals, data2)
+	c.Check(data1, check.DeepEquals, []byte(`{"alg":"sha256","hashes":["bAXFAXtOWEzg5Od7Quc5nAOSQHIWgD8kIz3vXAOK3Hw=","c+YMt+LZyLpHpQfGR/mziJAPWl3DPCTUqV+E9N2F3Ow=","fYZelZskZpGMmGOvypQtD7idfJrAyZuvw3SVBN7ZdzA=","tbudgBSg+bHWHiHnlteNzN8TUvI80ygS9IULh4rklEw="]}
+`))
+
+	// The in-memory order is unchanged.
+	c.Check(assets.loaded.Hashes[0], check.DeepEquals, hashes[3])
+
+	assets, err = ReadTrustedAssets()
+	c.Assert(err, check.IsNil)
+	c.Check(assets.loaded.Hashes, check.DeepEquals, [][]byte{hashes[3], hashes[2], hashes[1], hashes[0]})
+}
+
+func (s *assetsSuite) TestExportImport(c *check.C) {
+	assets := newTrustedAssets()
+	assets.maybeAddHash(decodeHexString(c, "b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c"))
+	assets.maybeAddHash(decodeHexString(c, "7d865e959b2466918c9863afca942d0fb89d7c9ac0c99bafc3749504ded97730"))
+
+	data, err := assets.Export()
+	c.Assert(err, check.IsNil)
+	c.Check(data, check.DeepEquals, []byte(`{"alg":"sha256","hashes":["fYZelZskZpGMmGOvypQtD7idfJrAyZuvw3SVBN7ZdzA=","tbudgBSg+bHWHiHnlteNzN8TUvI80ygS9IULh4rklEw="]}
+`))
+
+	// Export produces the same file as SaveCanonical
+	c.Check(assets.SaveCanonical(), check.IsNil)
+	saved, err := s.fs.ReadFile(trustedAssetsPath)
+	c.Check(err, check.IsNil)
+	c.Check(data, check.DeepEquals, saved)
+
+	imported, err := ImportTrustedAssets(data)
+	c.Assert(err, check.IsNil)
+	c.Check(imported.loaded.Alg, check.Equals, hashAlg{Hash: crypto.SHA256})
+	c.Check(imported.loaded.Hashes, check.DeepEquals, [][]byte{
+		decodeHexString(c, "7d865e959b2466918c9863afca942d0fb89d7c9ac0c99bafc3749504ded97730"),
+		decodeHexString(c, "b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c"),
+	})
+	c.Check(imported.newAssets, check.DeepEquals, [][]byte(nil))
+
+	exported, err := imported.Export()
+	c.Check(err, check.IsNil)
+	c.Check(exported, check.DeepEquals, data)
+}
+
+func (s *assetsSuite) TestImportTrustedAssetsInvalidHashLength(c *check.C) {
+	_, err := ImportTrustedAssets([]byte(`{"alg":"sha256","hashes":["tbudgBSg+bHWHiHnlteNzN8TUvI80ygS9IULh4rklEw=","AAECAwQFBgcICQoLDA0ODw=="]}`))
+	c.Check(err, check.ErrorMatches, "invalid length 16 for hash 1, expected 32")
+}
+
+func (s *assetsSuite) TestImportTrustedAssetsMissingAlg(c *check.C) {
+	_, err := ImportTrustedAssets([]byte(`{"hashes":["tbudgBSg+bHWHiHnlteNzN8TUvI80ygS9IULh4rklEw="]}`))
+	c.Check(err, check.ErrorMatches, "digest algorithm unknown hash value 0 is not available")
+}
+
+func (s *assetsSuite) TestVerify(c *check.C) {
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0644), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim1"), 0644), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0644), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic", []byte("kernel2"), 0644), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0644), check.IsNil)
+
+	assets := newTrustedAssets()
+	c.Check(assets.TrustNewFromDir("/usr/lib/linux"), check.IsNil)
+	c.Check(assets.TrustNewFromDir("/usr/lib/nullboot/shim"), check.IsNil)
+
+	failed, err := assets.Verify([]string{
+		"/boot/efi/EFI/ubuntu/shimx64.efi",
+		"/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic",
+		"/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic",
+	})
+	c.Check(err, check.IsNil)
+	c.Check(failed, check.DeepEquals, []string{"/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic"})
+}
+
+func (s *assetsSuite) TestVerifyMissing(c *check.C) {
+	assets := newTrustedAssets()
+	_, err := assets.Verify([]string{"/boot/efi/EFI/ubuntu/shimx64.efi"})
+	c.Check(err, check.ErrorMatches, "cannot open /boot/efi/EFI/ubuntu/shimx64.efi: .*")
+}
+
+func (s *assetsSuite) TestAuditInstalled(c *check.C) {
+	SetArchitecture("x64")
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0644), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim1"), 0644), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/fbx64.efi", []byte("fb1"), 0644), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/BOOT/BOOTX64.EFI", []byte("shim1"), 0644), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/BOOT/fbx64.efi", []byte("fb1"), 0644), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0644), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0644), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/fbx64.efi", []byte("fb1"), 0644), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/BOOTX64.CSV", []byte("csv"), 0644), check.IsNil)
+
+	assets := newTrustedAssets()
+	c.Check(assets.TrustNewFromDir("/usr/lib/linux"), check.IsNil)
+	c.Check(assets.TrustNewFromDir("/usr/lib/nullboot/shim"), check.IsNil)
+
+	untrusted, err := AuditInstalled("/boot/efi", "ubuntu", assets)
+	c.Check(err, check.IsNil)
+	c.Check(untrusted, check.HasLen, 0)
+
+	// Installed without trusting its source directory
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic", []byte("kernel2"), 0644), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/BOOT/mmx64.efi", []byte("mm1"), 0644), check.IsNil)
+
+	untrusted, err = AuditInstalled("/boot/efi", "ubuntu", assets)
+	c.Check(err, check.IsNil)
+	c.Check(untrusted, check.DeepEquals, []string{"/boot/efi/EFI/BOOT/mmx64.efi", "/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic"})
+}
+
+func (s *assetsSuite) TestAuditInstalledNoVendorDir(c *check.C) {
+	_, err := AuditInstalled("/boot/efi", "ubuntu", newTrustedAssets())
+	c.Check(err, check.ErrorMatches, "cannot list /boot/efi/EFI/ubuntu: .*")
+}
+
+func benchmarkTrustNewFromDir(b *testing.B, workers int) {
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	for i := 0; i < 8; i++ {
+		afero.WriteFile(memFs, fmt.Sprintf("/foo/%d", i), bytes.Repeat([]byte{byte(i)}, 4<<20), 0644)
+	}
+	b.SetBytes(8 * 4 << 20)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		assets := newTrustedAssets()
+		assets.HashWorkers = workers
+		if err := assets.TrustNewFromDir("/foo"); err != nil {
+			b.Fatalf("Could not trust directory: %v", err)
+		}
+	}
+}
+
+func BenchmarkTrustNewFromDir(b *testing.B) {
+	b.Run("serial", func(b *testing.B) {
+		benchmarkTrustNewFromDir(b, 1)
+	})
+	b.Run("default", func(b *testing.B) {
+		benchmarkTrustNewFromDir(b, 0)
+	})
+}
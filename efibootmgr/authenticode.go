@@ -0,0 +1,235 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"crypto"
+	_ "crypto/sha512" // ensure that sha384 and sha512 are linked in
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"debug/pe"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/canonical/go-efilib"
+	"go.mozilla.org/pkcs7"
+)
+
+const certTableIndex = 4 // Index of the Certificate Table entry in the data directories
+
+var (
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+)
+
+// spcIndirectDataContentDigest is the messageDigest field of the Authenticode
+// SpcIndirectDataContent structure.
+type spcIndirectDataContentDigest struct {
+	DigestAlgorithm pkix.AlgorithmIdentifier
+	Digest          []byte
+}
+
+// readAuthenticodeSignatures returns the Authenticode signatures from the
+// security directory of the PE image read from r.
+func readAuthenticodeSignatures(r io.ReaderAt) ([]*pkcs7.PKCS7, error) {
+	pefile, err := pe.NewFile(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode PE binary: %w", err)
+	}
+
+	var dd []pe.DataDirectory
+	switch oh := pefile.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		dd = oh.DataDirectory[0:oh.NumberOfRvaAndSizes]
+	case *pe.OptionalHeader64:
+		dd = oh.DataDirectory[0:oh.NumberOfRvaAndSizes]
+	default:
+		return nil, errors.New("cannot obtain security directory entry from PE binary: no optional header")
+	}
+	if len(dd) <= certTableIndex {
+		return nil, errors.New("cannot obtain security directory entry from PE binary: invalid number of data directories")
+	}
+
+	certReader := io.NewSectionReader(r, int64(dd[certTableIndex].VirtualAddress), int64(dd[certTableIndex].Size))
+
+	var sigs []*pkcs7.PKCS7
+	for {
+		// Signatures in the security directory are 8-byte aligned
+		off, _ := certReader.Seek(0, io.SeekCurrent)
+		certReader.Seek((8-(off&7))%8, io.SeekCurrent)
+
+		c, err := efi.ReadWinCertificate(certReader)
+		switch {
+		case errors.Is(err, io.EOF):
+			return sigs, nil
+		case err != nil:
+			return nil, fmt.Errorf("cannot decode WIN_CERTIFICATE from security directory entry of PE binary: %w", err)
+		}
+
+		authenticode, ok := c.(efi.WinCertificateAuthenticode)
+		if !ok {
+			return nil, errors.New("unexpected WIN_CERTIFICATE type: not an Authenticode signature")
+		}
+
+		p7, err := pkcs7.Parse(authenticode)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode signature: %w", err)
+		}
+		sigs = append(sigs, p7)
+	}
+}
+
+// authenticodeDigest returns the image digest that was signed, from the content
+// of an Authenticode signature. The content is the SpcIndirectDataContent
+// structure without its outer SEQUENCE header.
+func authenticodeDigest(content []byte) (crypto.Hash, []byte, error) {
+	var data asn1.RawValue
+	rest, err := asn1.Unmarshal(content, &data)
+	if err != nil {
+		return 0, nil, fmt.Errorf("cannot decode SpcIndirectDataContent: %w", err)
+	}
+
+	var digest spcIndirectDataContentDigest
+	if _, err := asn1.Unmarshal(rest, &digest); err != nil {
+		return 0, nil, fmt.Errorf("cannot decode SpcIndirectDataContent digest: %w", err)
+	}
+
+	switch alg := digest.DigestAlgorithm.Algorithm; {
+	case alg.Equal(oidSHA256):
+		return crypto.SHA256, digest.Digest, nil
+	case alg.Equal(oidSHA384):
+		return crypto.SHA384, digest.Digest, nil
+	case alg.Equal(oidSHA512):
+		return crypto.SHA512, digest.Digest, nil
+	default:
+		return 0, nil, fmt.Errorf("unsupported image digest algorithm %v", alg)
+	}
+}
+
+// verifyImageSignature checks that the PE image read from r has an Authenticode
+// signature which covers the image and chains to one of the supplied trusted
+// certificates.
+func verifyImageSignature(r io.ReaderAt, sz int64, roots *x509.CertPool) error {
+	sigs, err := readAuthenticodeSignatures(r)
+	if err != nil {
+		return err
+	}
+	if len(sigs) == 0 {
+		return errors.New("no Authenticode signatures")
+	}
+
+	for _, p7 := range sigs {
+		signer := p7.GetOnlySigner()
+		if signer == nil {
+			err = errors.New("cannot obtain signer certificate from signature")
+			continue
+		}
+		// Firmware does not check certificate expiry, so neither do we.
+		if err = p7.VerifyWithChainAtTime(roots, signer.NotBefore); err != nil {
+			continue
+		}
+
+		var alg crypto.Hash
+		var signedDigest []byte
+		alg, signedDigest, err = authenticodeDigest(p7.Content)
+		if err != nil {
+			continue
+		}
+		var digest []byte
+		digest, err = efiComputePeImageDigest(alg, r, sz)
+		if err != nil {
+			return fmt.Errorf("cannot compute PE image hash: %w", err)
+		}
+		if !bytes.Equal(digest, signedDigest) {
+			err = errors.New("signature does not match image")
+			continue
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("no valid signature from a trusted signer: %w", err)
+}
+
+// verifyImageFile checks the signature of the PE image at the specified path,
+// see verifyImageSignature.
+func verifyImageFile(path string, roots *x509.CertPool) error {
+	f, err := appFs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return verifyImageSignature(f, fi.Size(), roots)
+}
+
+// NXCompatCheck selects how EFI images that don't advertise NX compatibility in
+// their PE headers are handled when they are installed. Firmware that enforces
+// NX memory protection refuses to load such images.
+type NXCompatCheck int
+
+const (
+	NXCompatIgnore  NXCompatCheck = iota // Don't check images
+	NXCompatWarn                         // Log a warning for images that are not NX compatible
+	NXCompatRequire                      // Refuse to install images that are not NX compatible
+)
+
+// isNXCompatible indicates whether the PE image read from r has the
+// IMAGE_DLLCHARACTERISTICS_NX_COMPAT flag set.
+func isNXCompatible(r io.ReaderAt) (bool, error) {
+	pefile, err := pe.NewFile(r)
+	if err != nil {
+		return false, fmt.Errorf("cannot decode PE binary: %w", err)
+	}
+
+	var characteristics uint16
+	switch oh := pefile.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		characteristics = oh.DllCharacteristics
+	case *pe.OptionalHeader64:
+		characteristics = oh.DllCharacteristics
+	default:
+		return false, errors.New("cannot obtain DLL characteristics from PE binary: no optional header")
+	}
+	return characteristics&pe.IMAGE_DLLCHARACTERISTICS_NX_COMPAT != 0, nil
+}
+
+// checkImageNXCompat checks that the PE image at the specified path is NX
+// compatible, logging a warning or returning an error if it isn't as selected
+// by check.
+func checkImageNXCompat(path string, check NXCompatCheck) error {
+	if check == NXCompatIgnore {
+		return nil
+	}
+
+	f, err := appFs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	compat, err := isNXCompatible(f)
+	switch {
+	case err != nil:
+		return err
+	case compat:
+		return nil
+	case check == NXCompatRequire:
+		return errors.New("image is not NX compatible")
+	}
+
+	log.Printf("Warning: %s is not NX compatible, firmware that enforces NX memory protection will refuse to load it", path)
+	return nil
+}
@@ -0,0 +1,273 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"debug/pe"
+	"encoding/asn1"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"time"
+
+	"go.mozilla.org/pkcs7"
+
+	"gopkg.in/check.v1"
+)
+
+type authenticodeSuite struct {
+	mapFsMixin
+
+	caCert     *x509.Certificate
+	signerCert *x509.Certificate
+	signerKey  crypto.Signer
+}
+
+var _ = check.Suite(&authenticodeSuite{})
+
+func (s *authenticodeSuite) newCertificate(c *check.C, cn string, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:              time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	c.Assert(err, check.IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, check.IsNil)
+	return cert, key
+}
+
+func (s *authenticodeSuite) SetUpSuite(c *check.C) {
+	caCert, caKey := s.newCertificate(c, "Test CA", nil, nil)
+	s.caCert = caCert
+	s.signerCert, s.signerKey = s.newCertificate(c, "Test Signer", caCert, caKey)
+}
+
+func (s *authenticodeSuite) roots(certs ...*x509.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return pool
+}
+
+// writePE writes a minimal PE image to path, with a signature over the supplied
+// image digest if signed is true.
+func (s *authenticodeSuite) writePE(c *check.C, path string, digest []byte, signed bool) {
+	s.writePEWithDllCharacteristics(c, path, digest, signed, 0)
+}
+
+// writePEWithDllCharacteristics writes a minimal PE image like writePE, with the
+// supplied DLL characteristics.
+func (s *authenticodeSuite) writePEWithDllCharacteristics(c *check.C, path string, digest []byte, signed bool, dllCharacteristics uint16) {
+	var sig []byte
+	if signed {
+		// SpcIndirectDataContent, without the outer SEQUENCE header
+		data, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: []byte{0x06, 0x01, 0x00}})
+		c.Assert(err, check.IsNil)
+		messageDigest, err := asn1.Marshal(spcIndirectDataContentDigest{
+			DigestAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+			Digest:          digest})
+		c.Assert(err, check.IsNil)
+
+		sd, err := pkcs7.NewSignedData(append(data, messageDigest...))
+		c.Assert(err, check.IsNil)
+		c.Assert(sd.AddSigner(s.signerCert, s.signerKey, pkcs7.SignerInfoConfig{}), check.IsNil)
+		sd.AddCertificate(s.caCert)
+		sig, err = sd.Finish()
+		c.Assert(err, check.IsNil)
+	}
+
+	w := new(bytes.Buffer)
+
+	// DOS header, with the offset of the PE header at 0x3c
+	dos := make([]byte, 64)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], uint32(len(dos)))
+	w.Write(dos)
+
+	w.WriteString("PE\x00\x00")
+	binary.Write(w, binary.LittleEndian, pe.FileHeader{
+		Machine:              pe.IMAGE_FILE_MACHINE_AMD64,
+		SizeOfOptionalHeader: uint16(binary.Size(pe.OptionalHeader64{})),
+		Characteristics:      pe.IMAGE_FILE_EXECUTABLE_IMAGE})
+
+	oh := pe.OptionalHeader64{Magic: 0x20b, DllCharacteristics: dllCharacteristics, NumberOfRvaAndSizes: 16}
+	certOffset := w.Len() + binary.Size(oh)
+	if signed {
+		oh.DataDirectory[certTableIndex] = pe.DataDirectory{VirtualAddress: uint32(certOffset), Size: uint32(8 + len(sig))}
+	}
+	binary.Write(w, binary.LittleEndian, oh)
+
+	if signed {
+		// WIN_CERTIFICATE with WIN_CERT_TYPE_PKCS_SIGNED_DATA
+		binary.Write(w, binary.LittleEndian, uint32(8+len(sig)))
+		binary.Write(w, binary.LittleEndian, uint16(0x0200))
+		binary.Write(w, binary.LittleEndian, uint16(0x0002))
+		w.Write(sig)
+	}
+
+	c.Check(s.fs.WriteFile(path, w.Bytes(), 0644), check.IsNil)
+}
+
+func (s *authenticodeSuite) mockEfiComputePeImageDigest(c *check.C, digest []byte) (restore func()) {
+	orig := efiComputePeImageDigest
+	efiComputePeImageDigest = func(alg crypto.Hash, r io.ReaderAt, sz int64) ([]byte, error) {
+		c.Check(alg, check.Equals, crypto.SHA256)
+		return digest, nil
+	}
+	return func() {
+		efiComputePeImageDigest = orig
+	}
+}
+
+func (s *authenticodeSuite) TestVerifyImageFile(c *check.C) {
+	digest := decodeHexString(c, "93c294bd9d372cf76e3cfd6f66a93fd2586aeb0406677ea0df104349b2ec093d")
+	s.writePE(c, "/image.efi", digest, true)
+
+	restore := s.mockEfiComputePeImageDigest(c, digest)
+	defer restore()
+
+	c.Check(verifyImageFile("/image.efi", s.roots(s.caCert)), check.IsNil)
+}
+
+func (s *authenticodeSuite) TestVerifyImageFileUntrustedSigner(c *check.C) {
+	digest := decodeHexString(c, "93c294bd9d372cf76e3cfd6f66a93fd2586aeb0406677ea0df104349b2ec093d")
+	s.writePE(c, "/image.efi", digest, true)
+
+	restore := s.mockEfiComputePeImageDigest(c, digest)
+	defer restore()
+
+	otherCA, _ := s.newCertificate(c, "Other CA", nil, nil)
+	c.Check(verifyImageFile("/image.efi", s.roots(otherCA)), check.ErrorMatches,
+		"no valid signature from a trusted signer: pkcs7: failed to verify certificate chain: .*")
+}
+
+func (s *authenticodeSuite) TestVerifyImageFileDigestMismatch(c *check.C) {
+	s.writePE(c, "/image.efi", decodeHexString(c, "93c294bd9d372cf76e3cfd6f66a93fd2586aeb0406677ea0df104349b2ec093d"), true)
+
+	restore := s.mockEfiComputePeImageDigest(c, decodeHexString(c, "54a5737f95928a359ba326bda6405a8e91fd06869cdb76f7f53aae83c1050308"))
+	defer restore()
+
+	c.Check(verifyImageFile("/image.efi", s.roots(s.caCert)), check.ErrorMatches,
+		"no valid signature from a trusted signer: signature does not match image")
+}
+
+func (s *authenticodeSuite) TestVerifyImageFileUnsigned(c *check.C) {
+	s.writePE(c, "/image.efi", nil, false)
+	c.Check(verifyImageFile("/image.efi", s.roots(s.caCert)), check.ErrorMatches, "no Authenticode signatures")
+}
+
+func (s *authenticodeSuite) TestVerifyImageFileNotPE(c *check.C) {
+	c.Check(s.fs.WriteFile("/image.efi", []byte("foo"), 0644), check.IsNil)
+	c.Check(verifyImageFile("/image.efi", s.roots(s.caCert)), check.ErrorMatches, "cannot decode PE binary: .*")
+}
+
+func (s *authenticodeSuite) TestInstallShimRejectsUnsigned(c *check.C) {
+	restore := s.mockEfiComputePeImageDigest(c, decodeHexString(c, "93c294bd9d372cf76e3cfd6f66a93fd2586aeb0406677ea0df104349b2ec093d"))
+	defer restore()
+
+	SetArchitecture("x64")
+	s.writePE(c, "/usr/lib/nullboot/shim/shimx64.efi.signed", decodeHexString(c, "93c294bd9d372cf76e3cfd6f66a93fd2586aeb0406677ea0df104349b2ec093d"), true)
+	s.writePE(c, "/usr/lib/nullboot/shim/fbx64.efi", nil, false)
+	s.writePE(c, "/usr/lib/nullboot/shim/mmx64.efi", nil, false)
+
+	updated, err := InstallShim("/boot/efi", "/usr/lib/nullboot/shim", ShimConfig{Vendor: "ubuntu", TrustedSigners: s.roots(s.caCert)})
+	c.Check(err, check.ErrorMatches, "Could not verify signature of (fb|mm)x64.efi: no Authenticode signatures")
+	c.Check(updated, check.Equals, false)
+
+	_, err = s.fs.Stat("/boot/efi/EFI/ubuntu/shimx64.efi")
+	c.Check(err, check.NotNil)
+}
+
+func (s *authenticodeSuite) TestInstallKernelsVerifiesSignatures(c *check.C) {
+	digest := decodeHexString(c, "93c294bd9d372cf76e3cfd6f66a93fd2586aeb0406677ea0df104349b2ec093d")
+	restore := s.mockEfiComputePeImageDigest(c, digest)
+	defer restore()
+
+	s.writePE(c, "/usr/lib/linux/kernel.efi-1.0-1-generic", digest, true)
+	c.Check(s.fs.MkdirAll("/boot/efi/EFI/ubuntu", 0755), check.IsNil)
+
+	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", ShimConfig{Vendor: "ubuntu"}, nil)
+	c.Assert(err, check.IsNil)
+	km.TrustedSigners = s.roots(s.caCert)
+
+	c.Check(km.InstallKernels(), check.IsNil)
+	_, err = s.fs.Stat("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic")
+	c.Check(err, check.IsNil)
+
+	s.writePE(c, "/usr/lib/linux/kernel.efi-1.0-1-generic", nil, false)
+	c.Check(km.InstallKernels(), check.ErrorMatches, "Could not verify signature of kernel kernel.efi-1.0-1-generic: no Authenticode signatures")
+}
+
+func (s *authenticodeSuite) TestIsNXCompatible(c *check.C) {
+	s.writePEWithDllCharacteristics(c, "/nx.efi", nil, false, pe.IMAGE_DLLCHARACTERISTICS_NX_COMPAT|pe.IMAGE_DLLCHARACTERISTICS_DYNAMIC_BASE)
+	s.writePEWithDllCharacteristics(c, "/no-nx.efi", nil, false, pe.IMAGE_DLLCHARACTERISTICS_DYNAMIC_BASE)
+
+	for _, mode := range []NXCompatCheck{NXCompatIgnore, NXCompatWarn, NXCompatRequire} {
+		c.Check(checkImageNXCompat("/nx.efi", mode), check.IsNil)
+	}
+	c.Check(checkImageNXCompat("/no-nx.efi", NXCompatIgnore), check.IsNil)
+	c.Check(checkImageNXCompat("/no-nx.efi", NXCompatWarn), check.IsNil)
+	c.Check(checkImageNXCompat("/no-nx.efi", NXCompatRequire), check.ErrorMatches, "image is not NX compatible")
+
+	c.Check(s.fs.WriteFile("/image.efi", []byte("foo"), 0644), check.IsNil)
+	c.Check(checkImageNXCompat("/image.efi", NXCompatWarn), check.ErrorMatches, "cannot decode PE binary: .*")
+}
+
+func (s *authenticodeSuite) TestInstallShimRequiresNXCompat(c *check.C) {
+	SetArchitecture("x64")
+	s.writePEWithDllCharacteristics(c, "/usr/lib/nullboot/shim/shimx64.efi.signed", nil, false, pe.IMAGE_DLLCHARACTERISTICS_NX_COMPAT)
+	s.writePE(c, "/usr/lib/nullboot/shim/mmx64.efi", nil, false)
+
+	updated, err := InstallShim("/boot/efi", "/usr/lib/nullboot/shim", ShimConfig{Vendor: "ubuntu", NXCompat: NXCompatRequire})
+	c.Check(err, check.ErrorMatches, "Could not check NX compatibility of mmx64.efi: image is not NX compatible")
+	c.Check(updated, check.Equals, false)
+
+	_, err = s.fs.Stat("/boot/efi/EFI/ubuntu/shimx64.efi")
+	c.Check(err, check.NotNil)
+
+	updated, err = InstallShim("/boot/efi", "/usr/lib/nullboot/shim", ShimConfig{Vendor: "ubuntu", NXCompat: NXCompatWarn})
+	c.Check(err, check.IsNil)
+	c.Check(updated, check.Equals, true)
+}
+
+func (s *authenticodeSuite) TestInstallKernelsRequiresNXCompat(c *check.C) {
+	s.writePE(c, "/usr/lib/linux/kernel.efi-1.0-1-generic", nil, false)
+	c.Check(s.fs.MkdirAll("/boot/efi/EFI/ubuntu", 0755), check.IsNil)
+
+	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", ShimConfig{Vendor: "ubuntu"}, nil)
+	c.Assert(err, check.IsNil)
+	km.NXCompat = NXCompatRequire
+
+	c.Check(km.InstallKernels(), check.ErrorMatches, "Could not check NX compatibility of kernel kernel.efi-1.0-1-generic: image is not NX compatible")
+	_, err = s.fs.Stat("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic")
+	c.Check(err, check.NotNil)
+
+	s.writePEWithDllCharacteristics(c, "/usr/lib/linux/kernel.efi-1.0-1-generic", nil, false, pe.IMAGE_DLLCHARACTERISTICS_NX_COMPAT)
+	c.Check(km.InstallKernels(), check.IsNil)
+	_, err = s.fs.Stat("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic")
+	c.Check(err, check.IsNil)
+}
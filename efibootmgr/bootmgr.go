@@ -8,9 +8,14 @@ package efibootmgr
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"log"
+	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/canonical/go-efilib"
 	efi_linux "github.com/canonical/go-efilib/linux"
@@ -18,22 +23,110 @@ import (
 
 const (
 	maxBootEntries = 65535 // Maximum number of boot entries we can hold
+
+	loadOptionCategoryMask efi.LoadOptionAttributes = 0x00001f00 // LOAD_OPTION_CATEGORY
+
+	ownEntryPrefix = "Ubuntu " // Description prefix of the entries created by nullboot
 )
 
+// isBootable indicates whether a load option is a visible boot entry, as
+// opposed to a hidden entry or an application.
+func isBootable(lo *efi.LoadOption) bool {
+	if lo == nil {
+		return false
+	}
+	return lo.Attributes&efi.LoadOptionHidden == 0 && lo.Attributes&loadOptionCategoryMask == efi.LoadOptionCategoryBoot
+}
+
 // BootEntryVariable defines a boot entry variable
 type BootEntryVariable struct {
 	BootNumber int                    // number of the Boot variable, for example, for Boot0004 this is 4
 	Data       []byte                 // the data of the variable
 	Attributes efi.VariableAttributes // any attributes set on the variable
-	LoadOption *efi.LoadOption        // the data of the variable parsed as a load option, if it is a valid load option
+	LoadOption *efi.LoadOption        // the data of the variable parsed as a load option, or nil if it is not a valid load option
+}
+
+// Description returns the description of the load option, or an empty string
+// if the variable is not a valid load option.
+func (v BootEntryVariable) Description() string {
+	if v.LoadOption == nil {
+		return ""
+	}
+	return v.LoadOption.Description
+}
+
+// Path returns the device path of the load option in its text form, or an
+// empty string if the variable is not a valid load option.
+func (v BootEntryVariable) Path() string {
+	if v.LoadOption == nil {
+		return ""
+	}
+	return v.LoadOption.FilePath.ToString(0)
+}
+
+// OptionalDataUTF8 returns the optional data of the load option, which is the
+// command line for entries created by nullboot, decoded from UCS-2. It returns
+// an empty string if the variable is not a valid load option.
+func (v BootEntryVariable) OptionalDataUTF8() string {
+	if v.LoadOption == nil {
+		return ""
+	}
+	data := make([]uint16, len(v.LoadOption.OptionalData)/2)
+	binary.Read(bytes.NewReader(v.LoadOption.OptionalData), binary.LittleEndian, data)
+	return efi.ConvertUTF16ToUTF8(data)
+}
+
+// DevicePathMode selects the form of the device path created for a boot entry.
+type DevicePathMode int
+
+const (
+	// DevicePathShortFormHD creates a short-form device path beginning with
+	// the hard drive media node, which is the default.
+	DevicePathShortFormHD DevicePathMode = iota
+
+	// DevicePathShortFormFile creates a short-form device path consisting of
+	// only the file path, for firmware that doesn't reliably match hard drive
+	// signatures.
+	DevicePathShortFormFile
+
+	// DevicePathFull creates a full device path.
+	DevicePathFull
+)
+
+func (m DevicePathMode) fileDevicePathMode() efi_linux.FileDevicePathMode {
+	switch m {
+	case DevicePathShortFormFile:
+		return efi_linux.ShortFormPathFile
+	case DevicePathFull:
+		return efi_linux.FullPath
+	default:
+		return efi_linux.ShortFormPathHD
+	}
 }
 
 // BootManager manages the boot device selection menu entries (Boot0000...BootFFFF).
+//
+// The same implementation manages the other load option variables, such as
+// the Driver variables, see DriverManager.
 type BootManager struct {
 	efivars        EFIVariables              // EFIVariables implementation
+	family         string                    // The prefix of the variable names, for example, Boot
 	entries        map[int]BootEntryVariable // The Boot<number> variables
 	bootOrder      []int                     // The BootOrder variable, parsed
 	bootOrderAttrs efi.VariableAttributes    // The attributes of BootOrder variable
+
+	// MaxEntries, if non-zero, is the maximum number of boot entries. Many
+	// firmware implementations fail to write variables long before the limit
+	// imposed by the specification is reached.
+	MaxEntries int
+
+	// ESP, if set, is the directory where the ESP is mounted. FindOrCreateEntry
+	// refuses to create entries for files outside of it and BackupESPs.
+	ESP string
+
+	// BackupESPs are the directories where any backup ESPs are mounted, see
+	// NewKernelManagerForESPs.
+	BackupESPs []string
 }
 
 // NewBootManagerFromSystem returns a new BootManager object, initialized with the system state.
@@ -43,17 +136,31 @@ func NewBootManagerFromSystem() (BootManager, error) {
 
 // NewBootManagerForVariables returns a boot manager for the given EFIVariables manager
 func NewBootManagerForVariables(efivars EFIVariables) (BootManager, error) {
+	return newLoadOptionManager(efivars, "Boot")
+}
+
+// newLoadOptionManager returns a manager for the load option variables of the
+// specified family, for example, Boot for the Boot#### and BootOrder variables.
+func newLoadOptionManager(efivars EFIVariables, family string) (BootManager, error) {
 	var err error
 	bm := BootManager{}
 	bm.efivars = efivars
+	bm.family = family
 
 	if !VariablesSupported(efivars) {
-		return BootManager{}, fmt.Errorf("Variables not supported")
+		return BootManager{}, fmt.Errorf("cannot manage %s variables: %w", family, ErrVariablesNotSupported)
 	}
 
-	bootOrderBytes, bootOrderAttrs, err := bm.efivars.GetVariable(efi.GlobalVariable, "BootOrder")
+	// Fresh firmware may not have a boot order yet, in which case it is created
+	// by the first write.
+	bootOrderBytes, bootOrderAttrs, err := bm.efivars.GetVariable(efi.GlobalVariable, bm.orderVariable())
+	switch {
+	case err == efi.ErrVarNotExist:
+		log.Printf("There is no %s variable, starting with an empty one", bm.orderVariable())
+	case err != nil:
+		log.Printf("Could not read %s variable, populating with default, error was: %v", bm.orderVariable(), err)
+	}
 	if err != nil {
-		log.Println("Could not read BootOrder variable, populating with default, error was:", err)
 		bootOrderBytes = nil
 		bootOrderAttrs = efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess
 	}
@@ -71,7 +178,8 @@ func NewBootManagerForVariables(efivars EFIVariables) (BootManager, error) {
 	}
 	for _, name := range names {
 		var entry BootEntryVariable
-		if parsed, err := fmt.Sscanf(name, "Boot%04X", &entry.BootNumber); len(name) != 8 || parsed != 1 || err != nil {
+		var ok bool
+		if entry.BootNumber, ok = parseLoadOptionNumber(name, bm.family); !ok {
 			continue
 		}
 		entry.Data, entry.Attributes, err = bm.efivars.GetVariable(efi.GlobalVariable, name)
@@ -80,7 +188,7 @@ func NewBootManagerForVariables(efivars EFIVariables) (BootManager, error) {
 		}
 		entry.LoadOption, err = efi.ReadLoadOption(bytes.NewReader(entry.Data))
 		if err != nil {
-			log.Printf("Invalid boot entry Boot%04X: %s\n", entry.BootNumber, err)
+			log.Printf("Invalid boot entry %s: %s\n", name, err)
 		}
 
 		bm.entries[entry.BootNumber] = entry
@@ -89,8 +197,45 @@ func NewBootManagerForVariables(efivars EFIVariables) (BootManager, error) {
 	return bm, nil
 }
 
-// NextFreeEntry returns the number of the next free Boot variable.
+// parseLoadOptionNumber returns the number of the load option variable with
+// the specified name, which must be the family followed by exactly four
+// uppercase hexadecimal digits, for example, Boot0001.
+func parseLoadOptionNumber(name, family string) (int, bool) {
+	if len(name) != len(family)+4 || !strings.HasPrefix(name, family) {
+		return 0, false
+	}
+
+	num := 0
+	for _, c := range name[len(family):] {
+		switch {
+		case c >= '0' && c <= '9':
+			num = num<<4 | int(c-'0')
+		case c >= 'A' && c <= 'F':
+			num = num<<4 | int(c-'A'+10)
+		default:
+			return 0, false
+		}
+	}
+	return num, true
+}
+
+// variable returns the name of the variable with the specified number.
+func (bm *BootManager) variable(num int) string {
+	return fmt.Sprintf("%s%04X", bm.family, num)
+}
+
+// orderVariable returns the name of the order variable, for example, BootOrder.
+func (bm *BootManager) orderVariable() string {
+	return bm.family + "Order"
+}
+
+// NextFreeEntry returns the number of the lowest free Boot variable, or an
+// error if there are already MaxEntries boot entries.
 func (bm *BootManager) NextFreeEntry() (int, error) {
+	if bm.MaxEntries > 0 && len(bm.entries) >= bm.MaxEntries {
+		return -1, fmt.Errorf("Maximum number of %d boot entries reached, consider removing unused entries", bm.MaxEntries)
+	}
+
 	for i := 0; i < maxBootEntries; i++ {
 		if _, ok := bm.entries[i]; !ok {
 			return i, nil
@@ -100,6 +245,44 @@ func (bm *BootManager) NextFreeEntry() (int, error) {
 	return -1, fmt.Errorf("Maximum number of boot entries exceeded")
 }
 
+// ListEntries returns the Boot variables, sorted by number.
+func (bm *BootManager) ListEntries() []BootEntryVariable {
+	entries := make([]BootEntryVariable, 0, len(bm.entries))
+	for _, entry := range bm.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].BootNumber < entries[j].BootNumber
+	})
+	return entries
+}
+
+// Entry returns the Boot variable with the specified number, if it exists.
+func (bm *BootManager) Entry(bootNum int) (BootEntryVariable, bool) {
+	entry, ok := bm.entries[bootNum]
+	return entry, ok
+}
+
+// isPathWithin indicates whether path is dir or is below it.
+func isPathWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// isPathWithinESP indicates whether path is within the ESP or one of the
+// backup ESPs.
+func (bm *BootManager) isPathWithinESP(path string) bool {
+	for _, esp := range append([]string{bm.ESP}, bm.BackupESPs...) {
+		if isPathWithin(esp, path) {
+			return true
+		}
+	}
+	return false
+}
+
 // FindOrCreateEntry finds a matching entry in the boot device selection menu,
 // or creates one if it is missing.
 //
@@ -107,13 +290,12 @@ func (bm *BootManager) NextFreeEntry() (int, error) {
 //
 // The argument relativeTo specifies the directory entry.Filename is in.
 func (bm *BootManager) FindOrCreateEntry(entry BootEntry, relativeTo string) (int, error) {
-	bootNext, err := bm.NextFreeEntry()
-	if err != nil {
-		return -1, err
+	filename := path.Join(relativeTo, entry.Filename)
+	if bm.ESP != "" && !bm.isPathWithinESP(filename) {
+		return -1, fmt.Errorf("cannot create boot entry for %s: path is outside of the ESP %s", filename, bm.ESP)
 	}
-	variable := fmt.Sprintf("Boot%04X", bootNext)
 
-	dp, err := bm.efivars.NewFileDevicePath(path.Join(relativeTo, entry.Filename), efi_linux.ShortFormPathHD)
+	dp, err := bm.efivars.NewFileDevicePath(filename, entry.DevicePath.fileDevicePathMode())
 	if err != nil {
 		return -1, err
 	}
@@ -121,8 +303,13 @@ func (bm *BootManager) FindOrCreateEntry(entry BootEntry, relativeTo string) (in
 	optionalData := new(bytes.Buffer)
 	binary.Write(optionalData, binary.LittleEndian, efi.ConvertUTF8ToUCS2(entry.Options+"\x00"))
 
+	attrs := entry.Attributes
+	if attrs == 0 {
+		attrs = efi.LoadOptionActive
+	}
+
 	loadoption := &efi.LoadOption{
-		Attributes:   efi.LoadOptionActive,
+		Attributes:   attrs,
 		Description:  entry.Label,
 		FilePath:     dp,
 		OptionalData: optionalData.Bytes()}
@@ -133,7 +320,6 @@ func (bm *BootManager) FindOrCreateEntry(entry BootEntry, relativeTo string) (in
 	}
 
 	entryVar := BootEntryVariable{
-		BootNumber: bootNext,
 		Data:       loadoptionBytes,
 		Attributes: efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess,
 		LoadOption: loadoption,
@@ -146,6 +332,13 @@ func (bm *BootManager) FindOrCreateEntry(entry BootEntry, relativeTo string) (in
 		}
 	}
 
+	bootNext, err := bm.NextFreeEntry()
+	if err != nil {
+		return -1, err
+	}
+	variable := bm.variable(bootNext)
+	entryVar.BootNumber = bootNext
+
 	if err := bm.efivars.SetVariable(efi.GlobalVariable, variable, entryVar.Data, entryVar.Attributes); err != nil {
 		return -1, err
 	}
@@ -163,7 +356,7 @@ func (bm *BootManager) FindOrCreateEntry(entry BootEntry, relativeTo string) (in
 // and then create a new one with the same number we don't accidentally have the new one in
 // the order.
 func (bm *BootManager) DeleteEntry(bootNum int) error {
-	variable := fmt.Sprintf("Boot%04X", bootNum)
+	variable := bm.variable(bootNum)
 	if _, ok := bm.entries[bootNum]; !ok {
 		return fmt.Errorf("Tried deleting a non-existing variable %s", variable)
 	}
@@ -187,15 +380,132 @@ func (bm *BootManager) DeleteEntry(bootNum int) error {
 	return nil
 }
 
+// entryFilePath returns the path of the file on the ESP that the specified
+// load option boots, and whether the load option boots a file from a hard
+// drive partition or with a short-form file path. Options which boot from
+// removable media, a network or firmware volume aren't mapped to a file.
+func entryFilePath(lo *efi.LoadOption) (string, bool) {
+	if lo == nil || len(lo.FilePath) == 0 {
+		return "", false
+	}
+
+	fpdp, ok := lo.FilePath[len(lo.FilePath)-1].(efi.FilePathDevicePathNode)
+	if !ok {
+		return "", false
+	}
+
+	for _, node := range lo.FilePath[:len(lo.FilePath)-1] {
+		switch node.(type) {
+		case *efi.ACPIDevicePathNode, *efi.ACPIExtendedDevicePathNode, *efi.PCIDevicePathNode,
+			*efi.ATAPIDevicePathNode, *efi.SCSIDevicePathNode, *efi.SATADevicePathNode,
+			*efi.NVMENamespaceDevicePathNode, *efi.HardDriveDevicePathNode:
+		default:
+			return "", false
+		}
+	}
+
+	components := strings.Split(string(fpdp), "\\")
+	return path.Join(components...), true
+}
+
+// entryKernelPath returns the path of the file on the ESP that is passed as
+// the first argument to the loader at the specified path, which is how the
+// entries created by nullboot pass the kernel to shim. The argument is
+// relative to the directory of the loader.
+func entryKernelPath(entry BootEntryVariable, loader string) (string, bool) {
+	args := strings.Fields(strings.TrimRight(entry.OptionalDataUTF8(), "\x00"))
+	if len(args) == 0 || !strings.HasPrefix(args[0], "\\") {
+		return "", false
+	}
+	components := strings.Split(args[0][1:], "\\")
+	return path.Join(append([]string{path.Dir(loader)}, components...)...), true
+}
+
+// PruneDangling deletes the entries created by nullboot that boot a file
+// which no longer exists on the ESP mounted at esp, and returns the numbers
+// of the deleted entries. An entry is dangling if either the loader in its
+// device path or the kernel passed to the loader is missing. Entries that
+// can't be mapped to a file on the ESP are left alone. As with DeleteEntry,
+// the boot order still needs to be committed afterwards.
+func (bm *BootManager) PruneDangling(esp string) ([]int, error) {
+	var nums []int
+	for _, entry := range bm.ListEntries() {
+		if !strings.HasPrefix(entry.Description(), ownEntryPrefix) {
+			continue
+		}
+		p, ok := entryFilePath(entry.LoadOption)
+		if !ok {
+			continue
+		}
+		paths := []string{p}
+		if k, ok := entryKernelPath(entry, p); ok {
+			paths = append(paths, k)
+		}
+		for _, p := range paths {
+			_, err := appFs.Stat(filepath.Join(esp, p))
+			if os.IsNotExist(err) {
+				nums = append(nums, entry.BootNumber)
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("cannot determine if %s is dangling: %w", bm.variable(entry.BootNumber), err)
+			}
+		}
+	}
+
+	var pruned []int
+	for _, num := range nums {
+		if err := bm.DeleteEntry(num); err != nil {
+			return pruned, fmt.Errorf("cannot delete %s: %w", bm.variable(num), err)
+		}
+		pruned = append(pruned, num)
+	}
+
+	return pruned, nil
+}
+
 // PrependAndSetBootOrder commits a new boot order or returns an error.
 //
 // The boot order specified is prepended to the existing one, and the order
-// is deduplicated before committing.
+// is deduplicated before committing. Hidden entries and entries which are not
+// in the boot category are not prepended.
 func (bm *BootManager) PrependAndSetBootOrder(head []int) error {
+	return bm.setBootOrder(bm.prependedBootOrder(head))
+}
+
+// hasBootOrderHead returns whether PrependAndSetBootOrder would leave the
+// cached boot order unchanged for the specified head.
+func (bm *BootManager) hasBootOrderHead(head []int) bool {
+	newOrder := bm.prependedBootOrder(head)
+	if len(newOrder) != len(bm.bootOrder) {
+		return false
+	}
+	for i, num := range newOrder {
+		if bm.bootOrder[i] != num {
+			return false
+		}
+	}
+	return true
+}
+
+// prependedBootOrder returns the boot order that results from prepending
+// head to the existing one, as described in PrependAndSetBootOrder.
+func (bm *BootManager) prependedBootOrder(head []int) []int {
 	var newOrder []int
 
+	var bootableHead []int
+	for _, num := range head {
+		entry, ok := bm.entries[num]
+		switch {
+		case !ok || entry.LoadOption == nil:
+		case bm.family != "Boot" || isBootable(entry.LoadOption):
+			// The attributes other than active only apply to boot entries.
+			bootableHead = append(bootableHead, num)
+		}
+	}
+
 	// Combine head with existing boot order, filter out duplicates and non-existing entries
-	for _, num := range append(append([]int(nil), head...), bm.bootOrder...) {
+	for _, num := range append(bootableHead, bm.bootOrder...) {
 		isDuplicate := false
 		for _, otherNum := range newOrder {
 			if otherNum == num {
@@ -207,20 +517,204 @@ func (bm *BootManager) PrependAndSetBootOrder(head []int) error {
 		}
 	}
 
+	return newOrder
+}
+
+// MoveEntry moves an existing entry to index pos of the boot order and
+// commits it. Positions outside of the boot order are clamped to its start
+// or end.
+func (bm *BootManager) MoveEntry(bootNum int, pos int) error {
+	if _, ok := bm.entries[bootNum]; !ok {
+		return fmt.Errorf("cannot move non-existing variable %s", bm.variable(bootNum))
+	}
+
+	var newOrder []int
+	for _, num := range bm.bootOrder {
+		if num != bootNum {
+			newOrder = append(newOrder, num)
+		}
+	}
+
+	switch {
+	case pos < 0:
+		pos = 0
+	case pos > len(newOrder):
+		pos = len(newOrder)
+	}
+
+	newOrder = append(newOrder[:pos], append([]int{bootNum}, newOrder[pos:]...)...)
+	return bm.setBootOrder(newOrder)
+}
+
+// setBootOrder commits the specified boot order and updates our cache.
+func (bm *BootManager) setBootOrder(order []int) error {
 	// Encode the boot order to bytes
 	var output []byte
-	for _, num := range newOrder {
+	for _, num := range order {
 		var numBytes [2]byte
 		binary.LittleEndian.PutUint16(numBytes[0:], uint16(num))
 		output = append(output, numBytes[0], numBytes[1])
 	}
 
-	// Set the boot order and update our cache
-	if err := bm.efivars.SetVariable(efi.GlobalVariable, "BootOrder", output, bm.bootOrderAttrs); err != nil {
+	if err := bm.efivars.SetVariable(efi.GlobalVariable, bm.orderVariable(), output, bm.bootOrderAttrs); err != nil {
 		return err
 	}
 
-	bm.bootOrder = newOrder
+	bm.bootOrder = order
+	return nil
+}
+
+// SetBootNext sets the entry that the firmware boots once on the next boot,
+// instead of the entries in BootOrder.
+func (bm *BootManager) SetBootNext(bootNum int) error {
+	if _, ok := bm.entries[bootNum]; !ok {
+		return fmt.Errorf("cannot set BootNext to non-existing variable %s", bm.variable(bootNum))
+	}
+
+	var data [2]byte
+	binary.LittleEndian.PutUint16(data[:], uint16(bootNum))
+
+	attrs := efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess
+	return bm.efivars.SetVariable(efi.GlobalVariable, "BootNext", data[:], attrs)
+}
+
+// GetTimeout returns the timeout in seconds of the firmware boot menu, and
+// whether the Timeout variable exists. Many firmware implementations don't
+// create it until it is first set.
+func (bm *BootManager) GetTimeout() (uint16, bool, error) {
+	data, _, err := bm.efivars.GetVariable(efi.GlobalVariable, "Timeout")
+	switch {
+	case err == efi.ErrVarNotExist:
+		return 0, false, nil
+	case err != nil:
+		return 0, false, fmt.Errorf("cannot read Timeout: %w", err)
+	case len(data) != 2:
+		return 0, false, fmt.Errorf("invalid Timeout size %d", len(data))
+	}
+
+	return binary.LittleEndian.Uint16(data), true, nil
+}
+
+// SetTimeout sets the timeout in seconds of the firmware boot menu.
+func (bm *BootManager) SetTimeout(seconds uint16) error {
+	var data [2]byte
+	binary.LittleEndian.PutUint16(data[:], seconds)
+
+	attrs := efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess
+	if err := bm.efivars.SetVariable(efi.GlobalVariable, "Timeout", data[:], attrs); err != nil {
+		return fmt.Errorf("cannot write Timeout: %w", err)
+	}
+
+	return nil
+}
+
+// Bits of the OsIndications and OsIndicationsSupported variables.
+const (
+	OsIndicationBootToFWUI                   uint64 = 0x0000000000000001 // EFI_OS_INDICATIONS_BOOT_TO_FW_UI
+	OsIndicationTimestampRevocation          uint64 = 0x0000000000000002 // EFI_OS_INDICATIONS_TIMESTAMP_REVOCATION
+	OsIndicationFileCapsuleDeliverySupported uint64 = 0x0000000000000004 // EFI_OS_INDICATIONS_FILE_CAPSULE_DELIVERY_SUPPORTED
+	OsIndicationFMPCapsuleSupported          uint64 = 0x0000000000000008 // EFI_OS_INDICATIONS_FMP_CAPSULE_SUPPORTED
+	OsIndicationCapsuleResultVarSupported    uint64 = 0x0000000000000010 // EFI_OS_INDICATIONS_CAPSULE_RESULT_VAR_SUPPORTED
+	OsIndicationStartOSRecovery              uint64 = 0x0000000000000020 // EFI_OS_INDICATIONS_START_OS_RECOVERY
+	OsIndicationStartPlatformRecovery        uint64 = 0x0000000000000040 // EFI_OS_INDICATIONS_START_PLATFORM_RECOVERY
+	OsIndicationJSONConfigDataRefresh        uint64 = 0x0000000000000080 // EFI_OS_INDICATIONS_JSON_CONFIG_DATA_REFRESH
+)
+
+// getUint64Variable returns the value of the specified little-endian uint64
+// global variable, or zero if it doesn't exist.
+func (bm *BootManager) getUint64Variable(name string) (uint64, error) {
+	data, _, err := bm.efivars.GetVariable(efi.GlobalVariable, name)
+	switch {
+	case err == efi.ErrVarNotExist:
+		return 0, nil
+	case err != nil:
+		return 0, fmt.Errorf("cannot read %s: %w", name, err)
+	case len(data) != 8:
+		return 0, fmt.Errorf("invalid %s size %d", name, len(data))
+	}
+
+	return binary.LittleEndian.Uint64(data), nil
+}
+
+// GetOsIndications returns the features that the OS has requested from the
+// firmware on the next boot. It returns zero if OsIndications doesn't exist.
+func (bm *BootManager) GetOsIndications() (uint64, error) {
+	return bm.getUint64Variable("OsIndications")
+}
+
+// GetOsIndicationsSupported returns the features that the firmware supports
+// being requested with OsIndications. It returns zero if
+// OsIndicationsSupported doesn't exist.
+func (bm *BootManager) GetOsIndicationsSupported() (uint64, error) {
+	return bm.getUint64Variable("OsIndicationsSupported")
+}
+
+// SetOsIndications requests the specified features from the firmware on the
+// next boot. It returns an error if any of them aren't supported by the
+// firmware.
+func (bm *BootManager) SetOsIndications(mask uint64) error {
+	supported, err := bm.GetOsIndicationsSupported()
+	if err != nil {
+		return err
+	}
+	if unsupported := mask &^ supported; unsupported != 0 {
+		return fmt.Errorf("unsupported OsIndications %#x, firmware supports %#x", unsupported, supported)
+	}
+
+	var data [8]byte
+	binary.LittleEndian.PutUint64(data[:], mask)
+
+	attrs := efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess
+	if err := bm.efivars.SetVariable(efi.GlobalVariable, "OsIndications", data[:], attrs); err != nil {
+		return fmt.Errorf("cannot write OsIndications: %w", err)
+	}
+
 	return nil
+}
+
+// bootEntryJSON is the JSON representation of a boot entry used by Dump.
+type bootEntryJSON struct {
+	BootNumber  int    `json:"number"`
+	Valid       bool   `json:"valid"`
+	Description string `json:"description"`
+	Path        string `json:"path"`
+	Options     string `json:"options"`
+}
+
+// bootStateJSON is the JSON representation of the boot state used by Dump.
+type bootStateJSON struct {
+	BootCurrent *int            `json:"boot-current"`
+	BootOrder   []int           `json:"boot-order"`
+	Entries     []bootEntryJSON `json:"entries"`
+}
+
+// Dump returns the boot order, the boot entries and BootCurrent as JSON.
+//
+// The device path of each entry is rendered in the UEFI text form, and the
+// optional data is decoded as a UCS-2 string. Entries which are not valid
+// load options are included with only their number. BootCurrent is null if
+// the variable cannot be read.
+func (bm *BootManager) Dump() ([]byte, error) {
+	state := bootStateJSON{
+		BootOrder: append([]int{}, bm.bootOrder...),
+		Entries:   []bootEntryJSON{},
+	}
+
+	if data, _, err := bm.efivars.GetVariable(efi.GlobalVariable, "BootCurrent"); err == nil && len(data) == 2 {
+		current := int(binary.LittleEndian.Uint16(data))
+		state.BootCurrent = &current
+	}
+
+	for _, entry := range bm.ListEntries() {
+		e := bootEntryJSON{BootNumber: entry.BootNumber}
+		if entry.LoadOption != nil {
+			e.Valid = true
+			e.Description = entry.Description()
+			e.Path = entry.Path()
+			e.Options = entry.OptionalDataUTF8()
+		}
+		state.Entries = append(state.Entries, e)
+	}
 
+	return json.MarshalIndent(state, "", "  ")
 }
@@ -6,11 +6,14 @@ package efibootmgr
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"reflect"
 	"testing"
 
 	"github.com/canonical/go-efilib"
+	efi_linux "github.com/canonical/go-efilib/linux"
 	"github.com/spf13/afero"
 )
 
@@ -121,12 +124,431 @@ func TestBootManager_mocked(t *testing.T) {
 
 }
 
-func TestBootManagerDeleteEntry(t *testing.T) {
+func TestParseLoadOptionNumber(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		family string
+		num    int
+		ok     bool
+	}{
+		{"Boot0000", "Boot", 0, true},
+		{"Boot0001", "Boot", 1, true},
+		{"Boot1A2F", "Boot", 0x1a2f, true},
+		{"BootFFFF", "Boot", 0xffff, true},
+		{"Bootffff", "Boot", 0, false},
+		{"Boot00000", "Boot", 0, false},
+		{"Boot000", "Boot", 0, false},
+		{"Boot+001", "Boot", 0, false},
+		{"Boot 001", "Boot", 0, false},
+		{"BootOrder", "Boot", 0, false},
+		{"BootNext", "Boot", 0, false},
+		{"BootCurrent", "Boot", 0, false},
+		{"boot0001", "Boot", 0, false},
+		{"Driver0001", "Boot", 0, false},
+		{"Driver0001", "Driver", 1, true},
+		{"DriverOrder", "Driver", 0, false},
+		{"SysPrep00A0", "SysPrep", 0xa0, true},
+	} {
+		num, ok := parseLoadOptionNumber(tc.name, tc.family)
+		if num != tc.num || ok != tc.ok {
+			t.Errorf("parseLoadOptionNumber(%q, %q): expected %d, %v, got %d, %v", tc.name, tc.family, tc.num, tc.ok, num, ok)
+		}
+	}
+}
+
+func TestBootManagerFindOrCreateEntryMaxEntries(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "path", []byte("file a"), 0644)
+	afero.WriteFile(memFs, "path2", []byte("file b"), 0644)
+	afero.WriteFile(memFs, "path3", []byte("file c"), 0644)
 	mockvars := MockEFIVariables{
 		map[efi.VariableDescriptor]mockEFIVariable{
-			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0, 2, 0, 3, 0}, 123},
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 123},
 			{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 42},
-			{GUID: efi.GlobalVariable, Name: "Boot0002"}:  {UsbrBootCdromOptBytes, 43},
+		},
+	}
+
+	bm, err := NewBootManagerForVariables(&mockvars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bm.MaxEntries = 3
+
+	// This creates Boot0000 and Boot0002, reusing the lowest free slots
+	for i, filename := range []string{"path", "path2"} {
+		got, err := bm.FindOrCreateEntry(BootEntry{Filename: filename, Label: "desc"}, "")
+		if err != nil {
+			t.Fatalf("could not create boot entry, error: %v", err)
+		}
+		if want := []int{0, 2}[i]; got != want {
+			t.Errorf("expected to create Boot%04X, created Boot%04X", want, got)
+		}
+	}
+
+	// Finding an existing entry still works
+	if got, err := bm.FindOrCreateEntry(BootEntry{Filename: "path", Label: "desc"}, ""); err != nil || got != 0 {
+		t.Errorf("expected to find Boot0000, got %d, %v", got, err)
+	}
+
+	_, err = bm.FindOrCreateEntry(BootEntry{Filename: "path3", Label: "desc"}, "")
+	if want := "Maximum number of 3 boot entries reached, consider removing unused entries"; err == nil || err.Error() != want {
+		t.Errorf("Expected error %q, got %v", want, err)
+	}
+	if _, ok := mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "Boot0003"}]; ok {
+		t.Errorf("Unexpected boot entry beyond the maximum")
+	}
+}
+
+func TestBootManagerFindOrCreateEntryOutsideESP(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim"), 0644)
+	afero.WriteFile(memFs, "/boot/evil.efi", []byte("evil"), 0644)
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{}, 123},
+		},
+	}
+
+	bm, err := NewBootManagerForVariables(&mockvars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bm.ESP = "/boot/efi"
+
+	if _, err := bm.FindOrCreateEntry(BootEntry{Filename: "shimx64.efi", Label: "desc"}, "/boot/efi/EFI/ubuntu"); err != nil {
+		t.Errorf("could not create boot entry, error: %v", err)
+	}
+
+	_, err = bm.FindOrCreateEntry(BootEntry{Filename: "../evil.efi", Label: "evil"}, "/boot/efi")
+	if want := "cannot create boot entry for /boot/evil.efi: path is outside of the ESP /boot/efi"; err == nil || err.Error() != want {
+		t.Errorf("Expected error %q, got %v", want, err)
+	}
+	if _, ok := mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "Boot0001"}]; ok {
+		t.Errorf("Unexpected boot entry for file outside of the ESP")
+	}
+}
+
+func TestBootManagerPruneDangling(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/fbx64.efi", []byte("fb"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic", []byte("kernel2"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/other/grubx64.efi", []byte("grub"), 0644)
+
+	usbOpt := &efi.LoadOption{
+		Attributes:  efi.LoadOptionActive,
+		Description: "Ubuntu on USB",
+		FilePath: efi.DevicePath{
+			&efi.ACPIDevicePathNode{HID: 0x0a0341d0},
+			&efi.PCIDevicePathNode{Device: 0x14, Function: 0},
+			&efi.USBDevicePathNode{ParentPortNumber: 0xb, InterfaceNumber: 0x1},
+			efi.NewFilePathDevicePathNode("EFI/ubuntu/missing.efi")},
+	}
+	usbOptBytes, err := usbOpt.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 123},
+			{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 42},
+			{GUID: efi.GlobalVariable, Name: "Boot0002"}:  {usbOptBytes, 42},
+		},
+	}
+	bm, err := NewBootManagerForVariables(&mockvars)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nums []int
+	for _, entry := range []BootEntry{
+		{Filename: "ubuntu/shimx64.efi", Label: "Ubuntu with kernel 1.0-1-generic", Options: "\\kernel.efi-1.0-1-generic root=magic"},
+		{Filename: "ubuntu/shimx64.efi", Label: "Ubuntu with kernel 1.0-2-generic", Options: "\\kernel.efi-1.0-2-generic root=magic"},
+		{Filename: "ubuntu/fbx64.efi", Label: "Ubuntu fallback"},
+		{Filename: "other/grubx64.efi", Label: "Other"},
+	} {
+		num, err := bm.FindOrCreateEntry(entry, "/boot/efi/EFI")
+		if err != nil {
+			t.Fatalf("could not create boot entry, error: %v", err)
+		}
+		nums = append(nums, num)
+	}
+	if err := bm.PrependAndSetBootOrder(nums); err != nil {
+		t.Fatal(err)
+	}
+
+	// The kernel of the first entry and the loader of the third entry are
+	// removed. Entries that weren't created by nullboot are left alone.
+	memFs.Remove("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic")
+	memFs.Remove("/boot/efi/EFI/ubuntu/fbx64.efi")
+	memFs.Remove("/boot/efi/EFI/other/grubx64.efi")
+
+	pruned, err := bm.PruneDangling("/boot/efi")
+	if err != nil {
+		t.Fatalf("could not prune boot entries, error: %v", err)
+	}
+	if want := []int{nums[0], nums[2]}; !reflect.DeepEqual(pruned, want) {
+		t.Errorf("Expected to prune %v, pruned %v", want, pruned)
+	}
+	for _, num := range []int{1, 2, nums[1], nums[3]} {
+		if _, ok := bm.entries[num]; !ok {
+			t.Errorf("Boot%04X was unexpectedly pruned", num)
+		}
+	}
+	if want := []int{nums[1], nums[3], 1}; !reflect.DeepEqual(bm.bootOrder, want) {
+		t.Errorf("Expected boot order %v, got %v", want, bm.bootOrder)
+	}
+}
+
+// devicePathModeEFIVariables records the modes passed to NewFileDevicePath.
+type devicePathModeEFIVariables struct {
+	*MockEFIVariables
+	modes []efi_linux.FileDevicePathMode
+}
+
+func (m *devicePathModeEFIVariables) NewFileDevicePath(filepath string, mode efi_linux.FileDevicePathMode) (efi.DevicePath, error) {
+	m.modes = append(m.modes, mode)
+	return m.MockEFIVariables.NewFileDevicePath(filepath, mode)
+}
+
+func TestBootManagerFindOrCreateEntryDevicePathMode(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "path", []byte("file a"), 0644)
+	mockvars := &devicePathModeEFIVariables{MockEFIVariables: &MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{}, 123},
+		},
+	}}
+
+	bm, err := NewBootManagerForVariables(mockvars)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []DevicePathMode{DevicePathShortFormHD, DevicePathShortFormFile, DevicePathFull} {
+		if _, err := bm.FindOrCreateEntry(BootEntry{Filename: "path", Label: "desc", DevicePath: mode}, ""); err != nil {
+			t.Fatalf("could not create boot entry, error: %v", err)
+		}
+	}
+
+	want := []efi_linux.FileDevicePathMode{efi_linux.ShortFormPathHD, efi_linux.ShortFormPathFile, efi_linux.FullPath}
+	if !reflect.DeepEqual(mockvars.modes, want) {
+		t.Errorf("Expected device path modes %v, got %v", want, mockvars.modes)
+	}
+}
+
+func TestMockEFIVariables_newFileDevicePath(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim"), 0644)
+
+	mockvars := MockEFIVariables{}
+	for _, tc := range []struct {
+		mode efi_linux.FileDevicePathMode
+		want string
+	}{
+		{efi_linux.ShortFormPathHD, `\\EFI\ubuntu\shimx64.efi`},
+		{efi_linux.ShortFormPathFile, `\\EFI\ubuntu\shimx64.efi`},
+		{efi_linux.FullPath, `\PciRoot(0x0)\Pci(0x1f,0x0)\\EFI\ubuntu\shimx64.efi`},
+	} {
+		dp, err := mockvars.NewFileDevicePath("/boot/efi/EFI/ubuntu/shimx64.efi", tc.mode)
+		if err != nil {
+			t.Fatalf("Cannot create device path: %v", err)
+		}
+		if got := dp.ToString(0); got != tc.want {
+			t.Errorf("Expected device path %s for mode %d, got %s", tc.want, tc.mode, got)
+		}
+	}
+}
+
+func TestBootManagerListEntries(t *testing.T) {
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 123},
+			{GUID: efi.GlobalVariable, Name: "Boot000A"}:  {UsbrBootCdromOptBytes, 7},
+			{GUID: efi.GlobalVariable, Name: "Boot0003"}:  {UsbrBootCdromOptBytes, 7},
+			{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 7},
+			{GUID: efi.GlobalVariable, Name: "Boot0002"}:  {[]byte{1, 0, 0}, 7},
+		},
+	}
+
+	bm, err := NewBootManagerForVariables(&mockvars)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []int
+	for _, entry := range bm.ListEntries() {
+		got = append(got, entry.BootNumber)
+	}
+	if want := []int{1, 2, 3, 10}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected entries %v, got %v", want, got)
+	}
+
+	entry, ok := bm.Entry(3)
+	if !ok || entry.BootNumber != 3 || entry.Description() != "USBR BOOT CDROM" {
+		t.Errorf("Unexpected entry 3: %+v, %v", entry, ok)
+	}
+	if entry, ok := bm.Entry(2); !ok || entry.LoadOption != nil {
+		t.Errorf("Expected invalid entry 2, got %+v, %v", entry, ok)
+	}
+	if _, ok := bm.Entry(4); ok {
+		t.Errorf("Unexpected entry 4")
+	}
+}
+
+func TestBootManagerTimeout(t *testing.T) {
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{}, 123},
+		},
+	}
+
+	bm, err := NewBootManagerForVariables(&mockvars)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if timeout, ok, err := bm.GetTimeout(); err != nil || ok || timeout != 0 {
+		t.Errorf("Expected no timeout, got %d, %v, %v", timeout, ok, err)
+	}
+
+	for _, seconds := range []uint16{0, 5, 0x1234} {
+		if err := bm.SetTimeout(seconds); err != nil {
+			t.Fatalf("Could not set timeout: %v", err)
+		}
+		timeout, ok, err := bm.GetTimeout()
+		if err != nil || !ok || timeout != seconds {
+			t.Errorf("Expected timeout %d, got %d, %v, %v", seconds, timeout, ok, err)
+		}
+	}
+
+	v := mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "Timeout"}]
+	if want := []byte{0x34, 0x12}; !bytes.Equal(v.data, want) {
+		t.Errorf("Expected Timeout %v, got %v", want, v.data)
+	}
+	if want := efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess; v.attrs != want {
+		t.Errorf("Expected attributes %v, got %v", want, v.attrs)
+	}
+
+	mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "Timeout"}] = mockEFIVariable{[]byte{5}, 7}
+	if _, _, err := bm.GetTimeout(); err == nil || err.Error() != "invalid Timeout size 1" {
+		t.Errorf("Expected invalid size error, got %v", err)
+	}
+}
+
+func TestBootManagerOsIndications(t *testing.T) {
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{}, 123},
+		},
+	}
+
+	bm, err := NewBootManagerForVariables(&mockvars)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := bm.GetOsIndications(); err != nil || got != 0 {
+		t.Errorf("Expected no OsIndications, got %#x, %v", got, err)
+	}
+	if got, err := bm.GetOsIndicationsSupported(); err != nil || got != 0 {
+		t.Errorf("Expected no OsIndicationsSupported, got %#x, %v", got, err)
+	}
+	if err := bm.SetOsIndications(OsIndicationBootToFWUI); err == nil || err.Error() != "unsupported OsIndications 0x1, firmware supports 0x0" {
+		t.Errorf("Expected unsupported error, got %v", err)
+	}
+
+	mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "OsIndicationsSupported"}] = mockEFIVariable{
+		[]byte{0x05, 0, 0, 0, 0, 0, 0, 0}, efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess}
+
+	if got, err := bm.GetOsIndicationsSupported(); err != nil || got != OsIndicationBootToFWUI|OsIndicationFileCapsuleDeliverySupported {
+		t.Errorf("Unexpected OsIndicationsSupported %#x, %v", got, err)
+	}
+
+	if err := bm.SetOsIndications(OsIndicationBootToFWUI | OsIndicationStartOSRecovery); err == nil || err.Error() != "unsupported OsIndications 0x20, firmware supports 0x5" {
+		t.Errorf("Expected unsupported error, got %v", err)
+	}
+	if _, ok := mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "OsIndications"}]; ok {
+		t.Errorf("OsIndications was unexpectedly written")
+	}
+
+	if err := bm.SetOsIndications(OsIndicationBootToFWUI | OsIndicationFileCapsuleDeliverySupported); err != nil {
+		t.Fatalf("Could not set OsIndications: %v", err)
+	}
+	if got, err := bm.GetOsIndications(); err != nil || got != 0x5 {
+		t.Errorf("Expected OsIndications 0x5, got %#x, %v", got, err)
+	}
+	v := mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "OsIndications"}]
+	if want := []byte{0x05, 0, 0, 0, 0, 0, 0, 0}; !bytes.Equal(v.data, want) {
+		t.Errorf("Expected OsIndications %v, got %v", want, v.data)
+	}
+
+	if err := bm.SetOsIndications(0); err != nil {
+		t.Errorf("Could not clear OsIndications: %v", err)
+	}
+}
+
+func TestBootEntryVariableOptionalDataUTF8(t *testing.T) {
+	entry := BootEntryVariable{1, UsbrBootCdromOptBytes, 7, UsbrBootCdromOpt}
+	if got := entry.OptionalDataUTF8(); got != "" {
+		t.Errorf("Expected no optional data, got %q", got)
+	}
+	if want := efi.LoadOptionActive | efi.LoadOptionHidden; entry.LoadOption.Attributes != want {
+		t.Errorf("Expected attributes %v, got %v", want, entry.LoadOption.Attributes)
+	}
+
+	optionalData := new(bytes.Buffer)
+	binary.Write(optionalData, binary.LittleEndian, efi.ConvertUTF8ToUCS2("\\kernel.efi-1.0-1-generic root=magic\x00"))
+	entry = BootEntryVariable{LoadOption: &efi.LoadOption{
+		Attributes:   efi.LoadOptionActive,
+		Description:  "Ubuntu with kernel 1.0-1-generic",
+		FilePath:     efi.DevicePath{efi.NewFilePathDevicePathNode("\\EFI\\ubuntu\\shimx64.efi")},
+		OptionalData: optionalData.Bytes()}}
+	if want := "\\kernel.efi-1.0-1-generic root=magic"; entry.OptionalDataUTF8() != want {
+		t.Errorf("Expected %q, got %q", want, entry.OptionalDataUTF8())
+	}
+
+	if got := (BootEntryVariable{}).OptionalDataUTF8(); got != "" {
+		t.Errorf("Expected no optional data, got %q", got)
+	}
+}
+
+func TestBootEntryVariableAccessors(t *testing.T) {
+	entry := BootEntryVariable{1, UsbrBootCdromOptBytes, 7, UsbrBootCdromOpt}
+	if want := "USBR BOOT CDROM"; entry.Description() != want {
+		t.Errorf("Expected description %q, got %q", want, entry.Description())
+	}
+	if want := `\PciRoot(0x0)\Pci(0x14,0x0)\USB(0xb,0x1)`; entry.Path() != want {
+		t.Errorf("Expected path %q, got %q", want, entry.Path())
+	}
+
+	// None of the accessors panic on an invalid load option.
+	for _, entry := range []BootEntryVariable{{}, {BootNumber: 5, Data: []byte{1, 0, 0}}} {
+		if got := entry.Description(); got != "" {
+			t.Errorf("Expected no description, got %q", got)
+		}
+		if got := entry.Path(); got != "" {
+			t.Errorf("Expected no path, got %q", got)
+		}
+		if got := entry.OptionalDataUTF8(); got != "" {
+			t.Errorf("Expected no optional data, got %q", got)
+		}
+	}
+}
+
+func TestBootManagerDeleteEntry(t *testing.T) {
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0, 2, 0, 3, 0}, 7},
+			{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 7},
+			{GUID: efi.GlobalVariable, Name: "Boot0002"}:  {UsbrBootCdromOptBytes, 7},
 		},
 	}
 
@@ -155,12 +577,99 @@ func TestBootManagerDeleteEntry(t *testing.T) {
 		t.Errorf("Expected failure in deletion")
 	}
 }
+func TestDelVariable(t *testing.T) {
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "Boot0001"}: {UsbrBootCdromOptBytes, efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess},
+			{GUID: efi.GlobalVariable, Name: "PK"}:       {[]byte{1, 2, 3}, efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess | efi.AttributeTimeBasedAuthenticatedWriteAccess},
+		},
+	}
+
+	if err := DelVariable(&mockvars, efi.GlobalVariable, "Boot0001"); err != nil {
+		t.Errorf("Expected successful deletion, got %v", err)
+	}
+	if _, ok := mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "Boot0001"}]; ok {
+		t.Errorf("Expected Boot0001 to be deleted")
+	}
+	if err := DelVariable(&mockvars, efi.GlobalVariable, "Boot0001"); err != efi.ErrVarNotExist {
+		t.Errorf("Expected %v, got %v", efi.ErrVarNotExist, err)
+	}
+
+	if err := DelVariable(&mockvars, efi.GlobalVariable, "PK"); err != errAuthenticatedDelete {
+		t.Errorf("Expected %v, got %v", errAuthenticatedDelete, err)
+	}
+	if _, ok := mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "PK"}]; !ok {
+		t.Errorf("Expected PK not to be deleted")
+	}
+
+	if err := DelVariable(&NoEFIVariables{}, efi.GlobalVariable, "Boot0001"); err != efi.ErrVarsUnavailable {
+		t.Errorf("Expected %v, got %v", efi.ErrVarsUnavailable, err)
+	}
+}
+
+func TestVendorVariables(t *testing.T) {
+	vendor := shimGUID
+	attrs := efi.AttributeNonVolatile | efi.AttributeBootserviceAccess
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "Boot0001"}: {UsbrBootCdromOptBytes, 7},
+		},
+	}
+
+	if err := SetVariable(&mockvars, vendor, "MokSBState", []byte{1}, attrs); err != nil {
+		t.Fatalf("Could not set variable: %v", err)
+	}
+	data, gotAttrs, err := GetVariable(&mockvars, vendor, "MokSBState")
+	if err != nil {
+		t.Fatalf("Could not get variable: %v", err)
+	}
+	if !bytes.Equal(data, []byte{1}) || gotAttrs != attrs {
+		t.Errorf("Expected %v with attributes %v, got %v with attributes %v", []byte{1}, attrs, data, gotAttrs)
+	}
+	if _, _, err := GetVariable(&mockvars, efi.GlobalVariable, "MokSBState"); err != efi.ErrVarNotExist {
+		t.Errorf("Expected %v, got %v", efi.ErrVarNotExist, err)
+	}
+
+	names, err := GetVariableNames(&mockvars, vendor)
+	if err != nil {
+		t.Fatalf("Could not list variables: %v", err)
+	}
+	if want := []string{"MokSBState"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected %v, got %v", want, names)
+	}
+	names, err = GetVariableNames(&mockvars, efi.GlobalVariable)
+	if err != nil {
+		t.Fatalf("Could not list variables: %v", err)
+	}
+	if want := []string{"Boot0001"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected %v, got %v", want, names)
+	}
+
+	if err := DelVariable(&mockvars, vendor, "MokSBState"); err != nil {
+		t.Errorf("Expected successful deletion, got %v", err)
+	}
+	if _, _, err := GetVariable(&mockvars, vendor, "MokSBState"); err != efi.ErrVarNotExist {
+		t.Errorf("Expected %v, got %v", efi.ErrVarNotExist, err)
+	}
+	if _, ok := mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "Boot0001"}]; !ok {
+		t.Errorf("Expected Boot0001 not to be deleted")
+	}
+}
+
 func TestBootManagerSetBootOrder(t *testing.T) {
+	// Hidden entries are not prepended, so use a visible one
+	visible := *UsbrBootCdromOpt
+	visible.Attributes = efi.LoadOptionActive
+	visibleBytes, err := visible.Bytes()
+	if err != nil {
+		t.Fatalf("Cannot encode load option: %v", err)
+	}
+
 	mockvars := MockEFIVariables{
 		map[efi.VariableDescriptor]mockEFIVariable{
 			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0, 2, 0, 3, 0}, 123},
 			{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 42},
-			{GUID: efi.GlobalVariable, Name: "Boot0002"}:  {UsbrBootCdromOptBytes, 43},
+			{GUID: efi.GlobalVariable, Name: "Boot0002"}:  {visibleBytes, 43},
 		},
 	}
 	bm, err := NewBootManagerForVariables(&mockvars)
@@ -180,6 +689,169 @@ func TestBootManagerSetBootOrder(t *testing.T) {
 	}
 }
 
+func TestBootManagerNoBootOrder(t *testing.T) {
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "Boot0001"}: {UsbrBootCdromOptBytes, 7},
+			{GUID: efi.GlobalVariable, Name: "Boot0002"}: {UsbrBootCdromOptBytes, 7},
+		},
+	}
+	bm, err := NewBootManagerForVariables(&mockvars)
+	if err != nil {
+		t.Fatalf("Could not create boot manager: %v", err)
+	}
+
+	if len(bm.bootOrder) != 0 {
+		t.Errorf("Expected empty boot order, got %v", bm.bootOrder)
+	}
+	if want := efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess; bm.bootOrderAttrs != want {
+		t.Errorf("Expected boot order attributes %v, got %v", want, bm.bootOrderAttrs)
+	}
+	if entries := bm.ListEntries(); len(entries) != 2 || entries[0].BootNumber != 1 || entries[1].BootNumber != 2 {
+		t.Errorf("Unexpected entries %+v", entries)
+	}
+}
+
+func TestBootManagerCreateBootOrder(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/boot/efi/path", []byte("file a"), 0644)
+	mockvars := MockEFIVariables{map[efi.VariableDescriptor]mockEFIVariable{}}
+	bm, err := NewBootManagerForVariables(&mockvars)
+	if err != nil {
+		t.Fatalf("Could not create boot manager: %v", err)
+	}
+
+	num, err := bm.FindOrCreateEntry(BootEntry{Filename: "/boot/efi/path", Label: "entry"}, "")
+	if err != nil {
+		t.Fatalf("could not create boot entry, error: %v", err)
+	}
+	if err := bm.PrependAndSetBootOrder([]int{num}); err != nil {
+		t.Fatalf("Failed to commit boot order: %v", err)
+	}
+
+	bootOrder, ok := mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "BootOrder"}]
+	if !ok {
+		t.Fatal("BootOrder was not created")
+	}
+	if want := []byte{0, 0}; !bytes.Equal(bootOrder.data, want) {
+		t.Errorf("Expected BootOrder %v, got %v", want, bootOrder.data)
+	}
+	// BootOrder must be non-volatile to survive a reboot
+	if want := efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess; bootOrder.attrs != want {
+		t.Errorf("Expected BootOrder attributes %v, got %v", want, bootOrder.attrs)
+	}
+}
+
+func TestBootManagerSetBootOrderHidden(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/boot/efi/path", []byte("file a"), 0644)
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 7},
+			{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 7},
+		},
+	}
+	bm, err := NewBootManagerForVariables(&mockvars)
+	if err != nil {
+		t.Fatalf("Could not create boot manager: %v", err)
+	}
+
+	hidden, err := bm.FindOrCreateEntry(BootEntry{Filename: "/boot/efi/path", Label: "hidden", Attributes: efi.LoadOptionActive | efi.LoadOptionHidden}, "")
+	if err != nil {
+		t.Fatalf("could not create hidden boot entry, error: %v", err)
+	}
+	app, err := bm.FindOrCreateEntry(BootEntry{Filename: "/boot/efi/path", Label: "app", Attributes: efi.LoadOptionActive | efi.LoadOptionCategoryApp}, "")
+	if err != nil {
+		t.Fatalf("could not create application entry, error: %v", err)
+	}
+	visible, err := bm.FindOrCreateEntry(BootEntry{Filename: "/boot/efi/path", Label: "visible"}, "")
+	if err != nil {
+		t.Fatalf("could not create boot entry, error: %v", err)
+	}
+
+	if want := efi.LoadOptionActive | efi.LoadOptionHidden; bm.entries[hidden].LoadOption.Attributes != want {
+		t.Errorf("Expected attributes %v, got %v", want, bm.entries[hidden].LoadOption.Attributes)
+	}
+	if want := efi.LoadOptionActive; bm.entries[visible].LoadOption.Attributes != want {
+		t.Errorf("Expected attributes %v, got %v", want, bm.entries[visible].LoadOption.Attributes)
+	}
+
+	if err := bm.PrependAndSetBootOrder([]int{hidden, app, visible}); err != nil {
+		t.Errorf("Failed to commit boot order: %v", err)
+	}
+	// The existing hidden Boot0001 stays in the order
+	if want := []int{visible, 1}; !reflect.DeepEqual(bm.bootOrder, want) {
+		t.Errorf("Expected boot order to be %v, got %v", want, bm.bootOrder)
+	}
+}
+
+func TestBootManagerMoveEntry(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		bootNum int
+		pos     int
+		want    []int
+	}{
+		{"front", 3, 0, []int{3, 1, 2}},
+		{"middle", 1, 1, []int{2, 1, 3}},
+		{"end", 1, 2, []int{2, 3, 1}},
+		{"clamp-front", 2, -1, []int{2, 1, 3}},
+		{"clamp-end", 1, 10, []int{2, 3, 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockvars := MockEFIVariables{
+				map[efi.VariableDescriptor]mockEFIVariable{
+					{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0, 2, 0, 3, 0}, 7},
+					{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 7},
+					{GUID: efi.GlobalVariable, Name: "Boot0002"}:  {UsbrBootCdromOptBytes, 7},
+					{GUID: efi.GlobalVariable, Name: "Boot0003"}:  {UsbrBootCdromOptBytes, 7},
+				},
+			}
+			bm, err := NewBootManagerForVariables(&mockvars)
+			if err != nil {
+				t.Fatalf("Could not create boot manager: %v", err)
+			}
+
+			if err := bm.MoveEntry(tc.bootNum, tc.pos); err != nil {
+				t.Fatalf("Failed to move entry: %v", err)
+			}
+			if !reflect.DeepEqual(bm.bootOrder, tc.want) {
+				t.Errorf("Expected boot order to be %v, got %v", tc.want, bm.bootOrder)
+			}
+
+			var want []byte
+			for _, num := range tc.want {
+				want = append(want, byte(num), 0)
+			}
+			if got := mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "BootOrder"}].data; !bytes.Equal(got, want) {
+				t.Errorf("Expected BootOrder %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestBootManagerMoveEntryNonExisting(t *testing.T) {
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 7},
+			{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 7},
+		},
+	}
+	bm, err := NewBootManagerForVariables(&mockvars)
+	if err != nil {
+		t.Fatalf("Could not create boot manager: %v", err)
+	}
+
+	if err := bm.MoveEntry(2, 0); err == nil || err.Error() != "cannot move non-existing variable Boot0002" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if want := []int{1}; !reflect.DeepEqual(bm.bootOrder, want) {
+		t.Errorf("Expected boot order to be %v, got %v", want, bm.bootOrder)
+	}
+}
+
 func TestBootManager_json(t *testing.T) {
 	memFs := afero.NewMemMapFs()
 	appFs = MapFS{memFs}
@@ -299,7 +971,184 @@ func TestBootManager_unsupported(t *testing.T) {
 		t.Fatalf("Unexpected success")
 	}
 
-	if err.Error() != "Variables not supported" {
+	if !errors.Is(err, ErrVariablesNotSupported) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestBootManager_dump(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/boot/efi/path", []byte("file a"), 0644)
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}:   {[]byte{1, 0, 2, 0}, 7},
+			{GUID: efi.GlobalVariable, Name: "BootCurrent"}: {[]byte{1, 0}, 6},
+			{GUID: efi.GlobalVariable, Name: "Boot0001"}:    {UsbrBootCdromOptBytes, 7},
+			{GUID: efi.GlobalVariable, Name: "Boot0002"}:    {[]byte{1, 2, 3}, 7},
+		},
+	}
+
+	bm, err := NewBootManagerForVariables(&mockvars)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := bm.FindOrCreateEntry(BootEntry{Filename: "/boot/efi/path", Label: "desc", Options: "arg1 arg2"}, ""); err != nil {
+		t.Fatalf("could not create next boot entry, error: %v", err)
+	}
+
+	jsonBytes, err := bm.Dump()
+	if err != nil {
+		t.Fatalf("Expected JSON, received err %v", err)
+	}
+
+	want := `{
+  "boot-current": 1,
+  "boot-order": [
+    1,
+    2
+  ],
+  "entries": [
+    {
+      "number": 0,
+      "valid": true,
+      "description": "desc",
+      "path": "\\\\path",
+      "options": "arg1 arg2"
+    },
+    {
+      "number": 1,
+      "valid": true,
+      "description": "USBR BOOT CDROM",
+      "path": "\\PciRoot(0x0)\\Pci(0x14,0x0)\\USB(0xb,0x1)",
+      "options": ""
+    },
+    {
+      "number": 2,
+      "valid": false,
+      "description": "",
+      "path": "",
+      "options": ""
+    }
+  ]
+}`
+	if string(jsonBytes) != want {
+		t.Fatalf("Expected\n%s\ngot\n%s", want, jsonBytes)
+	}
+
+	delete(mockvars.store, efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "BootCurrent"})
+	jsonBytes, err = bm.Dump()
+	if err != nil {
+		t.Fatalf("Expected JSON, received err %v", err)
+	}
+	var state struct {
+		BootCurrent *int `json:"boot-current"`
+	}
+	if err := json.Unmarshal(jsonBytes, &state); err != nil {
+		t.Fatalf("Unable to unmarshal JSON: %v", err)
+	}
+	if state.BootCurrent != nil {
+		t.Errorf("Expected no BootCurrent, got %d", *state.BootCurrent)
+	}
+}
+
+func TestMockEFIVariables_fromJSON(t *testing.T) {
+	vendorGUID := efi.MakeGUID(0x605dab50, 0xe046, 0x4300, 0xabb6, [...]uint8{0x3d, 0xd8, 0x10, 0xdd, 0x8b, 0x23})
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0, 2, 0, 3, 0}, 7},
+			{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 7},
+			{GUID: vendorGUID, Name: "MokListRT"}:         {[]byte{1, 2, 3}, 6},
+		},
+	}
+
+	jsonBytes, err := mockvars.JSON()
+	if err != nil {
+		t.Fatalf("Expected JSON, received err %v", err)
+	}
+
+	got, err := NewMockEFIVariablesFromJSON(jsonBytes)
+	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
+	if !reflect.DeepEqual(got.store, mockvars.store) {
+		t.Fatalf("Expected\n%v\ngot\n%v", mockvars.store, got.store)
+	}
+
+	for _, invalid := range []string{
+		`{"Boot0001": {"guid": "AAAA", "attributes": "BwA=", "value": ""}}`,
+		`{"Boot0001": {"guid": "Yd/ki8qT0hGqDQDgmAMrjA==", "attributes": "BwAAAA==", "value": ""}}`,
+		`{"Boot0001": {"guid": "Yd/ki8qT0hGqDQDgmAMrjA==", "attributes": "BwA=", "value": "!"}}`,
+		`[]`,
+	} {
+		if _, err := NewMockEFIVariablesFromJSON([]byte(invalid)); err == nil {
+			t.Errorf("Expected error decoding %s", invalid)
+		}
+	}
+}
+
+func TestMockEFIVariables_jsonVendorGUID(t *testing.T) {
+	vendorGUID := efi.MakeGUID(0x605dab50, 0xe046, 0x4300, 0xabb6, [...]uint8{0x3d, 0xd8, 0x10, 0xdd, 0x8b, 0x23})
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: vendorGUID, Name: "MokListRT"}: {[]byte{1, 2, 3}, 6},
+		},
+	}
+
+	jsonBytes, err := mockvars.JSON()
+	if err != nil {
+		t.Fatalf("Expected JSON, received err %v", err)
+	}
+
+	gotJSON := make(map[string]map[string]string)
+	if err := json.Unmarshal(jsonBytes, &gotJSON); err != nil {
+		t.Fatalf("Unable to unmarshal JSON: %v", err)
+	}
+
+	if want := "UKtdYEbgAEOrtj3YEN2LIw=="; gotJSON["MokListRT"]["guid"] != want {
+		t.Fatalf("Expected guid %s, got %s", want, gotJSON["MokListRT"]["guid"])
+	}
+}
+
+func TestReadOnlyEFIVariables(t *testing.T) {
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 7},
+			{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 7},
+		},
+	}
+	vars := ReadOnlyEFIVariables{&mockvars}
+
+	data, attrs, err := vars.GetVariable(efi.GlobalVariable, "BootOrder")
+	if err != nil {
+		t.Fatalf("Could not read BootOrder: %v", err)
+	}
+	if !bytes.Equal(data, []byte{1, 0}) || attrs != 7 {
+		t.Errorf("Unexpected BootOrder %v with attributes %v", data, attrs)
+	}
+	names, err := GetVariableNames(vars, efi.GlobalVariable)
+	if err != nil {
+		t.Fatalf("Could not list variables: %v", err)
+	}
+	if len(names) != 2 {
+		t.Errorf("Expected 2 variables, got %v", names)
+	}
+
+	if err := vars.SetVariable(efi.GlobalVariable, "BootOrder", []byte{2, 0}, 7); err != nil {
+		t.Errorf("Could not write BootOrder: %v", err)
+	}
+	if err := vars.SetVariable(efi.GlobalVariable, "Boot0002", UsbrBootCdromOptBytes, 7); err != nil {
+		t.Errorf("Could not write Boot0002: %v", err)
+	}
+	if err := vars.DeleteVariable(efi.GlobalVariable, "Boot0001"); err != nil {
+		t.Errorf("Could not delete Boot0001: %v", err)
+	}
+
+	want := map[efi.VariableDescriptor]mockEFIVariable{
+		{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 7},
+		{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 7},
+	}
+	if !reflect.DeepEqual(mockvars.store, want) {
+		t.Errorf("Expected variables to be unchanged, got %v", mockvars.store)
+	}
 }
@@ -0,0 +1,63 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+// DriverManager manages the UEFI drivers that the firmware loads before the
+// boot manager runs (Driver0000...DriverFFFF, ordered by DriverOrder), or the
+// system preparation applications (SysPrep0000...SysPrepFFFF, ordered by
+// SysPrepOrder). It shares its implementation with BootManager.
+type DriverManager struct {
+	bm BootManager
+}
+
+// NewDriverManagerForVariables returns a manager for the Driver variables.
+func NewDriverManagerForVariables(efivars EFIVariables) (DriverManager, error) {
+	bm, err := newLoadOptionManager(efivars, "Driver")
+	if err != nil {
+		return DriverManager{}, err
+	}
+	return DriverManager{bm}, nil
+}
+
+// NewSysPrepManagerForVariables returns a manager for the SysPrep variables.
+func NewSysPrepManagerForVariables(efivars EFIVariables) (DriverManager, error) {
+	bm, err := newLoadOptionManager(efivars, "SysPrep")
+	if err != nil {
+		return DriverManager{}, err
+	}
+	return DriverManager{bm}, nil
+}
+
+// FindOrCreateEntry finds a matching entry, or creates one if it is missing,
+// and returns its number. See BootManager.FindOrCreateEntry.
+func (dm *DriverManager) FindOrCreateEntry(entry BootEntry, relativeTo string) (int, error) {
+	return dm.bm.FindOrCreateEntry(entry, relativeTo)
+}
+
+// DeleteEntry deletes an entry. See BootManager.DeleteEntry.
+func (dm *DriverManager) DeleteEntry(num int) error {
+	return dm.bm.DeleteEntry(num)
+}
+
+// PrependAndSetOrder prepends the specified entries to the order and commits
+// it. See BootManager.PrependAndSetBootOrder.
+func (dm *DriverManager) PrependAndSetOrder(head []int) error {
+	return dm.bm.PrependAndSetBootOrder(head)
+}
+
+// ListEntries returns the entries, sorted by number.
+func (dm *DriverManager) ListEntries() []BootEntryVariable {
+	return dm.bm.ListEntries()
+}
+
+// Entry returns the entry with the specified number, if it exists.
+func (dm *DriverManager) Entry(num int) (BootEntryVariable, bool) {
+	return dm.bm.Entry(num)
+}
+
+// Order returns the order of the entries.
+func (dm *DriverManager) Order() []int {
+	return append([]int{}, dm.bm.bootOrder...)
+}
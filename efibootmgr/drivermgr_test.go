@@ -0,0 +1,129 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/canonical/go-efilib"
+	"github.com/spf13/afero"
+)
+
+func TestDriverManager_mocked(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "driver.efi", []byte("driver"), 0644)
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}:   {[]byte{0, 0}, 7},
+			{GUID: efi.GlobalVariable, Name: "Boot0000"}:    {UsbrBootCdromOptBytes, 7},
+			{GUID: efi.GlobalVariable, Name: "DriverOrder"}: {[]byte{1, 0}, 7},
+			{GUID: efi.GlobalVariable, Name: "Driver0001"}:  {UsbrBootCdromOptBytes, 7},
+		},
+	}
+
+	dm, err := NewDriverManagerForVariables(&mockvars)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if entries := dm.ListEntries(); len(entries) != 1 || entries[0].BootNumber != 1 {
+		t.Fatalf("Unexpected entries %+v", entries)
+	}
+	if want := []int{1}; !reflect.DeepEqual(dm.Order(), want) {
+		t.Fatalf("Expected %v, got: %v", want, dm.Order())
+	}
+
+	// This creates entry Driver0000
+	got, err := dm.FindOrCreateEntry(BootEntry{Filename: "driver.efi", Label: "NIC driver"}, "")
+	if err != nil {
+		t.Fatalf("could not create next driver entry, error: %v", err)
+	}
+	if want := 0; got != want {
+		t.Fatalf("expected to create Driver%04X, created Driver%04X", want, got)
+	}
+
+	driver0000, ok := mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "Driver0000"}]
+	if !ok {
+		t.Fatal("Variable Driver0000 does not exist")
+	}
+	optGot, err := efi.ReadLoadOption(bytes.NewReader(driver0000.data))
+	if err != nil {
+		t.Fatalf("Cannot decode load option: %v", err)
+	}
+	if want := "NIC driver"; optGot.Description != want {
+		t.Fatalf("Expected desc %v, got %v", want, optGot.Description)
+	}
+
+	// Check that the existing entry is not recreated
+	if got, err := dm.FindOrCreateEntry(BootEntry{Filename: "driver.efi", Label: "NIC driver"}, ""); err != nil || got != 0 {
+		t.Fatalf("expected to find Driver0000, got %d, %v", got, err)
+	}
+
+	// Entries are prepended regardless of the boot entry attributes
+	if err := dm.PrependAndSetOrder([]int{0, 1}); err != nil {
+		t.Fatalf("could not set driver order, error: %v", err)
+	}
+	if want := []byte{0, 0, 1, 0}; !bytes.Equal(mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "DriverOrder"}].data, want) {
+		t.Errorf("Expected DriverOrder %v, got %v", want, mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "DriverOrder"}].data)
+	}
+
+	if err := dm.DeleteEntry(0); err != nil {
+		t.Fatalf("could not delete driver entry, error: %v", err)
+	}
+	if _, ok := dm.Entry(0); ok {
+		t.Errorf("Driver0000 still exists")
+	}
+	if _, ok := mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "Driver0000"}]; ok {
+		t.Errorf("Variable Driver0000 still exists")
+	}
+	if want := []int{1}; !reflect.DeepEqual(dm.Order(), want) {
+		t.Errorf("Expected %v, got: %v", want, dm.Order())
+	}
+
+	// The boot entries are untouched
+	if _, ok := mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "Boot0000"}]; !ok {
+		t.Errorf("Variable Boot0000 was unexpectedly deleted")
+	}
+	if want := []byte{0, 0}; !bytes.Equal(mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "BootOrder"}].data, want) {
+		t.Errorf("BootOrder was unexpectedly changed")
+	}
+}
+
+func TestDriverManager_sysPrep(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "sysprep.efi", []byte("sysprep"), 0644)
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "Driver0000"}: {UsbrBootCdromOptBytes, 7},
+		},
+	}
+
+	dm, err := NewSysPrepManagerForVariables(&mockvars)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if entries := dm.ListEntries(); len(entries) != 0 {
+		t.Fatalf("Unexpected entries %+v", entries)
+	}
+
+	got, err := dm.FindOrCreateEntry(BootEntry{Filename: "sysprep.efi", Label: "Provisioning"}, "")
+	if err != nil || got != 0 {
+		t.Fatalf("expected to create SysPrep0000, got %d, %v", got, err)
+	}
+	if err := dm.PrependAndSetOrder([]int{got}); err != nil {
+		t.Fatalf("could not set sysprep order, error: %v", err)
+	}
+
+	if _, ok := mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "SysPrep0000"}]; !ok {
+		t.Errorf("Variable SysPrep0000 does not exist")
+	}
+	if want := []byte{0, 0}; !bytes.Equal(mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "SysPrepOrder"}].data, want) {
+		t.Errorf("Expected SysPrepOrder %v, got %v", want, mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "SysPrepOrder"}].data)
+	}
+}
@@ -8,21 +8,43 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"strings"
+	"syscall"
 
-	//"errors"
 	"github.com/canonical/go-efilib"
 	efi_linux "github.com/canonical/go-efilib/linux"
 )
 
+// errAuthenticatedDelete is returned when trying to delete an authenticated
+// variable, which requires writing a signed empty payload.
+var errAuthenticatedDelete = errors.New("variable must be deleted by setting an authenticated empty payload")
+
+// isAuthenticated indicates whether writes to a variable with the specified
+// attributes must be authenticated.
+func isAuthenticated(attrs efi.VariableAttributes) bool {
+	return attrs&(efi.AttributeAuthenticatedWriteAccess|efi.AttributeTimeBasedAuthenticatedWriteAccess|efi.AttributeEnhancedAuthenticatedAccess) != 0
+}
+
 // EFIVariables abstracts away the host-specific bits of the efivars module
 type EFIVariables interface {
 	ListVariables() ([]efi.VariableDescriptor, error)
 	GetVariable(guid efi.GUID, name string) (data []byte, attrs efi.VariableAttributes, err error)
 	SetVariable(guid efi.GUID, name string, data []byte, attrs efi.VariableAttributes) error
+	DeleteVariable(guid efi.GUID, name string) error
+
+	// NewFileDevicePath creates the device path for a file. This is how all
+	// boot entry device paths are created, see BootEntry.DevicePath.
 	NewFileDevicePath(filepath string, mode efi_linux.FileDevicePathMode) (efi.DevicePath, error)
 }
 
+var (
+	efiReadVariable  = efi.ReadVariable
+	efiWriteVariable = efi.WriteVariable
+)
+
 // RealEFIVariables provides the real implementation of efivars
 type RealEFIVariables struct{}
 
@@ -36,9 +58,57 @@ func (RealEFIVariables) GetVariable(guid efi.GUID, name string) (data []byte, at
 	return efi.ReadVariable(name, guid)
 }
 
-// SetVariable proxy
+// SetVariable proxy. If the variable store is full, an existing variable is
+// deleted and recreated once, see recreateVariable. go-efilib clears the
+// immutable flag of an existing variable while writing it.
 func (RealEFIVariables) SetVariable(guid efi.GUID, name string, data []byte, attrs efi.VariableAttributes) error {
-	return efi.WriteVariable(name, guid, attrs, data)
+	err := efiWriteVariable(name, guid, attrs, data)
+	if errors.Is(err, syscall.ENOSPC) {
+		return recreateVariable(guid, name, data, attrs, err)
+	}
+	return err
+}
+
+// recreateVariable works around firmware that writes the new value of a
+// variable to its store before invalidating the old value, as EDK2 does, so
+// that updating a variable fails when there isn't room for both values, eg,
+// when the store is fragmented. Deleting the variable first invalidates the
+// old value so that the firmware can reclaim its space for the new one. This
+// doesn't help when creating a new variable, and authenticated variables
+// can't be deleted, so writeErr is returned for those. If the new value still
+// doesn't fit, the old value is written back.
+func recreateVariable(guid efi.GUID, name string, data []byte, attrs efi.VariableAttributes, writeErr error) error {
+	old, oldAttrs, err := efiReadVariable(name, guid)
+	if err != nil || isAuthenticated(oldAttrs) {
+		return writeErr
+	}
+
+	log.Printf("Variable store is full writing %s, deleting and recreating it", name)
+	if err := efiWriteVariable(name, guid, oldAttrs, nil); err != nil {
+		return writeErr
+	}
+	if err := efiWriteVariable(name, guid, attrs, data); err != nil {
+		if err := efiWriteVariable(name, guid, oldAttrs, old); err != nil {
+			log.Printf("Could not restore %s after failing to recreate it: %v", name, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// DeleteVariable deletes the variable by removing its efivarfs file.
+// Authenticated variables cannot be deleted this way.
+func (RealEFIVariables) DeleteVariable(guid efi.GUID, name string) error {
+	_, attrs, err := efi.ReadVariable(name, guid)
+	if err != nil {
+		return err
+	}
+	if isAuthenticated(attrs) {
+		return errAuthenticatedDelete
+	}
+	// go-efilib removes the efivarfs file when writing an empty payload,
+	// clearing its immutable flag first.
+	return efi.WriteVariable(name, guid, attrs, nil)
 }
 
 // NewFileDevicePath proxy
@@ -46,6 +116,25 @@ func (RealEFIVariables) NewFileDevicePath(filepath string, mode efi_linux.FileDe
 	return efi_linux.NewFileDevicePath(filepath, mode)
 }
 
+// ReadOnlyEFIVariables wraps another EFIVariables implementation, passing
+// reads through to it and dropping writes. The writes that are dropped are
+// logged, so that it can be used to see what would be changed.
+type ReadOnlyEFIVariables struct {
+	EFIVariables
+}
+
+// SetVariable logs the write and drops it.
+func (ReadOnlyEFIVariables) SetVariable(guid efi.GUID, name string, data []byte, attrs efi.VariableAttributes) error {
+	log.Printf("Not writing variable %s-%s (read-only): %d bytes, attributes %#x", name, guid, len(data), uint32(attrs))
+	return nil
+}
+
+// DeleteVariable logs the delete and drops it.
+func (ReadOnlyEFIVariables) DeleteVariable(guid efi.GUID, name string) error {
+	log.Printf("Not deleting variable %s-%s (read-only)", name, guid)
+	return nil
+}
+
 type mockEFIVariable struct {
 	data  []byte
 	attrs efi.VariableAttributes
@@ -86,7 +175,22 @@ func (m *MockEFIVariables) SetVariable(guid efi.GUID, name string, data []byte,
 	return nil
 }
 
-// NewFileDevicePath implements EFIVariables
+// DeleteVariable implements EFIVariables
+func (m *MockEFIVariables) DeleteVariable(guid efi.GUID, name string) error {
+	key := efi.VariableDescriptor{Name: name, GUID: guid}
+	v, ok := m.store[key]
+	if !ok {
+		return efi.ErrVarNotExist
+	}
+	if isAuthenticated(v.attrs) {
+		return errAuthenticatedDelete
+	}
+	delete(m.store, key)
+	return nil
+}
+
+// NewFileDevicePath implements EFIVariables. The device path only contains
+// the file path, relative to /boot/efi, unless mode is efi_linux.FullPath.
 func (m MockEFIVariables) NewFileDevicePath(filepath string, mode efi_linux.FileDevicePathMode) (efi.DevicePath, error) {
 	file, err := appFs.Open(filepath)
 	if err != nil {
@@ -99,9 +203,17 @@ func (m MockEFIVariables) NewFileDevicePath(filepath string, mode efi_linux.File
 		filepath = filepath[len(espLocation):]
 	}
 
-	return efi.DevicePath{
+	path := efi.DevicePath{
 		efi.NewFilePathDevicePathNode(filepath),
-	}, nil
+	}
+	if mode == efi_linux.FullPath {
+		// Pretend the ESP is on a device below a fixed PCI root.
+		path = append(efi.DevicePath{
+			&efi.ACPIDevicePathNode{HID: 0x0a0341d0},
+			&efi.PCIDevicePathNode{Device: 0x1f, Function: 0},
+		}, path...)
+	}
+	return path, nil
 }
 
 // JSON renders the MockEFIVariables as an Azure JSON config
@@ -126,6 +238,48 @@ func (m MockEFIVariables) JSON() ([]byte, error) {
 	return json.MarshalIndent(payload, "", "  ")
 }
 
+// NewMockEFIVariablesFromJSON returns a MockEFIVariables populated from JSON
+// in the format produced by MockEFIVariables.JSON.
+func NewMockEFIVariablesFromJSON(data []byte) (*MockEFIVariables, error) {
+	var payload map[string]map[string]string
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, err
+	}
+
+	m := &MockEFIVariables{store: make(map[efi.VariableDescriptor]mockEFIVariable)}
+	for name, entry := range payload {
+		guid, err := base64.StdEncoding.DecodeString(entry["guid"])
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode guid of %s: %w", name, err)
+		}
+		if len(guid) != len(efi.GUID{}) {
+			return nil, fmt.Errorf("cannot decode guid of %s: invalid length %d", name, len(guid))
+		}
+		attrs, err := base64.StdEncoding.DecodeString(entry["attributes"])
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode attributes of %s: %w", name, err)
+		}
+		if len(attrs) != 2 {
+			return nil, fmt.Errorf("cannot decode attributes of %s: invalid length %d", name, len(attrs))
+		}
+		value, err := base64.StdEncoding.DecodeString(entry["value"])
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode value of %s: %w", name, err)
+		}
+
+		var key efi.VariableDescriptor
+		key.Name = name
+		copy(key.GUID[:], guid)
+		m.store[key] = mockEFIVariable{value, efi.VariableAttributes(binary.LittleEndian.Uint16(attrs))}
+	}
+
+	return m, nil
+}
+
+// ErrVariablesNotSupported is returned, possibly wrapped, when EFI variables
+// cannot be accessed, eg, in a container or a VM without efivarfs.
+var ErrVariablesNotSupported = errors.New("variables not supported")
+
 // VariablesSupported indicates whether variables can be accessed.
 func VariablesSupported(efiVars EFIVariables) bool {
 	_, err := efiVars.ListVariables()
@@ -147,15 +301,17 @@ func GetVariableNames(efiVars EFIVariables, filterGUID efi.GUID) (names []string
 	return names, nil
 }
 
+// GetVariable reads the variable with the specified GUID and name.
+func GetVariable(efivars EFIVariables, guid efi.GUID, name string) ([]byte, efi.VariableAttributes, error) {
+	return efivars.GetVariable(guid, name)
+}
+
+// SetVariable writes the variable with the specified GUID and name.
+func SetVariable(efivars EFIVariables, guid efi.GUID, name string, data []byte, attrs efi.VariableAttributes) error {
+	return efivars.SetVariable(guid, name, data, attrs)
+}
+
 // DelVariable deletes the non-authenticated variable with the specified name.
 func DelVariable(efivars EFIVariables, guid efi.GUID, name string) error {
-	_, attrs, err := efivars.GetVariable(guid, name)
-	if err != nil {
-		return err
-	}
-	// XXX: Update tests to not set these attributes in mock variables
-	//if attrs&(efi.AttributeAuthenticatedWriteAccess|efi.AttributeTimeBasedAuthenticatedWriteAccess|efi.AttributeEnhancedAuthenticatedAccess) != 0 {
-	//	return errors.New("variable must be deleted by setting an authenticated empty payload")
-	//}
-	return efivars.SetVariable(guid, name, nil, attrs)
+	return efivars.DeleteVariable(guid, name)
 }
@@ -0,0 +1,119 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+//go:build linux
+
+package efibootmgr
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/canonical/go-efilib"
+	"golang.org/x/sys/unix"
+)
+
+// mockEfiVariableIO mocks the reading and writing of Boot0001, which
+// currently has the supplied value, or doesn't exist if it is nil. Each
+// write fails with the next of the supplied errors, and the data of each
+// write is recorded, with nil for deletes.
+func mockEfiVariableIO(t *testing.T, current []byte, attrs efi.VariableAttributes, errs ...error) (writes *[][]byte) {
+	origRead, origWrite := efiReadVariable, efiWriteVariable
+	t.Cleanup(func() {
+		efiReadVariable, efiWriteVariable = origRead, origWrite
+	})
+
+	writes = new([][]byte)
+	efiReadVariable = func(name string, guid efi.GUID) ([]byte, efi.VariableAttributes, error) {
+		if name != "Boot0001" || guid != efi.GlobalVariable {
+			t.Errorf("Unexpected read of %s-%s", name, guid)
+		}
+		if current == nil {
+			return nil, 0, efi.ErrVarNotExist
+		}
+		return current, attrs, nil
+	}
+	efiWriteVariable = func(name string, guid efi.GUID, attrs efi.VariableAttributes, data []byte) error {
+		if name != "Boot0001" || guid != efi.GlobalVariable {
+			t.Errorf("Unexpected write of %s-%s", name, guid)
+		}
+		*writes = append(*writes, data)
+		if len(errs) == 0 {
+			return nil
+		}
+		err := errs[0]
+		errs = errs[1:]
+		return err
+	}
+	return writes
+}
+
+func TestRealEFIVariablesSetVariable(t *testing.T) {
+	writes := mockEfiVariableIO(t, []byte{9, 9}, 7)
+
+	if err := (RealEFIVariables{}).SetVariable(efi.GlobalVariable, "Boot0001", []byte{1, 2, 3}, 7); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if want := [][]byte{{1, 2, 3}}; !reflect.DeepEqual(*writes, want) {
+		t.Errorf("Expected writes %v, got %v", want, *writes)
+	}
+}
+
+func TestRealEFIVariablesSetVariableENOSPC(t *testing.T) {
+	writes := mockEfiVariableIO(t, []byte{9, 9}, 7, &os.PathError{Op: "write", Path: "Boot0001", Err: unix.ENOSPC})
+
+	if err := (RealEFIVariables{}).SetVariable(efi.GlobalVariable, "Boot0001", []byte{1, 2, 3}, 7); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	// The variable is deleted and recreated.
+	if want := [][]byte{{1, 2, 3}, nil, {1, 2, 3}}; !reflect.DeepEqual(*writes, want) {
+		t.Errorf("Expected writes %v, got %v", want, *writes)
+	}
+}
+
+func TestRealEFIVariablesSetVariableENOSPCTwice(t *testing.T) {
+	writes := mockEfiVariableIO(t, []byte{9, 9}, 7, unix.ENOSPC, nil, unix.ENOSPC)
+
+	if err := (RealEFIVariables{}).SetVariable(efi.GlobalVariable, "Boot0001", []byte{1, 2, 3}, 7); err != unix.ENOSPC {
+		t.Errorf("Expected %v, got %v", unix.ENOSPC, err)
+	}
+	// The old value is restored.
+	if want := [][]byte{{1, 2, 3}, nil, {1, 2, 3}, {9, 9}}; !reflect.DeepEqual(*writes, want) {
+		t.Errorf("Expected writes %v, got %v", want, *writes)
+	}
+}
+
+func TestRealEFIVariablesSetVariableENOSPCNewVariable(t *testing.T) {
+	writes := mockEfiVariableIO(t, nil, 0, unix.ENOSPC)
+
+	if err := (RealEFIVariables{}).SetVariable(efi.GlobalVariable, "Boot0001", []byte{1, 2, 3}, 7); err != unix.ENOSPC {
+		t.Errorf("Expected %v, got %v", unix.ENOSPC, err)
+	}
+	if want := [][]byte{{1, 2, 3}}; !reflect.DeepEqual(*writes, want) {
+		t.Errorf("Expected writes %v, got %v", want, *writes)
+	}
+}
+
+func TestRealEFIVariablesSetVariableENOSPCAuthenticated(t *testing.T) {
+	writes := mockEfiVariableIO(t, []byte{9, 9}, 7|efi.AttributeTimeBasedAuthenticatedWriteAccess, unix.ENOSPC)
+
+	if err := (RealEFIVariables{}).SetVariable(efi.GlobalVariable, "Boot0001", []byte{1, 2, 3}, 7); err != unix.ENOSPC {
+		t.Errorf("Expected %v, got %v", unix.ENOSPC, err)
+	}
+	if want := [][]byte{{1, 2, 3}}; !reflect.DeepEqual(*writes, want) {
+		t.Errorf("Expected writes %v, got %v", want, *writes)
+	}
+}
+
+func TestRealEFIVariablesSetVariableOtherError(t *testing.T) {
+	writes := mockEfiVariableIO(t, []byte{9, 9}, 7, efi.ErrVarPermission)
+
+	if err := (RealEFIVariables{}).SetVariable(efi.GlobalVariable, "Boot0001", []byte{1, 2, 3}, 7); err != efi.ErrVarPermission {
+		t.Errorf("Expected %v, got %v", efi.ErrVarPermission, err)
+	}
+	if want := [][]byte{{1, 2, 3}}; !reflect.DeepEqual(*writes, want) {
+		t.Errorf("Expected writes %v, got %v", want, *writes)
+	}
+}
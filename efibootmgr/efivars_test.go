@@ -27,6 +27,10 @@ func (NoEFIVariables) SetVariable(guid efi.GUID, name string, data []byte, attrs
 	return efi.ErrVarsUnavailable
 }
 
+func (NoEFIVariables) DeleteVariable(guid efi.GUID, name string) error {
+	return efi.ErrVarsUnavailable
+}
+
 func (NoEFIVariables) NewFileDevicePath(filepath string, mode efi_linux.FileDevicePathMode) (efi.DevicePath, error) {
 	return nil, errors.New("Cannot access")
 }
@@ -7,6 +7,7 @@ package efibootmgr
 import (
 	"bytes"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -49,8 +50,15 @@ type FS interface {
 	Stat(path string) (os.FileInfo, error)
 	// TempFile behaves like ioutil.TempFile()
 	TempFile(dir, prefix string) (File, error)
+	// Clone makes the existing file dst share the contents of src without
+	// copying them, or returns ErrCloneNotSupported if that isn't possible.
+	Clone(dst, src string) error
 }
 
+// ErrCloneNotSupported is returned from FS.Clone if the filesystem cannot
+// clone the file.
+var ErrCloneNotSupported = errors.New("cloning is not supported")
+
 // realFS implements FS using the os package
 type realFS struct{}
 
@@ -72,6 +80,30 @@ var appFs FS = realFS{}
 // is false, the state of the destination is unspecified. It might not exist, exist
 // with partial data or exist with old data, amongst others.
 func MaybeUpdateFile(dst string, src string) (updated bool, err error) {
+	return maybeUpdateFileWithProgress(dst, src, nil)
+}
+
+// progressWriter is an io.Writer that reports the number of bytes written so far
+// to a callback.
+type progressWriter struct {
+	w        io.Writer
+	copied   int64
+	total    int64
+	progress func(copied, total int64)
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.copied += int64(n)
+	if n > 0 {
+		w.progress(w.copied, w.total)
+	}
+	return n, err
+}
+
+// maybeUpdateFileWithProgress implements MaybeUpdateFile, calling progress, if
+// it is not nil, with the number of bytes copied so far and the size of src.
+func maybeUpdateFileWithProgress(dst string, src string, progress func(copied, total int64)) (updated bool, err error) {
 	srcFile, err := appFs.Open(src)
 	if err != nil {
 		return false, fmt.Errorf("Could not open source file: %w", err)
@@ -94,8 +126,28 @@ func MaybeUpdateFile(dst string, src string) (updated bool, err error) {
 		}
 	}()
 
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
-		return false, fmt.Errorf("Could not copy %s to %s: %w", src, dst, err)
+	// Try a cheap reflink first, and fall back to copying the data
+	switch cloneErr := appFs.Clone(dstFile.Name(), src); {
+	case cloneErr == nil:
+		if progress != nil {
+			if fi, err := srcFile.Stat(); err == nil {
+				progress(fi.Size(), fi.Size())
+			}
+		}
+	case errors.Is(cloneErr, ErrCloneNotSupported):
+		var w io.Writer = dstFile
+		if progress != nil {
+			fi, err := srcFile.Stat()
+			if err != nil {
+				return false, fmt.Errorf("Could not stat source file %s: %w", src, err)
+			}
+			w = &progressWriter{w: dstFile, total: fi.Size(), progress: progress}
+		}
+		if _, err := io.Copy(w, srcFile); err != nil {
+			return false, fmt.Errorf("Could not copy %s to %s: %w", src, dst, err)
+		}
+	default:
+		return false, fmt.Errorf("Could not clone %s to %s: %w", src, dst, cloneErr)
 	}
 
 	if err := appFs.Rename(dstFile.Name(), dst); err != nil {
@@ -105,6 +157,47 @@ func MaybeUpdateFile(dst string, src string) (updated bool, err error) {
 	return true, nil
 }
 
+// maybeWriteFile writes data to dst if its contents are different, replacing
+// it atomically. It returns true if the destination file was updated.
+func maybeWriteFile(dst string, data []byte) (updated bool, err error) {
+	switch dstFile, err := appFs.Open(dst); {
+	case os.IsNotExist(err):
+	case err != nil:
+		return false, fmt.Errorf("Could not open destination file: %w", err)
+	default:
+		current, err := ioutil.ReadAll(dstFile)
+		dstFile.Close()
+		if err != nil {
+			return false, fmt.Errorf("Could not read destination file %s: %w", dst, err)
+		}
+		if bytes.Equal(current, data) {
+			return false, nil
+		}
+	}
+
+	tmpFile, err := appFs.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".")
+	if err != nil {
+		return false, fmt.Errorf("Could not open %s for writing: %w", dst, err)
+	}
+	defer func() {
+		name := tmpFile.Name()
+		tmpFile.Close()
+		if err != nil {
+			appFs.Remove(name)
+		}
+	}()
+
+	if _, err := tmpFile.Write(data); err != nil {
+		return false, fmt.Errorf("Could not write %s: %w", dst, err)
+	}
+
+	if err := appFs.Rename(tmpFile.Name(), dst); err != nil {
+		return false, fmt.Errorf("cannot rename %s to %s: %w", tmpFile.Name(), dst, err)
+	}
+
+	return true, nil
+}
+
 func needUpdateFile(dst string, src string, srcFile File) (bool, error) {
 	// To keep things simple, but not have the files in memory, just hash them
 	dstHash := sha256.New()
@@ -120,6 +213,19 @@ func needUpdateFile(dst string, src string, srcFile File) (bool, error) {
 
 	defer dstFile.Close()
 
+	// Files of different sizes obviously differ, so avoid reading them
+	dstInfo, err := dstFile.Stat()
+	if err != nil {
+		return false, fmt.Errorf("Could not stat destination file %s: %w", dst, err)
+	}
+	srcInfo, err := srcFile.Stat()
+	if err != nil {
+		return false, fmt.Errorf("Could not stat source file %s: %w", src, err)
+	}
+	if dstInfo.Size() != srcInfo.Size() {
+		return true, nil
+	}
+
 	if _, err := io.Copy(dstHash, dstFile); err != nil {
 		return false, fmt.Errorf("Could not hash destination file %s: %w", dst, err)
 	}
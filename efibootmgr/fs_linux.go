@@ -0,0 +1,42 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+//go:build linux
+
+package efibootmgr
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var unixIoctlFileClone = unix.IoctlFileClone
+
+// Clone clones src to dst with FICLONE, which is supported by filesystems
+// such as btrfs and XFS.
+func (realFS) Clone(dst, src string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+
+	err = unixIoctlFileClone(int(dstFile.Fd()), int(srcFile.Fd()))
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, unix.EOPNOTSUPP), errors.Is(err, unix.EXDEV), errors.Is(err, unix.EINVAL), errors.Is(err, unix.ENOTTY):
+		return ErrCloneNotSupported
+	default:
+		return &os.PathError{Op: "clone", Path: dst, Err: err}
+	}
+}
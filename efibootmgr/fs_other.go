@@ -0,0 +1,12 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+//go:build !linux
+
+package efibootmgr
+
+// Clone is not supported on this system.
+func (realFS) Clone(dst, src string) error {
+	return ErrCloneNotSupported
+}
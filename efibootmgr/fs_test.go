@@ -10,6 +10,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"reflect"
 	"syscall"
 	"testing"
 
@@ -68,6 +70,122 @@ func (m MapFS) Remove(path string) error                  { return m.p.Remove(pa
 func (m MapFS) Rename(oldname, newname string) error      { return m.p.Rename(oldname, newname) }
 func (m MapFS) Stat(path string) (os.FileInfo, error)     { return m.p.Stat(path) }
 func (m MapFS) TempFile(dir, prefix string) (File, error) { return afero.TempFile(m.p, dir, prefix) }
+func (m MapFS) Clone(dst, src string) error               { return ErrCloneNotSupported }
+
+// cloningFS is a MapFS which supports cloning files.
+type cloningFS struct {
+	MapFS
+	clones   int
+	cloneErr error
+}
+
+func (m *cloningFS) Clone(dst, src string) error {
+	m.clones++
+	if m.cloneErr != nil {
+		return m.cloneErr
+	}
+	data, err := afero.ReadFile(m.p, src)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(m.p, dst, data, 0644)
+}
+
+// readCountingFS is a MapFS which counts the reads from each file.
+type readCountingFS struct {
+	MapFS
+	reads map[string]int
+}
+
+type readCountingFile struct {
+	File
+	fs *readCountingFS
+}
+
+func (f readCountingFile) Read(p []byte) (int, error) {
+	f.fs.reads[f.Name()]++
+	return f.File.Read(p)
+}
+
+func (m *readCountingFS) Open(path string) (File, error) {
+	f, err := m.MapFS.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return readCountingFile{f, m}, nil
+}
+
+// chunkedReadFS is a MapFS which returns at most chunk bytes from each read.
+type chunkedReadFS struct {
+	MapFS
+	chunk int
+}
+
+type chunkedReadFile struct {
+	File
+	chunk int
+}
+
+func (f chunkedReadFile) Read(p []byte) (int, error) {
+	if len(p) > f.chunk {
+		p = p[:f.chunk]
+	}
+	return f.File.Read(p)
+}
+
+func (m chunkedReadFS) Open(path string) (File, error) {
+	f, err := m.MapFS.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return chunkedReadFile{f, m.chunk}, nil
+}
+
+// openHookFS is a MapFS which calls hook with the path of each file opened.
+type openHookFS struct {
+	MapFS
+	hook func(path string)
+}
+
+func (m openHookFS) Open(path string) (File, error) {
+	m.hook(path)
+	return m.MapFS.Open(path)
+}
+
+// renameErrorFS is a MapFS which returns the supplied errors when renaming a
+// file to specific paths.
+type renameErrorFS struct {
+	MapFS
+	errs map[string]error
+}
+
+func (m renameErrorFS) Rename(oldpath, newpath string) error {
+	if err, ok := m.errs[newpath]; ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	return m.MapFS.Rename(oldpath, newpath)
+}
+
+// statErrorFS is a MapFS which returns the supplied errors from Stat and
+// ReadDir for specific paths.
+type statErrorFS struct {
+	MapFS
+	errs map[string]error
+}
+
+func (m statErrorFS) ReadDir(path string) ([]os.DirEntry, error) {
+	if err, ok := m.errs[path]; ok {
+		return nil, &os.PathError{Op: "readdir", Path: path, Err: err}
+	}
+	return m.MapFS.ReadDir(path)
+}
+
+func (m statErrorFS) Stat(path string) (os.FileInfo, error) {
+	if err, ok := m.errs[path]; ok {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	return m.MapFS.Stat(path)
+}
 
 type mapFsMixin struct {
 	restoreFs func()
@@ -232,3 +350,145 @@ func TestMaybeUpdateFile_sameFile(t *testing.T) {
 		t.Errorf("file \"%s\" does not exist.\n", "dst")
 	}
 }
+
+func TestMaybeUpdateFile_clone(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	fs := &cloningFS{MapFS: MapFS{memFs}}
+	appFs = fs
+	afero.WriteFile(memFs, "src", []byte("file b"), 0644)
+	afero.WriteFile(memFs, "dst", []byte("file a"), 0644)
+	updated, err := MaybeUpdateFile("dst", "src")
+	if err != nil {
+		t.Errorf("Could not update file: %v", err)
+	}
+	if !updated {
+		t.Errorf("Did not update")
+	}
+	if fs.clones != 1 {
+		t.Errorf("Expected 1 clone, got %d", fs.clones)
+	}
+
+	dstBytes, err := afero.ReadFile(memFs, "dst")
+	if err != nil {
+		t.Errorf("Could not read dst: %v", err)
+	}
+	if want := []byte("file b"); !bytes.Equal(want, dstBytes) {
+		t.Errorf("Expected: %v, got: %v", want, dstBytes)
+	}
+}
+
+func TestMaybeUpdateFile_cloneProgress(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	appFs = &cloningFS{MapFS: MapFS{memFs}}
+	afero.WriteFile(memFs, "src", []byte("file b"), 0644)
+
+	var calls [][2]int64
+	updated, err := maybeUpdateFileWithProgress("dst", "src", func(copied, total int64) {
+		calls = append(calls, [2]int64{copied, total})
+	})
+	if err != nil || !updated {
+		t.Fatalf("Could not update file: %v, %v", updated, err)
+	}
+	if want := [][2]int64{{6, 6}}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("Expected %v, got %v", want, calls)
+	}
+}
+
+func TestMaybeUpdateFile_cloneError(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	appFs = &cloningFS{MapFS: MapFS{memFs}, cloneErr: syscall.EIO}
+	afero.WriteFile(memFs, "src", []byte("file b"), 0644)
+	updated, err := MaybeUpdateFile("dst", "src")
+	if !errors.Is(err, syscall.EIO) {
+		t.Errorf("Expected to fail with EIO, got: %v", err)
+	}
+	if updated {
+		t.Errorf("Expected not to have updated, but somehow did")
+	}
+	if _, err := memFs.Stat("dst"); !os.IsNotExist(err) {
+		t.Errorf("file \"%s\" exists or something\n", "dst")
+	}
+	if entries, _ := afero.ReadDir(memFs, "."); len(entries) != 1 {
+		t.Errorf("Expected temporary file to be removed, got %v", entries)
+	}
+}
+
+func TestRealFSClone(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	if err := os.WriteFile(src, []byte("file b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Whether this works depends on the filesystem of the temporary directory
+	switch err := (realFS{}).Clone(dst, src); {
+	case err == ErrCloneNotSupported:
+	case err != nil:
+		t.Errorf("Unexpected error: %v", err)
+	default:
+		dstBytes, err := os.ReadFile(dst)
+		if err != nil {
+			t.Errorf("Could not read dst: %v", err)
+		}
+		if want := []byte("file b"); !bytes.Equal(want, dstBytes) {
+			t.Errorf("Expected: %v, got: %v", want, dstBytes)
+		}
+	}
+}
+
+func TestMaybeUpdateFile_sizeMismatch(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	fs := &readCountingFS{MapFS: MapFS{memFs}, reads: make(map[string]int)}
+	appFs = fs
+	afero.WriteFile(memFs, "src", []byte("file b"), 0644)
+	afero.WriteFile(memFs, "dst", []byte("file"), 0644)
+	updated, err := MaybeUpdateFile("dst", "src")
+	if err != nil {
+		t.Errorf("Could not update file: %v", err)
+	}
+	if !updated {
+		t.Errorf("Did not update")
+	}
+
+	// The destination isn't hashed
+	if fs.reads["dst"] != 0 {
+		t.Errorf("Expected dst not to be read, got %d reads", fs.reads["dst"])
+	}
+	dstBytes, err := afero.ReadFile(memFs, "dst")
+	if err != nil {
+		t.Errorf("Could not read dst: %v", err)
+	}
+	if want := []byte("file b"); !bytes.Equal(want, dstBytes) {
+		t.Errorf("Expected: %v, got: %v", want, dstBytes)
+	}
+}
+
+func benchmarkMaybeUpdateFile(b *testing.B, dstSize int) {
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	src := bytes.Repeat([]byte{0xa5}, 16<<20)
+	afero.WriteFile(memFs, "src", src, 0644)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		afero.WriteFile(memFs, "dst", make([]byte, dstSize), 0644)
+		b.StartTimer()
+
+		if _, err := MaybeUpdateFile("dst", "src"); err != nil {
+			b.Fatalf("Could not update file: %v", err)
+		}
+	}
+}
+
+func BenchmarkMaybeUpdateFile_sameSize(b *testing.B) {
+	benchmarkMaybeUpdateFile(b, 16<<20)
+}
+
+func BenchmarkMaybeUpdateFile_sizeMismatch(b *testing.B) {
+	benchmarkMaybeUpdateFile(b, 8<<20)
+}
@@ -26,8 +26,9 @@ import (
 // TOCTOU type bugs and without having to read and keep the entire file in
 // memory whilst it is being used.
 type hashedFile struct {
-	file File
-	sz   int64
+	file      File
+	sz        int64
+	blockSize int64
 
 	alg              crypto.Hash
 	closeNotify      func([][]byte)
@@ -36,10 +37,17 @@ type hashedFile struct {
 	cachedBlock      []byte
 }
 
-// newHashedFile creates a new hashedFile from the supplied file handle. When the
-// file is closed, the supplied closeNotify callback will be called with a list
-// of per-block hashes from the file.
-func newHashedFile(f File, alg crypto.Hash, closeNotify func([][]byte)) (*hashedFile, error) {
+// newHashedFile creates a new hashedFile from the supplied file handle, which
+// hashes blocks of the specified size. When the file is closed, the supplied
+// closeNotify callback will be called with a list of per-block hashes from the
+// file. The per-block hashes depend on the block size, so they only match the
+// trusted asset hashes if they are computed with the same block size, which is
+// normally hashBlockSize.
+func newHashedFile(f File, alg crypto.Hash, blockSize int, closeNotify func([][]byte)) (*hashedFile, error) {
+	if blockSize <= 0 {
+		return nil, fmt.Errorf("invalid block size %d", blockSize)
+	}
+
 	info, err := f.Stat()
 	if err != nil {
 		return nil, err
@@ -48,9 +56,10 @@ func newHashedFile(f File, alg crypto.Hash, closeNotify func([][]byte)) (*hashed
 	return &hashedFile{
 		file:             f,
 		sz:               info.Size(),
+		blockSize:        int64(blockSize),
 		alg:              alg,
 		closeNotify:      closeNotify,
-		leafHashes:       make([][]byte, (info.Size()+(hashBlockSize-1))/hashBlockSize),
+		leafHashes:       make([][]byte, (info.Size()+int64(blockSize-1))/int64(blockSize)),
 		cachedBlockIndex: -1}, nil
 }
 
@@ -66,10 +75,10 @@ func (f *hashedFile) readAndCacheBlock(i int64) error {
 	}
 
 	// Read the whole block
-	r := io.NewSectionReader(f.file, i*hashBlockSize, hashBlockSize)
+	r := io.NewSectionReader(f.file, i*f.blockSize, f.blockSize)
 
-	var block [hashBlockSize]byte
-	n, err := io.ReadFull(r, block[:])
+	block := make([]byte, f.blockSize)
+	n, err := io.ReadFull(r, block)
 	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
 		// Handle io.ErrUnexpectedEOF later.
 		return err
@@ -81,7 +90,7 @@ func (f *hashedFile) readAndCacheBlock(i int64) error {
 
 	// Hash the block
 	h := f.alg.New()
-	h.Write(block[:])
+	h.Write(block)
 
 	if len(f.leafHashes[i]) == 0 {
 		// This is the first time we read this block.
@@ -95,37 +104,42 @@ func (f *hashedFile) readAndCacheBlock(i int64) error {
 }
 
 func (f *hashedFile) ReadAt(p []byte, off int64) (n int, err error) {
-	// Calculate the starting block and number of blocks.
-	start := ((off + hashBlockSize) / hashBlockSize) - 1
-	end := ((off + int64(len(p)) + hashBlockSize) / hashBlockSize)
-	num := end - start
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	// Calculate the starting block and the block after the last one.
+	start := off / f.blockSize
+	end := (off + int64(len(p)) + (f.blockSize - 1)) / f.blockSize
 
 	// Read and hash each block.
-	for i := start; i < start+num; i++ {
-		if err := f.readAndCacheBlock(i); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+	for i := start; i < end; i++ {
+		if err := f.readAndCacheBlock(i); err == io.EOF {
 			break
+		} else if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return n, err
 		}
 
 		data := f.cachedBlock
-		if n == 0 {
-			off0 := off - (start * hashBlockSize)
+		if i == start {
+			off0 := off - (start * f.blockSize)
+			if off0 >= int64(len(data)) {
+				// Reading past the end of the file.
+				break
+			}
 			data = data[off0:]
 		}
-		sz := len(p) - n
-		if sz < len(data) {
-			data = data[:sz]
-		}
 
-		copy(p[n:], data)
-		n += len(data)
+		n += copy(p[n:], data)
 
-		if err != nil {
+		if int64(len(f.cachedBlock)) < f.blockSize {
+			// This is the last, partial, block.
 			break
 		}
 	}
 
-	if n == 0 {
-		return 0, io.EOF
+	if n < len(p) {
+		return n, io.EOF
 	}
 	return n, nil
 }
@@ -153,3 +167,25 @@ func (f *hashedFile) Close() error {
 func (f *hashedFile) Size() int64 {
 	return f.sz
 }
+
+// hashFileBlocks returns the size and per-block hashes of the file at the
+// specified path.
+func hashFileBlocks(path string, alg crypto.Hash) (sz int64, leafHashes [][]byte, err error) {
+	f, err := appFs.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	hf, err := newHashedFile(f, alg, hashBlockSize, func(hashes [][]byte) {
+		leafHashes = hashes
+	})
+	if err != nil {
+		f.Close()
+		return 0, nil, err
+	}
+	if err := hf.Close(); err != nil {
+		return 0, nil, err
+	}
+
+	return hf.Size(), leafHashes, nil
+}
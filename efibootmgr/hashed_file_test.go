@@ -8,6 +8,7 @@ import (
 	"crypto"
 	"errors"
 	"io"
+	"os"
 
 	"gopkg.in/check.v1"
 )
@@ -50,7 +51,7 @@ func (s *hashedFileSuite) testHashedFile(c *check.C, path string, blocks []testH
 	expectedHash := h.Sum(nil)
 	leafHashes = nil
 
-	hf, err := newHashedFile(f, crypto.SHA256, func(hashes [][]byte) {
+	hf, err := newHashedFile(f, crypto.SHA256, hashBlockSize, func(hashes [][]byte) {
 		leafHashes = hashes
 	})
 	c.Assert(err, check.IsNil)
@@ -112,3 +113,117 @@ func (s *hashedFileSuite) TestHashedFileReadSparse(c *check.C) {
 		{off: 20000, sz: 500, n: 20},
 	})
 }
+
+func (s *hashedFileSuite) TestHashedFileReadAtUnaligned(c *check.C) {
+	// The file size is not a multiple of the block size.
+	s.writeFile(c, "/foo", 0, 199, 3500)
+
+	f, err := appFs.Open("/foo")
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+
+	info, err := f.Stat()
+	c.Assert(err, check.IsNil)
+	sz := info.Size()
+	c.Assert(sz%hashBlockSize, check.Not(check.Equals), int64(0))
+
+	hf, err := newHashedFile(f, crypto.SHA256, hashBlockSize, func([][]byte) {})
+	c.Assert(err, check.IsNil)
+
+	lastBlock := (sz / hashBlockSize) * hashBlockSize
+	for _, off := range []int64{
+		0, 1, hashBlockSize - 1, hashBlockSize, hashBlockSize + 1,
+		3*hashBlockSize - 7, lastBlock - 1, lastBlock, lastBlock + 1,
+		sz - 100, sz - 1, sz, sz + 1, sz + hashBlockSize,
+	} {
+		for _, n := range []int{
+			0, 1, 7, hashBlockSize - 1, hashBlockSize, hashBlockSize + 1,
+			2*hashBlockSize + 13, 100, 200,
+		} {
+			expected := make([]byte, n)
+			expectedN, _ := f.ReadAt(expected, off)
+
+			data := make([]byte, n)
+			n, err := hf.ReadAt(data, off)
+			c.Check(n, check.Equals, expectedN, check.Commentf("off: %d, len: %d", off, len(data)))
+			c.Check(data, check.DeepEquals, expected, check.Commentf("off: %d, len: %d", off, len(data)))
+			// io.ReaderAt requires an error for short reads.
+			if expectedN == len(data) {
+				c.Check(err, check.IsNil, check.Commentf("off: %d, len: %d", off, len(data)))
+			} else {
+				c.Check(err, check.Equals, io.EOF, check.Commentf("off: %d, len: %d", off, len(data)))
+			}
+		}
+	}
+}
+
+func (s *hashedFileSuite) TestHashedFileReadAtModified(c *check.C) {
+	s.writeFile(c, "/foo", 0, 199, 3500)
+
+	f, err := s.fs.OpenFile("/foo", os.O_RDWR, 0)
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+
+	hf, err := newHashedFile(f, crypto.SHA256, hashBlockSize, func([][]byte) {})
+	c.Assert(err, check.IsNil)
+
+	data := make([]byte, 10)
+	_, err = hf.ReadAt(data, 100)
+	c.Check(err, check.IsNil)
+	_, err = hf.ReadAt(data, hashBlockSize+100)
+	c.Check(err, check.IsNil)
+
+	_, err = f.WriteAt([]byte("foo"), 0)
+	c.Check(err, check.IsNil)
+
+	n, err := hf.ReadAt(data, 100)
+	c.Check(n, check.Equals, 0)
+	c.Check(err, check.ErrorMatches, "hash check fail for block 0")
+}
+
+func (s *hashedFileSuite) TestHashedFileBlockSize(c *check.C) {
+	// 199 * 100 bytes, which is not a multiple of the block size.
+	s.writeFile(c, "/foo", 0, 199, 100)
+	const blockSize = 512
+
+	expected, err := s.fs.ReadFile("/foo")
+	c.Assert(err, check.IsNil)
+
+	var expectedLeafHashes [][]byte
+	for off := 0; off < len(expected); off += blockSize {
+		block := make([]byte, blockSize)
+		copy(block, expected[off:])
+		h := crypto.SHA256.New()
+		h.Write(block)
+		expectedLeafHashes = append(expectedLeafHashes, h.Sum(nil))
+	}
+	c.Assert(expectedLeafHashes, check.HasLen, 39)
+
+	f, err := appFs.Open("/foo")
+	c.Assert(err, check.IsNil)
+
+	var leafHashes [][]byte
+	hf, err := newHashedFile(f, crypto.SHA256, blockSize, func(hashes [][]byte) {
+		leafHashes = hashes
+	})
+	c.Assert(err, check.IsNil)
+
+	data := make([]byte, 1000)
+	n, err := hf.ReadAt(data, 300)
+	c.Check(err, check.IsNil)
+	c.Check(data[:n], check.DeepEquals, expected[300:1300])
+
+	c.Check(hf.Close(), check.IsNil)
+	c.Check(leafHashes, check.DeepEquals, expectedLeafHashes)
+}
+
+func (s *hashedFileSuite) TestHashedFileInvalidBlockSize(c *check.C) {
+	s.writeFile(c, "/foo", 0, 199, 1)
+
+	f, err := appFs.Open("/foo")
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+
+	_, err = newHashedFile(f, crypto.SHA256, 0, nil)
+	c.Check(err, check.ErrorMatches, "invalid block size 0")
+}
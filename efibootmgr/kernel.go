@@ -5,10 +5,16 @@
 package efibootmgr
 
 import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 	"path"
+	"reflect"
 	"sort"
 	"strings"
 
@@ -20,23 +26,62 @@ import (
 // It will update or install shim, copy in any new kernels,
 // remove old kernels, and configure boot in shim and BDS.
 type KernelManager struct {
-	sourceDir     string       // sourceDir is the location to copy kernels from
-	targetDir     string       // targetDir is a vendor directory on the ESP
-	sourceKernels []string     // kernels in sourceDir
-	targetKernels []string     // kernels in targetDir
-	bootEntries   []BootEntry  // boot entries filled by InstallKernels
-	kernelOptions string       // options to pass to kernel
-	bootManager   *BootManager // The EFI boot manager
+	esp              string       // esp is the mount point of the ESP
+	sourceDir        string       // sourceDir is the location to copy kernels from
+	targetDir        string       // targetDir is a vendor directory on the ESP
+	sourceKernels    []string     // kernels in sourceDir
+	targetKernels    []string     // kernels in targetDir
+	installedKernels []string     // kernels installed by InstallKernels
+	createdKernels   []string     // kernels created by InstallKernels, which didn't exist before
+	bootEntries      []BootEntry  // boot entries built by CommitToBootLoader
+	kernelOptions    string       // options to pass to kernel
+	bootManager      *BootManager // The EFI boot manager
+	shimBasename     string       // filename of shim in targetDir
+
+	backups []*KernelManager // managers for the backup ESPs, see NewKernelManagerForESPs
+
+	// KernelManagerConfig is shared with the managers for the backup ESPs,
+	// so that they are configured like this one.
+	*KernelManagerConfig
+}
+
+// KernelManagerConfig configures how a KernelManager installs kernels.
+type KernelManagerConfig struct {
+	// CmdlineTransform, if set, is called for each kernel with its ABI version
+	// and the configured command line, and returns the command line to use for
+	// that kernel.
+	CmdlineTransform func(version, cmdline string) (string, error)
+
+	// TrustedSigners, if set, enables checking that the Authenticode signature of
+	// each kernel chains to one of these certificates before it is installed.
+	TrustedSigners *x509.CertPool
+
+	// NXCompat selects whether kernels are checked for NX compatibility before
+	// they are installed.
+	NXCompat NXCompatCheck
+
+	// ProgressFunc, if set, is called while copying a kernel to the ESP with
+	// the path it is being installed to, the number of bytes copied so far
+	// and the size of the kernel.
+	ProgressFunc func(path string, copied, total int64)
+
+	// MaxInstalledKernels, if non-zero, limits the kernels installed to the ESP
+	// to this many of the newest source kernels. Older source kernels are not
+	// installed.
+	MaxInstalledKernels int
 }
 
 // NewKernelManager returns a new kernel manager managing kernels in the host system
-func NewKernelManager(esp, sourceDir, vendor string, bootManager *BootManager) (*KernelManager, error) {
+func NewKernelManager(esp, sourceDir string, shim ShimConfig, bootManager *BootManager) (*KernelManager, error) {
 	var km KernelManager
 	var err error
 
+	km.esp = esp
 	km.sourceDir = sourceDir
-	km.targetDir = path.Join(esp, "EFI", vendor)
+	km.targetDir = path.Join(esp, "EFI", shim.Vendor)
 	km.bootManager = bootManager
+	km.shimBasename = shim.basename()
+	km.KernelManagerConfig = new(KernelManagerConfig)
 
 	if file, err := appFs.Open("/etc/kernel/cmdline"); err == nil {
 		defer file.Close()
@@ -60,6 +105,36 @@ func NewKernelManager(esp, sourceDir, vendor string, bootManager *BootManager) (
 	return &km, nil
 }
 
+// NewKernelManagerForESPs returns a new kernel manager managing kernels on
+// several mirrored ESPs, eg, a primary ESP and a backup of it. Kernels are
+// installed to and removed from each ESP, and each kernel gets a boot entry
+// for each ESP, with the entries for the first ESP first in the boot order.
+func NewKernelManagerForESPs(esps []string, sourceDir string, shim ShimConfig, bootManager *BootManager) (*KernelManager, error) {
+	if len(esps) == 0 {
+		return nil, errors.New("Could not create kernel manager: no ESPs")
+	}
+
+	km, err := NewKernelManager(esps[0], sourceDir, shim, bootManager)
+	if err != nil {
+		return nil, err
+	}
+	for _, esp := range esps[1:] {
+		backup, err := NewKernelManager(esp, sourceDir, shim, bootManager)
+		if err != nil {
+			return nil, err
+		}
+		backup.KernelManagerConfig = km.KernelManagerConfig
+		km.backups = append(km.backups, backup)
+	}
+
+	return km, nil
+}
+
+// managers returns km followed by the managers for the backup ESPs.
+func (km *KernelManager) managers() []*KernelManager {
+	return append([]*KernelManager{km}, km.backups...)
+}
+
 // readKernels returns a list of all kernels in the
 func (km *KernelManager) readKernels(dir string) ([]string, error) {
 	var kernels []string
@@ -94,39 +169,201 @@ func getKernelABI(kernel string) string {
 	return kernel[len("kernel.efi-"):]
 }
 
-// InstallKernels installs the kernels to the ESP and builds up the boot entries
-// to commit using CommitToBootLoader()
+// kernelsToInstall returns the source kernels that should be installed to the
+// ESP, newest first, honoring MaxInstalledKernels.
+func (km *KernelManager) kernelsToInstall() []string {
+	if km.MaxInstalledKernels > 0 && len(km.sourceKernels) > km.MaxInstalledKernels {
+		return km.sourceKernels[:km.MaxInstalledKernels]
+	}
+	return km.sourceKernels
+}
+
+// InstallKernels installs the kernels to the ESP, recording the ones to build
+// boot entries for when calling CommitToBootLoader()
 func (km *KernelManager) InstallKernels() error {
-	km.bootEntries = nil
-	for _, sk := range km.sourceKernels {
-		updated, err := MaybeUpdateFile(path.Join(km.targetDir, sk),
-			path.Join(km.sourceDir, sk))
-		if err != nil {
-			log.Printf("Could not install kernel %s: %v", sk, err)
+	return km.InstallKernelsContext(context.Background())
+}
+
+// InstallKernelsContext is like InstallKernels, but stops before installing the
+// next kernel if ctx is done, and returns ctx.Err(). The kernels installed so
+// far are recorded for CommitToBootLoader().
+//
+// If installing a kernel fails for any other reason, the kernels that didn't
+// exist on the ESP before are removed again before returning the error, so
+// that a partially updated ESP doesn't end up with kernels which are not
+// referenced by the boot entries.
+func (km *KernelManager) InstallKernelsContext(ctx context.Context) error {
+	managers := km.managers()
+	for i, m := range managers {
+		err := m.installKernels(ctx)
+		if err == nil {
 			continue
 		}
+		if err != ctx.Err() {
+			for _, m := range managers[:i+1] {
+				m.rollbackInstalledKernels()
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// installKernels installs the kernels to the ESP of this manager only.
+func (km *KernelManager) installKernels(ctx context.Context) error {
+	km.installedKernels = nil
+	km.createdKernels = nil
+	for _, sk := range km.kernelsToInstall() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if km.TrustedSigners != nil {
+			if err := verifyImageFile(path.Join(km.sourceDir, sk), km.TrustedSigners); err != nil {
+				return fmt.Errorf("Could not verify signature of kernel %s: %w", sk, err)
+			}
+		}
+		if err := checkImageNXCompat(path.Join(km.sourceDir, sk), km.NXCompat); err != nil {
+			return fmt.Errorf("Could not check NX compatibility of kernel %s: %w", sk, err)
+		}
+		dst := path.Join(km.targetDir, sk)
+		var progress func(copied, total int64)
+		if km.ProgressFunc != nil {
+			progress = func(copied, total int64) {
+				km.ProgressFunc(dst, copied, total)
+			}
+		}
+		_, statErr := appFs.Stat(dst)
+		updated, err := maybeUpdateFileWithProgress(dst, path.Join(km.sourceDir, sk), progress)
+		if err != nil {
+			return fmt.Errorf("Could not install kernel %s: %w", sk, err)
+		}
 		if updated {
 			log.Printf("Installed or updated kernel %s", sk)
 		}
+		if os.IsNotExist(statErr) {
+			km.createdKernels = append(km.createdKernels, sk)
+		}
+		km.installedKernels = append(km.installedKernels, sk)
+	}
+
+	return nil
+}
+
+// rollbackInstalledKernels removes the kernels which were created on the ESP of
+// this manager by the last call to installKernels.
+func (km *KernelManager) rollbackInstalledKernels() {
+	created := make(map[string]bool)
+	for _, k := range km.createdKernels {
+		if err := appFs.Remove(path.Join(km.targetDir, k)); err != nil {
+			log.Printf("Could not remove kernel %s: %v", k, err)
+			continue
+		}
+		log.Printf("Removed kernel %s after a failed installation", k)
+		created[k] = true
+	}
+	km.createdKernels = nil
+
+	var installed []string
+	for _, k := range km.installedKernels {
+		if !created[k] {
+			installed = append(installed, k)
+		}
+	}
+	km.installedKernels = installed
+}
+
+// kernelCmdline returns the command line for the specified kernel, with
+// CmdlineTransform applied.
+func (km *KernelManager) kernelCmdline(kernel string) (string, error) {
+	if km.CmdlineTransform == nil {
+		return km.kernelOptions, nil
+	}
+	cmdline, err := km.CmdlineTransform(getKernelABI(kernel), km.kernelOptions)
+	if err != nil {
+		return "", fmt.Errorf("Could not transform command line for kernel %s: %w", kernel, err)
+	}
+	return cmdline, nil
+}
+
+// buildBootEntries builds the boot entries for the installed kernels
+func (km *KernelManager) buildBootEntries() error {
+	km.bootEntries = nil
+	for _, k := range km.installedKernels {
+		cmdline, err := km.kernelCmdline(k)
+		if err != nil {
+			return err
+		}
 		// It is worth pointing out that the argument for shim should start with \
 		// which here somehow denotes it is in the same directory rather than the root.
 		// FIXME: Extract vendor name out into config file
-		skVersion := getKernelABI(sk)
-		options := "\\" + sk
-		if km.kernelOptions != "" {
-			options += " " + km.kernelOptions
+		kVersion := getKernelABI(k)
+		options := "\\" + k
+		if cmdline != "" {
+			options += " " + cmdline
 		}
 		km.bootEntries = append(km.bootEntries, BootEntry{
-			Filename:    "shim" + GetEfiArchitecture() + ".efi",
-			Label:       fmt.Sprintf("Ubuntu with kernel %s", skVersion),
+			Filename:    km.shimBasename,
+			Label:       fmt.Sprintf("Ubuntu with kernel %s", kVersion),
 			Options:     options,
-			Description: fmt.Sprintf("Ubuntu entry for kernel %s", skVersion),
+			Description: fmt.Sprintf("Ubuntu entry for kernel %s", kVersion),
 		})
 	}
 
 	return nil
 }
 
+// InstalledAssets returns the paths of shim and the kernels in the ESP vendor
+// directory of each ESP, as found when the kernel manager was created.
+func (km *KernelManager) InstalledAssets() []string {
+	var paths []string
+	for _, m := range km.managers() {
+		paths = append(paths, path.Join(m.targetDir, m.shimBasename))
+		for _, tk := range m.targetKernels {
+			paths = append(paths, path.Join(m.targetDir, tk))
+		}
+	}
+	return paths
+}
+
+// DetectPartialInstalls compares the kernels installed in the vendor directory
+// of the ESP against the kernels in the source directory, and returns the paths
+// of installed kernels which differ from their source, eg, because a previous
+// copy was interrupted. Installed kernels with no source are ignored.
+func DetectPartialInstalls(esp, kernelSource, vendor string) ([]string, error) {
+	targetDir := path.Join(esp, "EFI", vendor)
+	entries, err := appFs.ReadDir(targetDir)
+	if err != nil {
+		return nil, fmt.Errorf("Could not determine kernels: %w", err)
+	}
+
+	var partial []string
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "kernel.efi-") {
+			continue
+		}
+
+		srcSz, srcHashes, err := hashFileBlocks(path.Join(kernelSource, e.Name()), crypto.SHA256)
+		switch {
+		case os.IsNotExist(err):
+			continue
+		case err != nil:
+			return nil, fmt.Errorf("Could not hash source kernel %s: %w", e.Name(), err)
+		}
+
+		dst := path.Join(targetDir, e.Name())
+		dstSz, dstHashes, err := hashFileBlocks(dst, crypto.SHA256)
+		if err != nil {
+			return nil, fmt.Errorf("Could not hash installed kernel %s: %w", e.Name(), err)
+		}
+
+		if dstSz != srcSz || !reflect.DeepEqual(dstHashes, srcHashes) {
+			partial = append(partial, dst)
+		}
+	}
+
+	return partial, nil
+}
+
 // IsObsoleteKernel checks whether a kernel is obsolete.
 func (km *KernelManager) isObsoleteKernel(k string) bool {
 	for _, sk := range km.sourceKernels {
@@ -137,13 +374,74 @@ func (km *KernelManager) isObsoleteKernel(k string) bool {
 	return true
 }
 
-// RemoveObsoleteKernels removes old kernels in the ESP vendor directory
-func (km *KernelManager) RemoveObsoleteKernels() error {
-	var remaining []string
+// ObsoleteKernels returns the paths of the kernels that RemoveObsoleteKernels
+// would remove, without removing them.
+func (km *KernelManager) ObsoleteKernels() []string {
+	var paths []string
+	for _, m := range km.managers() {
+		for _, tk := range m.obsoleteKernels() {
+			paths = append(paths, path.Join(m.targetDir, tk))
+		}
+	}
+	return paths
+}
+
+// obsoleteKernels returns the obsolete kernels on the ESP of this manager only.
+func (km *KernelManager) obsoleteKernels() []string {
+	var obsolete []string
 	for _, tk := range km.targetKernels {
-		if !km.isObsoleteKernel(tk) {
+		if km.isObsoleteKernel(tk) {
+			obsolete = append(obsolete, tk)
+		}
+	}
+	return obsolete
+}
+
+// RemoveObsoleteKernels removes old kernels in the ESP vendor directory, and
+// deletes the boot entries created for them and commits the boot order.
+func (km *KernelManager) RemoveObsoleteKernels() error {
+	removed := make(map[string]bool)
+	for _, m := range km.managers() {
+		for _, tk := range m.removeObsoleteKernels() {
+			removed[tk] = true
+		}
+	}
+
+	if km.bootManager == nil || len(removed) == 0 {
+		return nil
+	}
+
+	deleted := false
+	for _, ev := range km.bootManager.ListEntries() {
+		if !strings.HasPrefix(ev.Description(), ownEntryPrefix) {
 			continue
 		}
+		// The kernel is the first argument passed to shim
+		args := strings.Fields(strings.TrimRight(ev.OptionalDataUTF8(), "\x00"))
+		if len(args) == 0 || !strings.HasPrefix(args[0], "\\") || !removed[args[0][1:]] {
+			continue
+		}
+		if err := km.bootManager.DeleteEntry(ev.BootNumber); err != nil {
+			log.Printf("Could not delete Boot%04X: %v", ev.BootNumber, err)
+			continue
+		}
+		deleted = true
+	}
+
+	if !deleted {
+		return nil
+	}
+	if err := km.bootManager.PrependAndSetBootOrder(nil); err != nil {
+		return fmt.Errorf("Could not set boot order: %w", err)
+	}
+	return nil
+}
+
+// removeObsoleteKernels removes old kernels from the ESP of this manager only,
+// and returns the kernels it removed.
+func (km *KernelManager) removeObsoleteKernels() []string {
+	var remaining, removed []string
+	for _, tk := range km.obsoleteKernels() {
 		if err := appFs.Remove(path.Join(km.targetDir, tk)); err != nil {
 			log.Printf("Could not remove kernel %s: %v", tk, err)
 			remaining = append(remaining, tk)
@@ -151,20 +449,43 @@ func (km *KernelManager) RemoveObsoleteKernels() error {
 		}
 
 		log.Printf("Removed kernel %s", tk)
+		removed = append(removed, tk)
 	}
 
 	km.targetKernels = remaining
+	return removed
+}
 
-	return nil
+// createBootEntries adds new entries and finds existing ones for the installed
+// kernels, and returns their numbers, newest kernel first.
+func (km *KernelManager) createBootEntries() ([]int, error) {
+	var nums []int
+	for _, entry := range km.bootEntries {
+		bootNum, err := km.bootManager.FindOrCreateEntry(entry, km.targetDir)
+		if err != nil {
+			return nil, fmt.Errorf("Failure to add boot entry for %s: %w", entry.Label, err)
+		}
+		nums = append(nums, bootNum)
+	}
+	return nums, nil
 }
 
 // CommitToBootLoader updates the firmware BDS entries and shim's boot.csv
 func (km *KernelManager) CommitToBootLoader() error {
+	managers := km.managers()
+	for _, m := range managers {
+		if err := m.buildBootEntries(); err != nil {
+			return err
+		}
+	}
+
 	log.Print("Configuring shim fallback loader")
 
 	// We completely own the shim fallback file, so just write it
-	if err := WriteShimFallbackToFile(path.Join(km.targetDir, "BOOT"+strings.ToUpper(GetEfiArchitecture())+".CSV"), km.bootEntries); err != nil {
-		log.Printf("Failed to configure shim fallback loader: %v", err)
+	for _, m := range managers {
+		if err := WriteShimFallbackToFile(path.Join(m.targetDir, GetEfiArchitecture().FallbackCSVBasename()), m.bootEntries); err != nil {
+			log.Printf("Failed to configure shim fallback loader: %v", err)
+		}
 	}
 
 	if km.bootManager == nil {
@@ -175,19 +496,18 @@ func (km *KernelManager) CommitToBootLoader() error {
 
 	// This will become the head of the new boot order
 	var ourBootOrder []int
-
-	// Add new entries, find existing ones and build target boot order
-	for _, entry := range km.bootEntries {
-		bootNum, err := km.bootManager.FindOrCreateEntry(entry, km.targetDir)
+	for _, m := range managers {
+		nums, err := m.createBootEntries()
 		if err != nil {
-			return fmt.Errorf("Failure to add boot entry for %s: %w", entry.Label, err)
+			return err
 		}
-		ourBootOrder = append(ourBootOrder, bootNum)
+		ourBootOrder = append(ourBootOrder, nums...)
 	}
 
 	// Delete any obsolete kernels
+	deleted := false
 	for _, ev := range km.bootManager.entries {
-		if !strings.HasPrefix(ev.LoadOption.Description, "Ubuntu ") {
+		if !strings.HasPrefix(ev.Description(), ownEntryPrefix) {
 			continue
 		}
 		isObsolete := true
@@ -202,7 +522,17 @@ func (km *KernelManager) CommitToBootLoader() error {
 
 		if err := km.bootManager.DeleteEntry(ev.BootNumber); err != nil {
 			log.Printf("Could not delete Boot%04X: %v", ev.BootNumber, err)
+			continue
 		}
+		deleted = true
+	}
+
+	// Don't rewrite the boot order if our entries already lead it. Deleted
+	// entries are only dropped from the cached order, so it still needs to
+	// be written in that case.
+	if !deleted && km.bootManager.hasBootOrderHead(ourBootOrder) {
+		log.Print("Boot order is already up to date")
+		return nil
 	}
 
 	// Set the boot order
@@ -212,3 +542,176 @@ func (km *KernelManager) CommitToBootLoader() error {
 
 	return nil
 }
+
+// CommitAsBootNext creates the BDS entries for the installed kernels and sets
+// BootNext to the entry for the newest kernel, so that it is tried once on the
+// next boot. Unlike CommitToBootLoader, it doesn't change BootOrder, delete
+// obsolete entries or update shim's boot.csv, so that the kernel can be
+// promoted with CommitToBootLoader once it has booted successfully.
+func (km *KernelManager) CommitAsBootNext() error {
+	if err := km.buildBootEntries(); err != nil {
+		return err
+	}
+
+	if km.bootManager == nil {
+		return errors.New("Could not set BootNext: no boot manager")
+	}
+	if len(km.bootEntries) == 0 {
+		return errors.New("Could not set BootNext: no kernels installed")
+	}
+
+	nums, err := km.createBootEntries()
+	if err != nil {
+		return err
+	}
+
+	if err := km.bootManager.SetBootNext(nums[0]); err != nil {
+		return fmt.Errorf("Could not set BootNext: %w", err)
+	}
+
+	return nil
+}
+
+// blsEntryID returns the Boot Loader Specification entry id for a kernel, which
+// is also the basename of its entry file without the .conf suffix.
+func (km *KernelManager) blsEntryID(kernel string) string {
+	return path.Base(km.targetDir) + "-" + getKernelABI(kernel)
+}
+
+// WriteBLSEntries writes a Boot Loader Specification entry to loader/entries
+// on each ESP for each installed kernel, for use with BLS-aware boot loaders
+// such as systemd-boot instead of shim's boot.csv. Entries for kernels that
+// are no longer installed are removed.
+func (km *KernelManager) WriteBLSEntries() error {
+	for _, m := range km.managers() {
+		if err := m.writeBLSEntries(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBLSEntries writes the BLS entries to the ESP of this manager only.
+func (km *KernelManager) writeBLSEntries() error {
+	entriesDir := path.Join(km.esp, "loader", "entries")
+	if err := appFs.MkdirAll(entriesDir, 0755); err != nil {
+		return fmt.Errorf("Could not create BLS entries directory: %w", err)
+	}
+
+	ours := make(map[string]bool)
+	for _, k := range km.installedKernels {
+		cmdline, err := km.kernelCmdline(k)
+		if err != nil {
+			return err
+		}
+
+		kVersion := getKernelABI(k)
+		var b strings.Builder
+		fmt.Fprintf(&b, "title Ubuntu with kernel %s\n", kVersion)
+		fmt.Fprintf(&b, "version %s\n", kVersion)
+		fmt.Fprintf(&b, "efi %s\n", path.Join("/EFI", path.Base(km.targetDir), k))
+		if cmdline != "" {
+			fmt.Fprintf(&b, "options %s\n", cmdline)
+		}
+
+		name := km.blsEntryID(k) + ".conf"
+		updated, err := maybeWriteFile(path.Join(entriesDir, name), []byte(b.String()))
+		if err != nil {
+			return fmt.Errorf("Could not write BLS entry for kernel %s: %w", k, err)
+		}
+		if updated {
+			log.Printf("Wrote BLS entry %s", name)
+		}
+		ours[name] = true
+	}
+
+	entries, err := appFs.ReadDir(entriesDir)
+	if err != nil {
+		return fmt.Errorf("Could not determine BLS entries: %w", err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if ours[name] || !strings.HasPrefix(name, path.Base(km.targetDir)+"-") || !strings.HasSuffix(name, ".conf") {
+			continue
+		}
+		if err := appFs.Remove(path.Join(entriesDir, name)); err != nil {
+			log.Printf("Could not remove BLS entry %s: %v", name, err)
+			continue
+		}
+		log.Printf("Removed BLS entry %s", name)
+	}
+
+	return nil
+}
+
+// WriteLoaderConf updates loader/loader.conf on each ESP for systemd-boot to
+// boot the entry written by WriteBLSEntries for the newest installed kernel
+// by default, showing the menu for timeout seconds. Other settings in the
+// file are preserved, and it is only rewritten if its contents change.
+func (km *KernelManager) WriteLoaderConf(timeout int) error {
+	for _, m := range km.managers() {
+		if _, err := m.updateLoaderConf(timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateLoaderConf implements WriteLoaderConf, and returns whether the file was
+// updated.
+func (km *KernelManager) updateLoaderConf(timeout int) (bool, error) {
+	if timeout < 0 {
+		return false, fmt.Errorf("Invalid loader timeout %d", timeout)
+	}
+	if len(km.installedKernels) == 0 {
+		return false, errors.New("Could not configure loader: no kernels installed")
+	}
+
+	settings := []struct{ key, value string }{
+		{"default", km.blsEntryID(km.installedKernels[0]) + ".conf"},
+		{"timeout", fmt.Sprint(timeout)},
+	}
+
+	loaderConf := path.Join(km.esp, "loader", "loader.conf")
+	var lines []string
+	switch file, err := appFs.Open(loaderConf); {
+	case os.IsNotExist(err):
+	case err != nil:
+		return false, fmt.Errorf("Could not open loader.conf: %w", err)
+	default:
+		data, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return false, fmt.Errorf("Could not read loader.conf: %w", err)
+		}
+		if len(data) > 0 {
+			lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		}
+	}
+
+	for _, setting := range settings {
+		found := false
+		for i, line := range lines {
+			if fields := strings.Fields(line); len(fields) == 0 || fields[0] != setting.key {
+				continue
+			}
+			lines[i] = setting.key + " " + setting.value
+			found = true
+		}
+		if !found {
+			lines = append(lines, setting.key+" "+setting.value)
+		}
+	}
+
+	if err := appFs.MkdirAll(path.Dir(loaderConf), 0755); err != nil {
+		return false, fmt.Errorf("Could not create loader directory: %w", err)
+	}
+	updated, err := maybeWriteFile(loaderConf, []byte(strings.Join(lines, "\n")+"\n"))
+	if err != nil {
+		return false, fmt.Errorf("Could not write loader.conf: %w", err)
+	}
+	if updated {
+		log.Print("Updated loader.conf")
+	}
+	return updated, nil
+}
@@ -6,10 +6,13 @@ package efibootmgr
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"reflect"
-	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/canonical/go-efilib"
@@ -35,7 +38,7 @@ func CheckFilesEqual(fs afero.Fs, want string, got string) error {
 }
 
 func TestKernelManagerNewAndInstallKernels(t *testing.T) {
-	appArchitecture = "x64"
+	SetArchitecture("x64")
 	memFs := afero.NewMemMapFs()
 	appFs = MapFS{memFs}
 	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-12-generic", []byte("1.0-12-generic"), 0644)
@@ -56,7 +59,7 @@ func TestKernelManagerNewAndInstallKernels(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", "ubuntu", &bm)
+	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", ShimConfig{Vendor: "ubuntu"}, &bm)
 	if err != nil {
 		t.Fatalf("Could not create kernel manager: %v", err)
 	}
@@ -84,18 +87,18 @@ func TestKernelManagerNewAndInstallKernels(t *testing.T) {
 		t.Errorf("Could not commit to bootloader: %v", err)
 	}
 
-	file, err := memFs.Open("/boot/efi/EFI/ubuntu/BOOT" + strings.ToUpper(GetEfiArchitecture()) + ".CSV")
+	file, err := memFs.Open("/boot/efi/EFI/ubuntu/" + GetEfiArchitecture().FallbackCSVBasename())
 	if err != nil {
 		t.Fatalf("Could not open boot.csv: %v", err)
 	}
-	reader := transform.NewReader(file, unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewDecoder())
+	reader := transform.NewReader(file, unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM).NewDecoder())
 	data, err := ioutil.ReadAll(reader)
 	if err != nil {
 		t.Fatalf("Could not read boot.csv: %v", err)
 	}
 
-	want := ("shim" + GetEfiArchitecture() + ".efi,Ubuntu with kernel 1.0-1-generic,\\kernel.efi-1.0-1-generic root=magic ,Ubuntu entry for kernel 1.0-1-generic\n" +
-		"shim" + GetEfiArchitecture() + ".efi,Ubuntu with kernel 1.0-12-generic,\\kernel.efi-1.0-12-generic root=magic ,Ubuntu entry for kernel 1.0-12-generic\n")
+	want := (GetEfiArchitecture().ShimBasename() + ",Ubuntu with kernel 1.0-1-generic,\\kernel.efi-1.0-1-generic root=magic ,Ubuntu entry for kernel 1.0-1-generic\n" +
+		GetEfiArchitecture().ShimBasename() + ",Ubuntu with kernel 1.0-12-generic,\\kernel.efi-1.0-12-generic root=magic ,Ubuntu entry for kernel 1.0-12-generic\n")
 	if want != string(data) {
 		t.Errorf("Boot entry mismatch:\nExpected:\n%v\nGot:\n%v", want, string(data))
 	}
@@ -119,7 +122,7 @@ func TestKernelManagerNewAndInstallKernels(t *testing.T) {
 	}
 }
 func TestKernelManager_noCmdLine(t *testing.T) {
-	appArchitecture = "x64"
+	SetArchitecture("x64")
 	memFs := afero.NewMemMapFs()
 	appFs = MapFS{memFs}
 	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-12-generic", []byte("1.0-12-generic"), 0644)
@@ -139,7 +142,7 @@ func TestKernelManager_noCmdLine(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", "ubuntu", &bm)
+	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", ShimConfig{Vendor: "ubuntu"}, &bm)
 	if err := km.InstallKernels(); err != nil {
 		t.Errorf("Could not install kernels: %v", err)
 	}
@@ -148,18 +151,18 @@ func TestKernelManager_noCmdLine(t *testing.T) {
 		t.Errorf("Could not commit to bootloader: %v", err)
 	}
 
-	file, err := memFs.Open("/boot/efi/EFI/ubuntu/BOOT" + strings.ToUpper(GetEfiArchitecture()) + ".CSV")
+	file, err := memFs.Open("/boot/efi/EFI/ubuntu/" + GetEfiArchitecture().FallbackCSVBasename())
 	if err != nil {
 		t.Fatalf("Could not open boot.csv: %v", err)
 	}
-	reader := transform.NewReader(file, unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewDecoder())
+	reader := transform.NewReader(file, unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM).NewDecoder())
 	data, err := ioutil.ReadAll(reader)
 	if err != nil {
 		t.Fatalf("Could not read boot.csv: %v", err)
 	}
 
-	want := ("shim" + GetEfiArchitecture() + ".efi,Ubuntu with kernel 1.0-1-generic,\\kernel.efi-1.0-1-generic ,Ubuntu entry for kernel 1.0-1-generic\n" +
-		"shim" + GetEfiArchitecture() + ".efi,Ubuntu with kernel 1.0-12-generic,\\kernel.efi-1.0-12-generic ,Ubuntu entry for kernel 1.0-12-generic\n")
+	want := (GetEfiArchitecture().ShimBasename() + ",Ubuntu with kernel 1.0-1-generic,\\kernel.efi-1.0-1-generic ,Ubuntu entry for kernel 1.0-1-generic\n" +
+		GetEfiArchitecture().ShimBasename() + ",Ubuntu with kernel 1.0-12-generic,\\kernel.efi-1.0-12-generic ,Ubuntu entry for kernel 1.0-12-generic\n")
 	if want != string(data) {
 		t.Errorf("Boot entry mismatch:\nExpected:\n%v\nGot:\n%v", want, string(data))
 	}
@@ -183,8 +186,542 @@ func TestKernelManager_noCmdLine(t *testing.T) {
 	}
 }
 
+func TestKernelManager_invalidBootEntry(t *testing.T) {
+	SetArchitecture("x64")
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/shimx64.efi", []byte("file a"), 0644)
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{5, 0}, 123},
+			{GUID: efi.GlobalVariable, Name: "Boot0005"}:  {[]byte{1, 0, 0}, 7},
+		},
+	}
+
+	bm, err := NewBootManagerForVariables(&mockvars)
+	if err != nil {
+		t.Fatalf("Could not create boot manager: %v", err)
+	}
+	if entry, ok := bm.entries[5]; !ok || entry.LoadOption != nil {
+		t.Fatalf("Expected invalid boot entry 5, got %+v", entry)
+	}
+
+	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", ShimConfig{Vendor: "ubuntu"}, &bm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := km.InstallKernels(); err != nil {
+		t.Errorf("Could not install kernels: %v", err)
+	}
+	if err := km.CommitToBootLoader(); err != nil {
+		t.Errorf("Could not commit to bootloader: %v", err)
+	}
+
+	// The invalid entry is left alone.
+	if !reflect.DeepEqual(bm.bootOrder, []int{0, 5}) {
+		t.Errorf("Unexpected boot order %v", bm.bootOrder)
+	}
+	if _, ok := mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "Boot0005"}]; !ok {
+		t.Errorf("Invalid boot entry was unexpectedly deleted")
+	}
+}
+
+// setVariableEFIVariables records the names of the variables written.
+type setVariableEFIVariables struct {
+	*MockEFIVariables
+	written []string
+}
+
+func (m *setVariableEFIVariables) SetVariable(guid efi.GUID, name string, data []byte, attrs efi.VariableAttributes) error {
+	m.written = append(m.written, name)
+	return m.MockEFIVariables.SetVariable(guid, name, data, attrs)
+}
+
+func TestKernelManager_commitTwice(t *testing.T) {
+	SetArchitecture("x64")
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-12-generic", []byte("1.0-12-generic"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/shimx64.efi", []byte("file a"), 0644)
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 123},
+			{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 42},
+		},
+	}
+
+	var written [][]string
+	for i := 0; i < 2; i++ {
+		vars := setVariableEFIVariables{MockEFIVariables: &mockvars}
+		bm, err := NewBootManagerForVariables(&vars)
+		if err != nil {
+			t.Fatalf("Could not create boot manager: %v", err)
+		}
+		km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", ShimConfig{Vendor: "ubuntu"}, &bm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := km.InstallKernels(); err != nil {
+			t.Fatalf("Could not install kernels: %v", err)
+		}
+		if err := km.CommitToBootLoader(); err != nil {
+			t.Fatalf("Could not commit to bootloader: %v", err)
+		}
+		if want := []int{0, 2, 1}; !reflect.DeepEqual(bm.bootOrder, want) {
+			t.Errorf("Expected boot order %v, got %v", want, bm.bootOrder)
+		}
+		written = append(written, vars.written)
+	}
+
+	if want := []string{"Boot0000", "Boot0002", "BootOrder"}; !reflect.DeepEqual(written[0], want) {
+		t.Errorf("Expected first commit to write %v, got %v", want, written[0])
+	}
+	if len(written[1]) != 0 {
+		t.Errorf("Expected second commit to write nothing, got %v", written[1])
+	}
+}
+
+func TestKernelManagerCommitAsBootNext(t *testing.T) {
+	SetArchitecture("x64")
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-12-generic", []byte("1.0-12-generic"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/shimx64.efi", []byte("file a"), 0644)
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 123},
+			{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 42},
+		},
+	}
+
+	bm, err := NewBootManagerForVariables(&mockvars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", ShimConfig{Vendor: "ubuntu"}, &bm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := km.InstallKernels(); err != nil {
+		t.Errorf("Could not install kernels: %v", err)
+	}
+	if err := km.CommitAsBootNext(); err != nil {
+		t.Fatalf("Could not set BootNext: %v", err)
+	}
+
+	if want := []byte{1, 0}; !bytes.Equal(mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "BootOrder"}].data, want) {
+		t.Errorf("BootOrder was unexpectedly changed to %v", mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "BootOrder"}].data)
+	}
+
+	bootNext, ok := mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: "BootNext"}]
+	if !ok || len(bootNext.data) != 2 {
+		t.Fatalf("Unexpected BootNext %v", bootNext.data)
+	}
+	entry, ok := bm.Entry(int(bootNext.data[0]) | int(bootNext.data[1])<<8)
+	if want := "Ubuntu with kernel 1.0-12-generic"; !ok || entry.Description() != want {
+		t.Errorf("Expected BootNext to be %q, got %q", want, entry.Description())
+	}
+	if len(bm.ListEntries()) != 3 {
+		t.Errorf("Unexpected entries %v", bm.ListEntries())
+	}
+
+	if _, err := memFs.Stat("/boot/efi/EFI/ubuntu/BOOTX64.CSV"); err == nil {
+		t.Errorf("boot.csv was unexpectedly written")
+	}
+}
+
+func TestKernelManagerForESPs(t *testing.T) {
+	SetArchitecture("x64")
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-12-generic", []byte("1.0-12-generic"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/shimx64.efi", []byte("file a"), 0644)
+	afero.WriteFile(memFs, "/boot/efi2/EFI/ubuntu/shimx64.efi", []byte("file a"), 0644)
+	afero.WriteFile(memFs, "/boot/efi2/EFI/ubuntu/kernel.efi-0.9-1-generic", []byte("0.9-1-generic"), 0644)
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 123},
+			{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 42},
+		},
+	}
+
+	bm, err := NewBootManagerForVariables(&mockvars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bm.ESP = "/boot/efi"
+	bm.BackupESPs = []string{"/boot/efi2"}
+	km, err := NewKernelManagerForESPs([]string{"/boot/efi", "/boot/efi2"}, "/usr/lib/linux", ShimConfig{Vendor: "ubuntu"}, &bm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{
+		"/boot/efi/EFI/ubuntu/shimx64.efi",
+		"/boot/efi2/EFI/ubuntu/shimx64.efi",
+		"/boot/efi2/EFI/ubuntu/kernel.efi-0.9-1-generic",
+	}; !reflect.DeepEqual(km.InstalledAssets(), want) {
+		t.Errorf("Expected installed assets %v, got %v", want, km.InstalledAssets())
+	}
+
+	if err := km.InstallKernels(); err != nil {
+		t.Errorf("Could not install kernels: %v", err)
+	}
+	if err := km.RemoveObsoleteKernels(); err != nil {
+		t.Errorf("Could not remove obsolete kernels: %v", err)
+	}
+	if err := km.CommitToBootLoader(); err != nil {
+		t.Fatalf("Could not commit to boot loader: %v", err)
+	}
+
+	for _, esp := range []string{"/boot/efi", "/boot/efi2"} {
+		for _, k := range []string{"kernel.efi-1.0-12-generic", "kernel.efi-1.0-1-generic", "BOOTX64.CSV"} {
+			if _, err := memFs.Stat(esp + "/EFI/ubuntu/" + k); err != nil {
+				t.Errorf("%s was not installed to %s: %v", k, esp, err)
+			}
+		}
+	}
+	if _, err := memFs.Stat("/boot/efi2/EFI/ubuntu/kernel.efi-0.9-1-generic"); err == nil {
+		t.Errorf("Obsolete kernel was not removed from the backup ESP")
+	}
+
+	// Each kernel has an entry for each ESP, with the primary ESP first
+	type entry struct{ desc, file string }
+	var got []entry
+	for _, num := range bm.bootOrder {
+		e, _ := bm.Entry(num)
+		file, _ := entryFilePath(e.LoadOption)
+		got = append(got, entry{e.Description(), file})
+	}
+	want := []entry{
+		{"Ubuntu with kernel 1.0-12-generic", "EFI/ubuntu/shimx64.efi"},
+		{"Ubuntu with kernel 1.0-1-generic", "EFI/ubuntu/shimx64.efi"},
+		{"Ubuntu with kernel 1.0-12-generic", "boot/efi2/EFI/ubuntu/shimx64.efi"},
+		{"Ubuntu with kernel 1.0-1-generic", "boot/efi2/EFI/ubuntu/shimx64.efi"},
+		{"USBR BOOT CDROM", ""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected boot order %v, got %v", want, got)
+	}
+}
+
+func TestKernelManagerForESPsSharesConfig(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+	memFs.MkdirAll("/boot/efi/EFI/ubuntu", 0755)
+	memFs.MkdirAll("/boot/efi2/EFI/ubuntu", 0755)
+
+	km, err := NewKernelManagerForESPs([]string{"/boot/efi", "/boot/efi2"}, "/usr/lib/linux", ShimConfig{Vendor: "ubuntu"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	km.MaxInstalledKernels = 1
+	km.NXCompat = NXCompatRequire
+
+	backup := km.backups[0]
+	if backup.MaxInstalledKernels != 1 || backup.NXCompat != NXCompatRequire {
+		t.Errorf("Expected backup to share the configuration, got %+v", *backup.KernelManagerConfig)
+	}
+}
+
+func TestKernelManagerWriteBLSEntries(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		esp     string
+		cmdline string
+		want    map[string]string
+	}{
+		{
+			name:    "cmdline",
+			esp:     "/boot/efi",
+			cmdline: "root=magic console=ttyS0,115200",
+			want: map[string]string{
+				"ubuntu-1.0-12-generic.conf": "title Ubuntu with kernel 1.0-12-generic\n" +
+					"version 1.0-12-generic\n" +
+					"efi /EFI/ubuntu/kernel.efi-1.0-12-generic\n" +
+					"options root=magic console=ttyS0,115200\n",
+				"ubuntu-1.0-1-generic.conf": "title Ubuntu with kernel 1.0-1-generic\n" +
+					"version 1.0-1-generic\n" +
+					"efi /EFI/ubuntu/kernel.efi-1.0-1-generic\n" +
+					"options root=magic console=ttyS0,115200\n",
+				"other.conf": "title Other\n",
+			},
+		},
+		{
+			name: "no cmdline",
+			esp:  "/boot/efi",
+			want: map[string]string{
+				"ubuntu-1.0-12-generic.conf": "title Ubuntu with kernel 1.0-12-generic\n" +
+					"version 1.0-12-generic\n" +
+					"efi /EFI/ubuntu/kernel.efi-1.0-12-generic\n",
+				"ubuntu-1.0-1-generic.conf": "title Ubuntu with kernel 1.0-1-generic\n" +
+					"version 1.0-1-generic\n" +
+					"efi /EFI/ubuntu/kernel.efi-1.0-1-generic\n",
+				"other.conf": "title Other\n",
+			},
+		},
+		{
+			name: "trailing slash",
+			esp:  "/boot/efi/",
+			want: map[string]string{
+				"ubuntu-1.0-12-generic.conf": "title Ubuntu with kernel 1.0-12-generic\n" +
+					"version 1.0-12-generic\n" +
+					"efi /EFI/ubuntu/kernel.efi-1.0-12-generic\n",
+				"ubuntu-1.0-1-generic.conf": "title Ubuntu with kernel 1.0-1-generic\n" +
+					"version 1.0-1-generic\n" +
+					"efi /EFI/ubuntu/kernel.efi-1.0-1-generic\n",
+				"other.conf": "title Other\n",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			memFs := afero.NewMemMapFs()
+			appFs = MapFS{memFs}
+			afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-12-generic", []byte("1.0-12-generic"), 0644)
+			afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+			afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/shimx64.efi", []byte("file a"), 0644)
+			afero.WriteFile(memFs, "/boot/efi/loader/entries/ubuntu-0.9-1-generic.conf", []byte("title Obsolete\n"), 0644)
+			afero.WriteFile(memFs, "/boot/efi/loader/entries/other.conf", []byte("title Other\n"), 0644)
+			if tc.cmdline != "" {
+				afero.WriteFile(memFs, "/etc/kernel/cmdline", []byte(tc.cmdline), 0644)
+			}
+
+			km, err := NewKernelManager(tc.esp, "/usr/lib/linux", ShimConfig{Vendor: "ubuntu"}, nil)
+			if err != nil {
+				t.Fatalf("Could not create kernel manager: %v", err)
+			}
+			if err := km.InstallKernels(); err != nil {
+				t.Fatalf("Could not install kernels: %v", err)
+			}
+			if err := km.WriteBLSEntries(); err != nil {
+				t.Fatalf("Could not write BLS entries: %v", err)
+			}
+
+			got := make(map[string]string)
+			entries, err := afero.ReadDir(memFs, "/boot/efi/loader/entries")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				data, err := afero.ReadFile(memFs, "/boot/efi/loader/entries/"+e.Name())
+				if err != nil {
+					t.Fatal(err)
+				}
+				got[e.Name()] = string(data)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestKernelManagerWriteLoaderConf(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-12-generic", []byte("1.0-12-generic"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/shimx64.efi", []byte("file a"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/loader/loader.conf", []byte("# my settings\ndefault other.conf\nconsole-mode max\n"), 0644)
+
+	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", ShimConfig{Vendor: "ubuntu"}, nil)
+	if err != nil {
+		t.Fatalf("Could not create kernel manager: %v", err)
+	}
+	if _, err := km.updateLoaderConf(5); err == nil {
+		t.Errorf("Expected an error without installed kernels")
+	}
+	if err := km.InstallKernels(); err != nil {
+		t.Fatalf("Could not install kernels: %v", err)
+	}
+	if _, err := km.updateLoaderConf(-1); err == nil {
+		t.Errorf("Expected an error for a negative timeout")
+	}
+
+	updated, err := km.updateLoaderConf(5)
+	if err != nil {
+		t.Fatalf("Could not write loader.conf: %v", err)
+	}
+	if !updated {
+		t.Errorf("Expected loader.conf to be updated")
+	}
+
+	data, err := afero.ReadFile(memFs, "/boot/efi/loader/loader.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# my settings\ndefault ubuntu-1.0-12-generic.conf\nconsole-mode max\ntimeout 5\n"
+	if string(data) != want {
+		t.Errorf("Expected %q, got %q", want, string(data))
+	}
+
+	updated, err = km.updateLoaderConf(5)
+	if err != nil {
+		t.Fatalf("Could not write loader.conf: %v", err)
+	}
+	if updated {
+		t.Errorf("Expected loader.conf to be unchanged")
+	}
+
+	if err := km.WriteLoaderConf(3); err != nil {
+		t.Fatalf("Could not write loader.conf: %v", err)
+	}
+	data, err = afero.ReadFile(memFs, "/boot/efi/loader/loader.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "# my settings\ndefault ubuntu-1.0-12-generic.conf\nconsole-mode max\ntimeout 3\n"
+	if string(data) != want {
+		t.Errorf("Expected %q, got %q", want, string(data))
+	}
+}
+
+func TestKernelManagerWriteLoaderConf_newFile(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/shimx64.efi", []byte("file a"), 0644)
+
+	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", ShimConfig{Vendor: "ubuntu"}, nil)
+	if err != nil {
+		t.Fatalf("Could not create kernel manager: %v", err)
+	}
+	if err := km.InstallKernels(); err != nil {
+		t.Fatalf("Could not install kernels: %v", err)
+	}
+	if err := km.WriteLoaderConf(0); err != nil {
+		t.Fatalf("Could not write loader.conf: %v", err)
+	}
+
+	data, err := afero.ReadFile(memFs, "/boot/efi/loader/loader.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "default ubuntu-1.0-1-generic.conf\ntimeout 0\n"; string(data) != want {
+		t.Errorf("Expected %q, got %q", want, string(data))
+	}
+}
+
+func TestKernelManager_progress(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	appFs = chunkedReadFS{MapFS{memFs}, 1000}
+	kernel := bytes.Repeat([]byte("kernel"), 1000)
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic", kernel, 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/shimx64.efi", []byte("file a"), 0644)
+
+	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", ShimConfig{Vendor: "ubuntu"}, nil)
+	if err != nil {
+		t.Fatalf("Could not create kernel manager: %v", err)
+	}
+
+	var calls int
+	var last int64
+	km.ProgressFunc = func(path string, copied, total int64) {
+		calls++
+		if path != "/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic" {
+			t.Errorf("Unexpected path %s", path)
+		}
+		if total != int64(len(kernel)) {
+			t.Errorf("Expected total %d, got %d", len(kernel), total)
+		}
+		if copied <= last || copied > total {
+			t.Errorf("Unexpected progress %d after %d", copied, last)
+		}
+		last = copied
+	}
+
+	if err := km.InstallKernels(); err != nil {
+		t.Fatalf("Could not install kernels: %v", err)
+	}
+	if calls != 6 {
+		t.Errorf("Expected 6 progress reports, got %d", calls)
+	}
+	if last != int64(len(kernel)) {
+		t.Errorf("Expected %d bytes to be copied, got %d", len(kernel), last)
+	}
+
+	// Kernels that are up to date are not copied
+	calls = 0
+	if err := km.InstallKernels(); err != nil {
+		t.Fatalf("Could not install kernels: %v", err)
+	}
+	if calls != 0 {
+		t.Errorf("Unexpected progress reports for an up to date kernel")
+	}
+}
+
+func TestKernelManager_installKernelsContextCancel(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-12-generic", bytes.Repeat([]byte("1.0-12-generic"), 10000), 0644)
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/shimx64.efi", []byte("file a"), 0644)
+
+	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", ShimConfig{Vendor: "ubuntu"}, nil)
+	if err != nil {
+		t.Fatalf("Could not create kernel manager: %v", err)
+	}
+
+	// Cancel while the first kernel is being copied
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	km.ProgressFunc = func(path string, copied, total int64) {
+		cancel()
+	}
+
+	if err := km.InstallKernelsContext(ctx); err != context.Canceled {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+
+	if err := CheckFilesEqual(memFs, "/usr/lib/linux/kernel.efi-1.0-12-generic", "/boot/efi/EFI/ubuntu/kernel.efi-1.0-12-generic"); err != nil {
+		t.Error(err)
+	}
+	if _, err := memFs.Stat("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic"); err == nil {
+		t.Errorf("Kernel 1.0-1-generic was unexpectedly installed")
+	}
+	if want := []string{"kernel.efi-1.0-12-generic"}; !reflect.DeepEqual(km.installedKernels, want) {
+		t.Errorf("Expected installed kernels %v, got %v", want, km.installedKernels)
+	}
+}
+
+func TestKernelManagerInstallKernelsRollback(t *testing.T) {
+	SetArchitecture("x64")
+	memFs := afero.NewMemMapFs()
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-3-generic", []byte("1.0-3-generic"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-2-generic", []byte("1.0-2-generic"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/kernel.efi-1.0-3-generic", []byte("old 1.0-3-generic"), 0644)
+	// Installing the third kernel fails
+	appFs = renameErrorFS{MapFS{memFs}, map[string]error{"/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic": syscall.ENOSPC}}
+
+	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", ShimConfig{Vendor: "ubuntu"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := km.InstallKernels(); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Expected %v, got %v", syscall.ENOSPC, err)
+	}
+
+	// The kernel that existed before is kept, the new one is removed again.
+	if err := CheckFilesEqual(memFs, "/usr/lib/linux/kernel.efi-1.0-3-generic", "/boot/efi/EFI/ubuntu/kernel.efi-1.0-3-generic"); err != nil {
+		t.Error(err)
+	}
+	for _, k := range []string{"kernel.efi-1.0-2-generic", "kernel.efi-1.0-1-generic"} {
+		if _, err := memFs.Stat("/boot/efi/EFI/ubuntu/" + k); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to not be installed, got: %v", k, err)
+		}
+	}
+	if want := []string{"kernel.efi-1.0-3-generic"}; !reflect.DeepEqual(km.installedKernels, want) {
+		t.Errorf("Expected installed kernels %v, got %v", want, km.installedKernels)
+	}
+}
+
 func TestKernelManagerRemoveObsoleteKernels(t *testing.T) {
-	appArchitecture = "x64"
+	SetArchitecture("x64")
 	memFs := afero.NewMemMapFs()
 	appFs = MapFS{memFs}
 	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-12-generic", []byte("1.0-12-generic"), 0644)
@@ -201,7 +738,7 @@ func TestKernelManagerRemoveObsoleteKernels(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Could not create boot manager: %v", err)
 	}
-	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", "ubuntu", &bm)
+	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", ShimConfig{Vendor: "ubuntu"}, &bm)
 	if err != nil {
 		t.Fatalf("Could not create kernel manager: %v", err)
 	}
@@ -221,3 +758,252 @@ func TestKernelManagerRemoveObsoleteKernels(t *testing.T) {
 	}
 
 }
+
+func TestKernelManagerRemoveObsoleteKernelsBootEntries(t *testing.T) {
+	SetArchitecture("x64")
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-12-generic", []byte("1.0-12-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/kernel.efi-1.0-12-generic", []byte("1.0-12-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/shimx64.efi", []byte("file a"), 0644)
+	mockvars := MockEFIVariables{
+		map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: efi.GlobalVariable, Name: "BootOrder"}: {[]byte{1, 0}, 7},
+			{GUID: efi.GlobalVariable, Name: "Boot0001"}:  {UsbrBootCdromOptBytes, 7},
+		},
+	}
+	bm, err := NewBootManagerForVariables(&mockvars)
+	if err != nil {
+		t.Fatalf("Could not create boot manager: %v", err)
+	}
+	var nums []int
+	for _, k := range []string{"1.0-12-generic", "1.0-1-generic"} {
+		num, err := bm.FindOrCreateEntry(BootEntry{Filename: "shimx64.efi", Label: "Ubuntu with kernel " + k, Options: "\\kernel.efi-" + k + " root=magic"}, "/boot/efi/EFI/ubuntu")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nums = append(nums, num)
+	}
+	if err := bm.PrependAndSetBootOrder(nums); err != nil {
+		t.Fatal(err)
+	}
+
+	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", ShimConfig{Vendor: "ubuntu"}, &bm)
+	if err != nil {
+		t.Fatalf("Could not create kernel manager: %v", err)
+	}
+	if err := km.RemoveObsoleteKernels(); err != nil {
+		t.Errorf("Failed to remove obsolete kernels: %v", err)
+	}
+
+	if _, err := memFs.Stat("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic"); !os.IsNotExist(err) {
+		t.Errorf("did not expect obsolete kernel to be present")
+	}
+	if _, ok := mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: fmt.Sprintf("Boot%04X", nums[1])}]; ok {
+		t.Errorf("did not expect boot entry of obsolete kernel to be present")
+	}
+	for _, num := range []int{nums[0], 1} {
+		if _, ok := mockvars.store[efi.VariableDescriptor{GUID: efi.GlobalVariable, Name: fmt.Sprintf("Boot%04X", num)}]; !ok {
+			t.Errorf("Expected Boot%04X to be kept", num)
+		}
+	}
+
+	bm, err = NewBootManagerForVariables(&mockvars)
+	if err != nil {
+		t.Fatalf("Could not create boot manager: %v", err)
+	}
+	if want := []int{nums[0], 1}; !reflect.DeepEqual(bm.bootOrder, want) {
+		t.Errorf("Expected boot order %v, got %v", want, bm.bootOrder)
+	}
+}
+
+func TestKernelManagerObsoleteKernels(t *testing.T) {
+	SetArchitecture("x64")
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-12-generic", []byte("1.0-12-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/kernel.efi-1.0-12-generic", []byte("1.0-12-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic", []byte("1.0-2-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/BOOTX64.CSV", []byte(""), 0644)
+	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", ShimConfig{Vendor: "ubuntu"}, nil)
+	if err != nil {
+		t.Fatalf("Could not create kernel manager: %v", err)
+	}
+
+	obsolete := km.ObsoleteKernels()
+	want := []string{"/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic", "/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic"}
+	if !reflect.DeepEqual(obsolete, want) {
+		t.Errorf("Expected obsolete kernels %v, got %v", want, obsolete)
+	}
+	for _, p := range want {
+		if _, err := memFs.Stat(p); err != nil {
+			t.Errorf("Expected %s to be kept, got: %v", p, err)
+		}
+	}
+
+	if err := km.RemoveObsoleteKernels(); err != nil {
+		t.Errorf("Failed to remove obsolete kernels: %v", err)
+	}
+	var removed []string
+	for _, p := range []string{"/boot/efi/EFI/ubuntu/kernel.efi-1.0-12-generic", "/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic", "/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic"} {
+		if _, err := memFs.Stat(p); os.IsNotExist(err) {
+			removed = append(removed, p)
+		}
+	}
+	if !reflect.DeepEqual(removed, obsolete) {
+		t.Errorf("Expected %v to be removed, got %v", obsolete, removed)
+	}
+}
+
+func TestKernelManager_customShim(t *testing.T) {
+	SetArchitecture("x64")
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/derivative/<dummy>", []byte(""), 0644)
+
+	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", ShimConfig{Vendor: "derivative", Basename: "shimx64-derivative.efi"}, nil)
+	if err != nil {
+		t.Fatalf("Could not create kernel manager: %v", err)
+	}
+	if err := km.InstallKernels(); err != nil {
+		t.Errorf("Could not install kernels: %v", err)
+	}
+	if err := CheckFilesEqual(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic", "/boot/efi/EFI/derivative/kernel.efi-1.0-1-generic"); err != nil {
+		t.Error(err)
+	}
+	if err := km.CommitToBootLoader(); err != nil {
+		t.Errorf("Could not commit to bootloader: %v", err)
+	}
+
+	want := []BootEntry{{
+		Filename:    "shimx64-derivative.efi",
+		Label:       "Ubuntu with kernel 1.0-1-generic",
+		Options:     "\\kernel.efi-1.0-1-generic",
+		Description: "Ubuntu entry for kernel 1.0-1-generic",
+	}}
+	if !reflect.DeepEqual(km.bootEntries, want) {
+		t.Errorf("Expected %v, got %v", want, km.bootEntries)
+	}
+}
+
+func TestKernelManager_cmdlineTransform(t *testing.T) {
+	SetArchitecture("x64")
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-12-generic", []byte("1.0-12-generic"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/<dummy>", []byte(""), 0644)
+	afero.WriteFile(memFs, "/etc/kernel/cmdline", []byte("root=magic"), 0644)
+
+	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", ShimConfig{Vendor: "ubuntu"}, nil)
+	if err != nil {
+		t.Fatalf("Could not create kernel manager: %v", err)
+	}
+	km.CmdlineTransform = func(version, cmdline string) (string, error) {
+		if version == "1.0-1-generic" {
+			return "", nil
+		}
+		return cmdline + " console=ttyS0", nil
+	}
+	if err := km.InstallKernels(); err != nil {
+		t.Errorf("Could not install kernels: %v", err)
+	}
+	if err := km.CommitToBootLoader(); err != nil {
+		t.Errorf("Could not commit to bootloader: %v", err)
+	}
+
+	file, err := memFs.Open("/boot/efi/EFI/ubuntu/BOOTX64.CSV")
+	if err != nil {
+		t.Fatalf("Could not open boot.csv: %v", err)
+	}
+	reader := transform.NewReader(file, unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM).NewDecoder())
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Could not read boot.csv: %v", err)
+	}
+
+	want := ("shimx64.efi,Ubuntu with kernel 1.0-1-generic,\\kernel.efi-1.0-1-generic ,Ubuntu entry for kernel 1.0-1-generic\n" +
+		"shimx64.efi,Ubuntu with kernel 1.0-12-generic,\\kernel.efi-1.0-12-generic root=magic console=ttyS0 ,Ubuntu entry for kernel 1.0-12-generic\n")
+	if want != string(data) {
+		t.Errorf("Boot entry mismatch:\nExpected:\n%v\nGot:\n%v", want, string(data))
+	}
+
+	km.CmdlineTransform = func(version, cmdline string) (string, error) {
+		return "", errors.New("some error")
+	}
+	if err := km.CommitToBootLoader(); err == nil || err.Error() != "Could not transform command line for kernel kernel.efi-1.0-12-generic: some error" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestKernelManager_maxInstalledKernels(t *testing.T) {
+	SetArchitecture("x64")
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-12-generic", []byte("1.0-12-generic"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-2-generic", []byte("1.0-2-generic"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/<dummy>", []byte(""), 0644)
+
+	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", ShimConfig{Vendor: "ubuntu"}, nil)
+	if err != nil {
+		t.Fatalf("Could not create kernel manager: %v", err)
+	}
+	km.MaxInstalledKernels = 2
+	if err := km.InstallKernels(); err != nil {
+		t.Errorf("Could not install kernels: %v", err)
+	}
+
+	wantInstalledKernels := []string{"kernel.efi-1.0-12-generic", "kernel.efi-1.0-2-generic"}
+	if !reflect.DeepEqual(km.installedKernels, wantInstalledKernels) {
+		t.Errorf("Expected %v, got %v", wantInstalledKernels, km.installedKernels)
+	}
+	for _, k := range wantInstalledKernels {
+		if err := CheckFilesEqual(memFs, "/usr/lib/linux/"+k, "/boot/efi/EFI/ubuntu/"+k); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := memFs.Stat("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic"); err == nil {
+		t.Errorf("did not expect oldest kernel to be installed")
+	}
+
+	if err := km.CommitToBootLoader(); err != nil {
+		t.Errorf("Could not commit to bootloader: %v", err)
+	}
+	if len(km.bootEntries) != 2 {
+		t.Errorf("Expected 2 boot entries, got %v", km.bootEntries)
+	}
+}
+
+func TestDetectPartialInstalls(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-12-generic", bytes.Repeat([]byte("1.0-12-generic"), 1000), 0644)
+	afero.WriteFile(memFs, "/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/kernel.efi-1.0-12-generic", bytes.Repeat([]byte("1.0-12-generic"), 500), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("1.0-1-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/kernel.efi-0.9-1-generic", []byte("0.9-1-generic"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim"), 0644)
+
+	partial, err := DetectPartialInstalls("/boot/efi", "/usr/lib/linux", "ubuntu")
+	if err != nil {
+		t.Fatalf("Could not detect partial installs: %v", err)
+	}
+	want := []string{"/boot/efi/EFI/ubuntu/kernel.efi-1.0-12-generic"}
+	if !reflect.DeepEqual(partial, want) {
+		t.Errorf("Expected %v, got %v", want, partial)
+	}
+
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/kernel.efi-1.0-12-generic", bytes.Repeat([]byte("1.0-12-generic"), 1000), 0644)
+
+	partial, err = DetectPartialInstalls("/boot/efi", "/usr/lib/linux", "ubuntu")
+	if err != nil {
+		t.Fatalf("Could not detect partial installs: %v", err)
+	}
+	if partial != nil {
+		t.Errorf("Expected no partial installs, got %v", partial)
+	}
+}
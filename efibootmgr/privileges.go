@@ -0,0 +1,69 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	efivarfsPath  = "/sys/firmware/efi/efivars"
+	tpmDevicePath = "/dev/tpm0"
+)
+
+var unixAccess = unix.Access
+
+// hasAccess checks whether we have the requested access to path. A path that
+// does not exist is not considered to be a privilege problem.
+func hasAccess(path string, mode uint32) (bool, error) {
+	err := unixAccess(path, mode)
+	switch {
+	case err == nil, errors.Is(err, unix.ENOENT):
+		return true, nil
+	case errors.Is(err, unix.EACCES), errors.Is(err, unix.EPERM), errors.Is(err, unix.EROFS):
+		return false, nil
+	default:
+		return false, fmt.Errorf("cannot check access to %s: %w", path, err)
+	}
+}
+
+// CheckPrivileges checks up front that the process has the access it needs to
+// the ESP, and optionally the EFI variables and the TPM, and returns a single
+// error listing everything that is missing.
+func CheckPrivileges(esp string, efivars, tpm bool) error {
+	checks := []struct {
+		enabled bool
+		path    string
+		mode    uint32
+		what    string
+	}{
+		{true, esp, unix.W_OK, "write access to " + esp},
+		{efivars, efivarfsPath, unix.W_OK, "write access to " + efivarfsPath},
+		{tpm, tpmDevicePath, unix.R_OK | unix.W_OK, "read/write access to " + tpmDevicePath},
+	}
+
+	var missing []string
+	for _, check := range checks {
+		if !check.enabled {
+			continue
+		}
+		ok, err := hasAccess(check.path, check.mode)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			missing = append(missing, check.what)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("insufficient privileges: needs %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
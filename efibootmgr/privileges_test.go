@@ -0,0 +1,69 @@
+// This file is part of nullboot
+// Copyright 2021 Canonical Ltd.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package efibootmgr
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func mockUnixAccess(fn func(path string, mode uint32) error) (restore func()) {
+	orig := unixAccess
+	unixAccess = fn
+	return func() {
+		unixAccess = orig
+	}
+}
+
+func TestCheckPrivileges(t *testing.T) {
+	restore := mockUnixAccess(func(path string, mode uint32) error {
+		return nil
+	})
+	defer restore()
+
+	if err := CheckPrivileges("/boot/efi", true, true); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestCheckPrivileges_noEfivarsWriteAccess(t *testing.T) {
+	restore := mockUnixAccess(func(path string, mode uint32) error {
+		if path == "/sys/firmware/efi/efivars" && mode&unix.W_OK != 0 {
+			return unix.EACCES
+		}
+		return nil
+	})
+	defer restore()
+
+	err := CheckPrivileges("/boot/efi", true, true)
+	if err == nil || err.Error() != "insufficient privileges: needs write access to /sys/firmware/efi/efivars" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if err := CheckPrivileges("/boot/efi", false, true); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestCheckPrivileges_multiple(t *testing.T) {
+	restore := mockUnixAccess(func(path string, mode uint32) error {
+		switch path {
+		case "/boot/efi":
+			return unix.EROFS
+		case "/dev/tpm0":
+			return unix.EPERM
+		case "/sys/firmware/efi/efivars":
+			return unix.ENOENT
+		}
+		return nil
+	})
+	defer restore()
+
+	err := CheckPrivileges("/boot/efi", true, true)
+	if err == nil || err.Error() != "insufficient privileges: needs write access to /boot/efi, read/write access to /dev/tpm0" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -6,15 +6,21 @@ package efibootmgr
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/canonical/go-efilib"
@@ -28,8 +34,11 @@ import (
 )
 
 const (
-	keyFilePath   = "device/fde/cloudimg-rootfs.sealed-key"
+	keyFileDir    = "device/fde"
+	keyFileSuffix = ".sealed-key"
+	authKeySuffix = ".auth-key"
 	keyringPrefix = "ubuntu-fde"
+	rootfsKeyFile = "cloudimg-rootfs.sealed-key"
 	rootfsLabel   = "cloudimg-rootfs-enc"
 )
 
@@ -46,11 +55,291 @@ var (
 	unixKeyctlInt = unix.KeyctlInt
 )
 
+// deviceAliasDirs are the directories of symlinks to block devices that are
+// searched for the path that a key was added to the kernel keyring with.
+var deviceAliasDirs = []string{
+	"/dev/disk/by-partuuid",
+	"/dev/disk/by-uuid",
+	"/dev/disk/by-id",
+}
+
+var (
+	// bootIDPath is the path of the kernel's random ID for the current boot.
+	bootIDPath = "/proc/sys/kernel/random/boot_id"
+
+	// resealStampPath records the boot ID and inputs of the last successful
+	// reseal, see ResealConfig.OncePerBoot.
+	resealStampPath = "/run/nullboot/reseal-stamp"
+
+	// sealedProfilesDir records the PCR profile that each key file was last
+	// sealed against, see ResealConfig.SkipUnchanged.
+	sealedProfilesDir = "/var/lib/nullboot/sealed-profiles"
+)
+
+var (
+	// pcrAlgorithm is the digest algorithm used for computing PCR profiles.
+	pcrAlgorithm = tpm2.HashAlgorithmSHA256
+
+	// logAlgorithms is the list of TCG log digest algorithms that TrustCurrentBoot
+	// can fall back to if the log doesn't contain digests for pcrAlgorithm, in
+	// order of preference. SHA-1 is deliberately not included.
+	logAlgorithms = []tpm2.HashAlgorithmId{
+		tpm2.HashAlgorithmSHA512,
+		tpm2.HashAlgorithmSHA384,
+		tpm2.HashAlgorithmSHA256,
+	}
+)
+
+// defaultPCRs is the set of PCRs that keys are sealed against by default.
+var defaultPCRs = []int{4, 7, 12}
+
+// ShimRoots selects which shim images are used as the roots of the boot chains
+// that keys are sealed against.
+type ShimRoots int
+
+const (
+	// ShimRootsBoth includes both the signed shim in the source directory and
+	// the shim installed to the ESP.
+	ShimRootsBoth ShimRoots = iota
+
+	// ShimRootsSource includes only the signed shim in the source directory.
+	ShimRootsSource
+
+	// ShimRootsTarget includes only the shim installed to the ESP.
+	ShimRootsTarget
+)
+
+// ResealConfig provides options to ResealKey.
+type ResealConfig struct {
+	// PCRs is the set of PCRs to seal the key against, which must be a subset of
+	// 4 (boot manager code), 7 (secure boot policy) and 12 (kernel command line
+	// and epoch). If empty, all of them are used.
+	PCRs []int
+
+	// KernelCmdlines is a list of additional command lines that kernels may be
+	// booted with, eg, if the command line can be selected at boot time. Each
+	// distinct command line adds a branch to the PCR 12 profile.
+	KernelCmdlines []string
+
+	// ProfileJSON, if set, receives a JSON description of the PCR values in each
+	// branch of the computed PCR profile.
+	ProfileJSON io.Writer
+
+	// KeyringPrefix is the prefix used for the auth keys in the kernel keyring.
+	// Defaults to "ubuntu-fde".
+	KeyringPrefix string
+
+	// RootfsLabel is the filesystem label of the encrypted root volume, which
+	// has the cloudimg-rootfs.sealed-key key file. Defaults to
+	// "cloudimg-rootfs-enc". The labels of other volumes are derived from the
+	// names of their key files.
+	RootfsLabel string
+
+	// ShimRoots selects which shims are included as roots of the boot chains.
+	// Defaults to ShimRootsBoth.
+	ShimRoots ShimRoots
+
+	// Epoch is the epoch measured to PCR 12 by snap-bootstrap.
+	Epoch uint32
+
+	// CommittedOnly restricts the profile to the new assets, ie, the source
+	// shim and the source kernels. By default, the assets currently on the ESP
+	// are included as well so that the key can be unsealed whether the system
+	// reboots before or after the update is committed. This should only be set
+	// once the update has been committed to the ESP, and cannot be combined with
+	// ShimRootsTarget.
+	CommittedOnly bool
+
+	// OncePerBoot skips resealing if the keys have already been resealed
+	// during the current boot with identical inputs.
+	OncePerBoot bool
+
+	// PolicyAuthKeyDir, if set, is a directory containing the auth key of each
+	// sealed key file, named after the key file with the .auth-key suffix, eg,
+	// cloudimg-rootfs.auth-key. The auth key is the key that signs the
+	// authorized PCR policies of a sealed key object, and is otherwise read
+	// from the kernel keyring, where it is only available after the volume
+	// has been unlocked during the current boot. Setting it doesn't make
+	// resealing work offline: a connection to the TPM is still needed to
+	// validate the sealed key objects and update their PCR policies.
+	PolicyAuthKeyDir string
+
+	// SkipUnchanged skips resealing key files that were last resealed by this
+	// package against identical PCR values, avoiding needless TPM and ESP
+	// writes. secboot doesn't expose the PCR policy of a sealed key object, so
+	// the PCR values are recorded in /var/lib/nullboot alongside a digest of
+	// the key file, which ensures that key files updated by anything else are
+	// always resealed. If no key file needs resealing, ErrResealNotNeeded is
+	// returned.
+	SkipUnchanged bool
+}
+
+func (c ResealConfig) pcrs() []int {
+	if len(c.PCRs) == 0 {
+		return defaultPCRs
+	}
+	return c.PCRs
+}
+
+func (c ResealConfig) hasPCR(pcr int) bool {
+	for _, p := range c.pcrs() {
+		if p == pcr {
+			return true
+		}
+	}
+	return false
+}
+
+func (c ResealConfig) keyringPrefix() string {
+	if c.KeyringPrefix == "" {
+		return keyringPrefix
+	}
+	return c.KeyringPrefix
+}
+
+// volumeLabel returns the filesystem label of the encrypted volume that the
+// specified sealed key file belongs to.
+func (c ResealConfig) volumeLabel(keyFile string) string {
+	if keyFile == rootfsKeyFile {
+		if c.RootfsLabel != "" {
+			return c.RootfsLabel
+		}
+		return rootfsLabel
+	}
+	return strings.TrimSuffix(keyFile, keyFileSuffix) + "-enc"
+}
+
+func (c ResealConfig) validate() error {
+	switch c.ShimRoots {
+	case ShimRootsBoth, ShimRootsSource, ShimRootsTarget:
+	default:
+		return fmt.Errorf("invalid shim roots selection %d", c.ShimRoots)
+	}
+	if c.CommittedOnly && c.ShimRoots == ShimRootsTarget {
+		return errors.New("cannot include only committed assets with only the target shim as a root")
+	}
+	for _, pcr := range c.PCRs {
+		switch pcr {
+		case 4, 7, 12:
+		default:
+			return fmt.Errorf("cannot seal against PCR %d: only PCRs %v are supported", pcr, defaultPCRs)
+		}
+	}
+	return nil
+}
+
+// ErrNoSealedKey is returned from ResealKey when there are no sealed key files
+// on the ESP, eg, because disk encryption isn't configured.
+var ErrNoSealedKey = errors.New("no sealed key files")
+
+// ErrResealNotNeeded is returned from ResealKey when ResealConfig.SkipUnchanged
+// is set and every key file is already sealed against the computed profile.
+var ErrResealNotNeeded = errors.New("all keys are already sealed against the computed PCR profile")
+
+var errAuthKeyMismatch = errors.New("auth key mismatch: the sealed key object expects a different auth key")
+
+// ResealStage identifies the stage of ResealKey that failed.
+type ResealStage int
+
+const (
+	StageConfig     ResealStage = iota + 1 // The configuration is invalid
+	StageKeyFiles                          // The sealed key files cannot be found or read
+	StagePCRProfile                        // The PCR profile cannot be computed
+	StageIntegrity                         // Some boot assets failed an integrity check
+	StageAuthKey                           // The auth key cannot be obtained or doesn't match
+	StageTPM                               // The TPM cannot be used
+	StageWrite                             // The updated sealed key object cannot be written
+)
+
+func (s ResealStage) String() string {
+	switch s {
+	case StageConfig:
+		return "config"
+	case StageKeyFiles:
+		return "key-files"
+	case StagePCRProfile:
+		return "pcr-profile"
+	case StageIntegrity:
+		return "integrity"
+	case StageAuthKey:
+		return "auth-key"
+	case StageTPM:
+		return "tpm"
+	case StageWrite:
+		return "write"
+	default:
+		return fmt.Sprintf("ResealStage(%d)", int(s))
+	}
+}
+
+// ResealError is returned from ResealKey, possibly wrapped, to indicate the
+// stage that failed, eg, so that callers can retry on transient TPM errors but
+// not on integrity failures. Use errors.As to obtain it.
+type ResealError struct {
+	Stage ResealStage
+	Err   error
+}
+
+func (e *ResealError) Error() string { return e.Err.Error() }
+func (e *ResealError) Unwrap() error { return e.Err }
+
+// resealStage returns the stage of the ResealError in err's chain, or 0 if
+// there is none.
+func resealStage(err error) ResealStage {
+	var e *ResealError
+	if !errors.As(err, &e) {
+		return 0
+	}
+	return e.Stage
+}
+
+// pcrProfileComputeContext tracks the images opened whilst computing a PCR
+// profile. It is safe for concurrent use.
 type pcrProfileComputeContext struct {
-	nOpen       int
+	mu          sync.Mutex
+	open        map[*trustedEFIImage]int
 	failedPaths []string
 }
 
+func (c *pcrProfileComputeContext) opened(image *trustedEFIImage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.open == nil {
+		c.open = make(map[*trustedEFIImage]int)
+	}
+	c.open[image]++
+}
+
+func (c *pcrProfileComputeContext) closed(image *trustedEFIImage, trusted bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !trusted {
+		c.failedPaths = append(c.failedPaths, image.path)
+	}
+	c.open[image]--
+	if c.open[image] == 0 {
+		delete(c.open, image)
+	}
+}
+
+// leaked returns the sorted paths of the images that are currently open.
+func (c *pcrProfileComputeContext) leaked() (paths []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for image := range c.open {
+		paths = append(paths, image.path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// failed returns the paths of the images that failed an integrity check.
+func (c *pcrProfileComputeContext) failed() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.failedPaths
+}
+
 // trustedEFIImage is an implementation of secboot_efi.Image that makes
 // use of hashedFile in order to ensure that boot assets added to a PCR
 // profile are trusted.
@@ -70,34 +359,43 @@ func (i *trustedEFIImage) Open() (file interface {
 	Size() int64
 }, err error) {
 	f, err := appFs.Open(i.path)
-	if err != nil {
+	switch {
+	case os.IsNotExist(err):
+		return nil, fmt.Errorf("boot asset %s is missing: %w", i.path, err)
+	case err != nil:
 		return nil, err
 	}
-	i.context.nOpen++
+	i.context.opened(i)
 
 	defer func() {
 		if err != nil {
 			f.Close()
-			i.context.nOpen--
+			i.context.closed(i, true)
 		}
 	}()
 
 	return newCheckedHashedFile(f, i.assets, func(trusted bool) {
-		if !trusted {
-			i.context.failedPaths = append(i.context.failedPaths, i.path)
-		}
-		i.context.nOpen--
+		i.context.closed(i, trusted)
 	})
 }
 
-func newTrustedEFIImage(assets *TrustedAssets, context *pcrProfileComputeContext, path string) *trustedEFIImage {
-	return &trustedEFIImage{assets, context, path}
+func newTrustedEFIImage(assets *TrustedAssets, pctx *pcrProfileComputeContext, path string) *trustedEFIImage {
+	return &trustedEFIImage{assets, pctx, path}
 }
 
+// maxSymlinks is the maximum number of symbolic links that resolveLink will
+// follow, matching the kernel's MAXSYMLINKS.
+const maxSymlinks = 40
+
 func resolveLink(path string) (string, error) {
 	path = filepath.Clean(path)
+	origPath := path
+
+	for i := 0; ; i++ {
+		if i > maxSymlinks {
+			return "", &os.PathError{Op: "readlink", Path: origPath, Err: syscall.ELOOP}
+		}
 
-	for {
 		tgtPath, err := appFs.Readlink(path)
 
 		if errors.Is(err, syscall.EINVAL) {
@@ -116,8 +414,57 @@ func resolveLink(path string) (string, error) {
 	}
 }
 
-func getPolicyAuthKeyFromKernel() (secboot_tpm2.PolicyAuthKey, error) {
-	devPath, err := resolveLink(filepath.Join("/dev/disk/by-label", rootfsLabel))
+// sealedKeyFiles returns the names of the sealed key files in the key file
+// directory on the ESP, in lexical order.
+func sealedKeyFiles(esp string) ([]string, error) {
+	entries, err := appFs.ReadDir(filepath.Join(esp, keyFileDir))
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), keyFileSuffix) {
+			continue
+		}
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// getAuxiliaryKeyFromKernelByAlias tries to read the auxiliary key for the
+// specified device from the kernel using each of the symlinks to the device in
+// deviceAliasDirs, as the key may have been added using any of these paths.
+func getAuxiliaryKeyFromKernelByAlias(prefix, devPath string) (secboot.AuxiliaryKey, error) {
+	for _, dir := range deviceAliasDirs {
+		ents, err := appFs.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, ent := range ents {
+			path := filepath.Join(dir, ent.Name())
+			target, err := resolveLink(path)
+			if err != nil || target != devPath {
+				continue
+			}
+
+			key, err := sbGetAuxiliaryKeyFromKernel(prefix, path, false)
+			if err == secboot.ErrKernelKeyNotFound {
+				continue
+			}
+			return key, err
+		}
+	}
+
+	return nil, secboot.ErrKernelKeyNotFound
+}
+
+func getPolicyAuthKeyFromKernel(prefix, label string) (secboot_tpm2.PolicyAuthKey, error) {
+	devPath, err := resolveLink(filepath.Join("/dev/disk/by-label", label))
 	if err != nil {
 		return nil, fmt.Errorf("cannot resolve devive symlink: %w", err)
 	}
@@ -131,64 +478,165 @@ func getPolicyAuthKeyFromKernel() (secboot_tpm2.PolicyAuthKey, error) {
 		return nil, fmt.Errorf("cannot link user keyring into process keyring: %w", err)
 	}
 
-	key, err := sbGetAuxiliaryKeyFromKernel(keyringPrefix, devPath, false)
+	key, err := sbGetAuxiliaryKeyFromKernel(prefix, devPath, false)
+	if err == secboot.ErrKernelKeyNotFound {
+		// Work around a secboot bug
+		key, err = getAuxiliaryKeyFromKernelByAlias(prefix, devPath)
+	}
 	if err != nil {
-		if err == secboot.ErrKernelKeyNotFound {
-			// Work around a secboot bug
-			ents, err2 := appFs.ReadDir("/dev/disk/by-partuuid")
-			if err2 == nil {
-				for _, ent := range ents {
-					path := filepath.Join("/dev/disk/by-partuuid", ent.Name())
-					devPath2, err2 := resolveLink(path)
-					if err2 != nil {
-						continue
-					}
-
-					if devPath2 == devPath {
-						key, err = sbGetAuxiliaryKeyFromKernel(keyringPrefix, path, false)
-						break
-					}
-				}
-			}
+		return nil, fmt.Errorf("cannot read key from kernel: %w", err)
+	}
+
+	return secboot_tpm2.PolicyAuthKey(key), nil
+}
+
+// readPolicyAuthKeyFile reads an auth key from the specified file.
+func readPolicyAuthKeyFile(path string) (secboot_tpm2.PolicyAuthKey, error) {
+	f, err := appFs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	key, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	return secboot_tpm2.PolicyAuthKey(key), nil
+}
+
+// addKernelCmdlineProfile adds the PCR 12 measurement of the kernel command line
+// made by the systemd EFI stub, with a branch for each of the supplied command
+// lines. The stub doesn't measure anything if it's invoked without a command line.
+func addKernelCmdlineProfile(profile *secboot_tpm2.PCRProtectionProfile, cmdlines []string) {
+	var branches []*secboot_tpm2.PCRProtectionProfile
+	for _, cmdline := range cmdlines {
+		branch := secboot_tpm2.NewPCRProtectionProfile()
+		if cmdline != "" {
+			branch.ExtendPCR(pcrAlgorithm, 12, tcglog.ComputeSystemdEFIStubCommandlineDigest(pcrAlgorithm.GetHash(), cmdline))
 		}
-		if err != nil {
-			return nil, fmt.Errorf("cannot read key from kernel: %w", err)
+		branches = append(branches, branch)
+	}
+	if len(branches) > 0 {
+		profile.AddProfileOR(branches...)
+	}
+}
+
+// authKeyMismatchMessage is the part of the message secboot uses for an auth
+// key that doesn't match the sealed key object. TestAuthKeyMismatchMessage
+// checks that the pinned secboot still uses it.
+const authKeyMismatchMessage = "private key doesn't match public key"
+
+// isAuthKeyMismatch returns whether err from a PCR policy update indicates
+// that the auth key doesn't match the sealed key object. secboot has no
+// accessor for the auth public key of a sealed key object and reports a
+// mismatch as an InvalidKeyDataError that can only be told apart from other
+// invalid key data by its message.
+func isAuthKeyMismatch(err error) bool {
+	var e secboot_tpm2.InvalidKeyDataError
+	return errors.As(err, &e) && strings.Contains(err.Error(), authKeyMismatchMessage)
+}
+
+type pcrValueJSON struct {
+	PCR    int    `json:"pcr"`
+	Alg    string `json:"alg"`
+	Digest string `json:"digest"`
+}
+
+type pcrBranchJSON struct {
+	Values []pcrValueJSON `json:"values"`
+}
+
+// marshalPCRValuesJSON renders the PCR values for each branch of a PCR profile
+// as JSON, ordered by algorithm and then PCR index.
+func marshalPCRValuesJSON(pcrValues []tpm2.PCRValues) ([]byte, error) {
+	branches := make([]pcrBranchJSON, 0, len(pcrValues))
+	for _, values := range pcrValues {
+		var branch pcrBranchJSON
+
+		var algs []tpm2.HashAlgorithmId
+		for alg := range values {
+			algs = append(algs, alg)
 		}
+		sort.Slice(algs, func(i, j int) bool { return algs[i] < algs[j] })
+
+		for _, alg := range algs {
+			var pcrs []int
+			for pcr := range values[alg] {
+				pcrs = append(pcrs, pcr)
+			}
+			sort.Ints(pcrs)
+
+			for _, pcr := range pcrs {
+				branch.Values = append(branch.Values, pcrValueJSON{
+					PCR:    pcr,
+					Alg:    strings.ToLower(strings.TrimPrefix(fmt.Sprint(alg), "TPM_ALG_")),
+					Digest: hex.EncodeToString(values[alg][pcr])})
+			}
+		}
+
+		branches = append(branches, branch)
 	}
 
-	return secboot_tpm2.PolicyAuthKey(key), nil
+	return json.MarshalIndent(struct {
+		Branches []pcrBranchJSON `json:"branches"`
+	}{branches}, "", "  ")
+}
+
+// ComputedPCRProfile describes the PCR profile that ResealKeyWithProfile
+// computed for the sealed keys.
+type ComputedPCRProfile struct {
+	// Selection is the set of PCRs that the keys are sealed against.
+	Selection tpm2.PCRSelectionList
+
+	// Values contains the expected PCR values for each branch of the profile.
+	Values []tpm2.PCRValues
+
+	// Digests contains the SHA-256 digest of the selected PCR values for each
+	// branch of the profile, as used in the PCR policy.
+	Digests tpm2.DigestList
 }
 
-func computePCRProtectionProfile(loadChains []*secboot_efi.ImageLoadEvent) (*secboot_tpm2.PCRProtectionProfile, error) {
+func computePCRProtectionProfile(loadChains []*secboot_efi.ImageLoadEvent, cmdlines []string, config ResealConfig) (*secboot_tpm2.PCRProtectionProfile, *ComputedPCRProfile, error) {
 	profile := secboot_tpm2.NewPCRProtectionProfile()
 
-	pcr4Params := secboot_efi.BootManagerProfileParams{
-		PCRAlgorithm:  tpm2.HashAlgorithmSHA256,
-		LoadSequences: loadChains}
-	if err := sbefiAddBootManagerProfile(profile, &pcr4Params); err != nil {
-		return nil, fmt.Errorf("cannot add EFI boot manager profile: %w", err)
+	if config.hasPCR(4) {
+		pcr4Params := secboot_efi.BootManagerProfileParams{
+			PCRAlgorithm:  pcrAlgorithm,
+			LoadSequences: loadChains}
+		if err := sbefiAddBootManagerProfile(profile, &pcr4Params); err != nil {
+			return nil, nil, fmt.Errorf("cannot add EFI boot manager profile: %w", err)
+		}
 	}
 
-	pcr7Params := secboot_efi.SecureBootPolicyProfileParams{
-		PCRAlgorithm:  tpm2.HashAlgorithmSHA256,
-		LoadSequences: loadChains}
-	if err := sbefiAddSecureBootPolicyProfile(profile, &pcr7Params); err != nil {
-		return nil, fmt.Errorf("cannot add EFI secure boot policy profile: %w", err)
+	if config.hasPCR(7) {
+		pcr7Params := secboot_efi.SecureBootPolicyProfileParams{
+			PCRAlgorithm:  pcrAlgorithm,
+			LoadSequences: loadChains}
+		if err := sbefiAddSecureBootPolicyProfile(profile, &pcr7Params); err != nil {
+			return nil, nil, fmt.Errorf("cannot add EFI secure boot policy profile: %w", err)
+		}
 	}
 
-	profile.AddPCRValue(tpm2.HashAlgorithmSHA256, 12, make([]byte, tpm2.HashAlgorithmSHA256.Size()))
+	if config.hasPCR(12) {
+		profile.AddPCRValue(pcrAlgorithm, 12, make([]byte, pcrAlgorithm.Size()))
 
-	// snap-bootstrap measures an epoch
-	h := crypto.SHA256.New()
-	binary.Write(h, binary.LittleEndian, uint32(0))
-	profile.ExtendPCR(tpm2.HashAlgorithmSHA256, 12, h.Sum(nil))
+		// The kernel EFI stub measures the command line passed to it by shim
+		addKernelCmdlineProfile(profile, cmdlines)
 
-	// XXX: The kernel EFI stub has a compiled-in commandline which isn't measured.
+		// snap-bootstrap measures an epoch
+		h := pcrAlgorithm.NewHash()
+		binary.Write(h, binary.LittleEndian, config.Epoch)
+		profile.ExtendPCR(pcrAlgorithm, 12, h.Sum(nil))
+	}
 
 	log.Println("Computed PCR profile:", profile)
 	pcrValues, err := profile.ComputePCRValues(nil)
 	if err != nil {
-		return nil, fmt.Errorf("cannot compute PCR values: %w", err)
+		return nil, nil, fmt.Errorf("cannot compute PCR values: %w", err)
 	}
 	log.Println("Computed PCR values:")
 	for i, values := range pcrValues {
@@ -199,9 +647,18 @@ func computePCRProtectionProfile(loadChains []*secboot_efi.ImageLoadEvent) (*sec
 			}
 		}
 	}
+	if config.ProfileJSON != nil {
+		data, err := marshalPCRValuesJSON(pcrValues)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot encode PCR values: %w", err)
+		}
+		if _, err := config.ProfileJSON.Write(data); err != nil {
+			return nil, nil, fmt.Errorf("cannot write PCR values: %w", err)
+		}
+	}
 	pcrs, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
 	if err != nil {
-		return nil, fmt.Errorf("cannot compute PCR digests: %w", err)
+		return nil, nil, fmt.Errorf("cannot compute PCR digests: %w", err)
 	}
 	log.Println("PCR selection:", pcrs)
 	log.Println("Computed PCR digests:")
@@ -209,126 +666,544 @@ func computePCRProtectionProfile(loadChains []*secboot_efi.ImageLoadEvent) (*sec
 		log.Printf(" %x\n", digest)
 	}
 
-	return profile, nil
+	return profile, &ComputedPCRProfile{Selection: pcrs, Values: pcrValues, Digests: digests}, nil
+}
+
+// resealKeyFile updates the PCR profile for the sealed key file with the
+// specified name.
+func resealKeyFile(esp, name string, tpm *secboot_tpm2.Connection, pcrProfile *secboot_tpm2.PCRProtectionProfile, config ResealConfig) error {
+	path := filepath.Join(esp, keyFileDir, name)
+
+	var authKey secboot_tpm2.PolicyAuthKey
+	if config.PolicyAuthKeyDir != "" {
+		authKeyPath := filepath.Join(config.PolicyAuthKeyDir, strings.TrimSuffix(name, keyFileSuffix)+authKeySuffix)
+		key, err := readPolicyAuthKeyFile(authKeyPath)
+		if err != nil {
+			return &ResealError{StageAuthKey, fmt.Errorf("cannot read auth key file: %w", err)}
+		}
+		authKey = key
+	} else {
+		key, err := getPolicyAuthKeyFromKernel(config.keyringPrefix(), config.volumeLabel(name))
+		if err != nil {
+			return &ResealError{StageAuthKey, fmt.Errorf("cannot obtain auth key from kernel: %w", err)}
+		}
+		authKey = key
+	}
+
+	k, err := sbtpmReadSealedKeyObjectFromFile(path)
+	if err != nil {
+		return &ResealError{StageKeyFiles, fmt.Errorf("cannot read sealed key file: %w", err)}
+	}
+
+	if err := sbtpmSealedKeyObjectUpdatePCRProtectionPolicy(k, tpm, authKey, pcrProfile); err != nil {
+		if isAuthKeyMismatch(err) {
+			return &ResealError{StageAuthKey, errAuthKeyMismatch}
+		}
+		return &ResealError{StageTPM, fmt.Errorf("cannot update PCR profile: %w", err)}
+	}
+
+	w := secboot_tpm2.NewFileSealedKeyObjectWriter(path)
+	if err := sbtpmSealedKeyObjectWriteAtomic(k, w); err != nil {
+		return &ResealError{StageWrite, fmt.Errorf("cannot write updated sealed key object: %w", err)}
+	}
+
+	return nil
+}
+
+// resealInputsDigest returns a digest of the inputs to a reseal, which are the
+// PCR values of the profile and the key files with their contents and auth key
+// details. The contents are included so that a key file that is replaced
+// during the boot, for example by re-provisioning, is resealed again.
+func resealInputsDigest(esp string, pcrProfile *secboot_tpm2.PCRProtectionProfile, keyFiles []string, config ResealConfig) ([]byte, error) {
+	pcrValues, err := pcrProfile.ComputePCRValues(nil)
+	if err != nil {
+		return nil, &ResealError{StagePCRProfile, fmt.Errorf("cannot compute PCR values: %w", err)}
+	}
+	data, err := marshalPCRValuesJSON(pcrValues)
+	if err != nil {
+		return nil, &ResealError{StagePCRProfile, fmt.Errorf("cannot encode PCR values: %w", err)}
+	}
+
+	h := crypto.SHA256.New()
+	h.Write(data)
+	fmt.Fprintf(h, "%s\x00", config.keyringPrefix())
+	for _, name := range keyFiles {
+		keyDigest, err := keyFileDigest(esp, name)
+		if err != nil {
+			return nil, &ResealError{StageKeyFiles, fmt.Errorf("cannot read sealed key file %s: %w", name, err)}
+		}
+		fmt.Fprintf(h, "%s\x00%x\x00%s\x00", name, keyDigest, config.volumeLabel(name))
+	}
+	return h.Sum(nil), nil
+}
+
+// keyFileDigest returns the SHA-256 digest of the contents of the key file
+// with the specified name.
+func keyFileDigest(esp, name string) ([]byte, error) {
+	f, err := appFs.Open(filepath.Join(esp, keyFileDir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := crypto.SHA256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// readBootID returns the ID of the current boot.
+func readBootID() (string, error) {
+	f, err := appFs.Open(bootIDPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// resealStamp returns the contents of the reseal stamp for the current boot
+// and the supplied inputs digest.
+func resealStamp(inputsDigest []byte) (string, error) {
+	bootID, err := readBootID()
+	if err != nil {
+		return "", fmt.Errorf("cannot read boot ID: %w", err)
+	}
+	return fmt.Sprintf("%s %x\n", bootID, inputsDigest), nil
+}
+
+// resealedThisBoot indicates whether a reseal with the supplied inputs digest
+// has already been recorded during the current boot.
+func resealedThisBoot(inputsDigest []byte) bool {
+	stamp, err := resealStamp(inputsDigest)
+	if err != nil {
+		return false
+	}
+
+	f, err := appFs.Open(resealStampPath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return false
+	}
+	return string(data) == stamp
+}
+
+// recordReseal records a successful reseal with the supplied inputs digest
+// during the current boot.
+func recordReseal(inputsDigest []byte) (err error) {
+	stamp, err := resealStamp(inputsDigest)
+	if err != nil {
+		return err
+	}
+
+	if err := appFs.MkdirAll(filepath.Dir(resealStampPath), 0755); err != nil {
+		return fmt.Errorf("cannot make directory: %w", err)
+	}
+
+	f, err := appFs.TempFile(filepath.Dir(resealStampPath), "."+filepath.Base(resealStampPath)+".")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		name := f.Name()
+		f.Close()
+		if err == nil {
+			return
+		}
+		appFs.Remove(name)
+	}()
+
+	if _, err := io.WriteString(f, stamp); err != nil {
+		return err
+	}
+
+	return appFs.Rename(f.Name(), resealStampPath)
+}
+
+// sealedProfileRecord returns the record of the key file with the specified
+// name being sealed against the supplied PCR values.
+func sealedProfileRecord(esp, name string, pcrValues []tpm2.PCRValues) (string, error) {
+	keyDigest, err := keyFileDigest(esp, name)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := marshalPCRValuesJSON(pcrValues)
+	if err != nil {
+		return "", fmt.Errorf("cannot encode PCR values: %w", err)
+	}
+	profileDigest := crypto.SHA256.New()
+	profileDigest.Write(data)
+
+	return fmt.Sprintf("%x %x\n", keyDigest, profileDigest.Sum(nil)), nil
+}
+
+// sealedProfileUnchanged indicates whether the key file with the specified name
+// was last resealed by recordSealedProfile against the supplied PCR values.
+func sealedProfileUnchanged(esp, name string, pcrValues []tpm2.PCRValues) bool {
+	record, err := sealedProfileRecord(esp, name, pcrValues)
+	if err != nil {
+		return false
+	}
+
+	f, err := appFs.Open(filepath.Join(sealedProfilesDir, name))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return false
+	}
+	return string(data) == record
+}
+
+// recordSealedProfile records that the key file with the specified name has
+// been resealed against the supplied PCR values.
+func recordSealedProfile(esp, name string, pcrValues []tpm2.PCRValues) error {
+	record, err := sealedProfileRecord(esp, name, pcrValues)
+	if err != nil {
+		return err
+	}
+
+	if err := appFs.MkdirAll(sealedProfilesDir, 0755); err != nil {
+		return fmt.Errorf("cannot make directory: %w", err)
+	}
+
+	_, err = maybeWriteFile(filepath.Join(sealedProfilesDir, name), []byte(record))
+	return err
+}
+
+// ResealKey updates the PCR profile for each of the disk encryption keys on the
+// ESP to incorporate the boot assets installed directly by the package manager
+// and those assets copied by this package to the ESP. A failure to update one
+// key doesn't prevent the others from being updated. If there are no keys,
+// ErrNoSealedKey is returned.
+func ResealKey(assets *TrustedAssets, km *KernelManager, esp, shimSource string, shim ShimConfig, config ResealConfig) error {
+	return ResealKeyContext(context.Background(), assets, km, esp, shimSource, shim, config)
+}
+
+// ResealKeyContext is like ResealKey, but stops before connecting to the TPM or
+// resealing the next key if ctx is done, and returns ctx.Err(). Keys that have
+// already been resealed keep their new PCR profile.
+func ResealKeyContext(ctx context.Context, assets *TrustedAssets, km *KernelManager, esp, shimSource string, shim ShimConfig, config ResealConfig) error {
+	_, err := ResealKeyWithProfile(ctx, assets, km, esp, shimSource, shim, config)
+	return err
 }
 
-// ResealKey updates the PCR profile for the disk encryption key to incorporate
-// the boot assets installed directly by the package manager and those assets
-// copied by this package to the ESP.
-func ResealKey(assets *TrustedAssets, km *KernelManager, esp, shimSource, vendor string) error {
-	_, err := appFs.Stat(filepath.Join(esp, keyFilePath))
-	if os.IsNotExist(err) {
-		// Assume that this file being missing means there is nothing to do.
-		return nil
+// ResealKeyWithProfile is like ResealKeyContext, but also returns the PCR
+// profile that the keys were sealed against, eg, so that it can be recorded
+// or compared against the measurements of the current boot. The profile is
+// returned whenever it was computed, including when resealing some of the
+// keys failed or was skipped because of config.OncePerBoot.
+func ResealKeyWithProfile(ctx context.Context, assets *TrustedAssets, km *KernelManager, esp, shimSource string, shim ShimConfig, config ResealConfig) (*ComputedPCRProfile, error) {
+	if err := config.validate(); err != nil {
+		return nil, &ResealError{StageConfig, err}
 	}
 
-	context := new(pcrProfileComputeContext)
+	keyFiles, err := sealedKeyFiles(esp)
+	if err != nil {
+		return nil, &ResealError{StageKeyFiles, fmt.Errorf("cannot determine sealed key files: %w", err)}
+	}
+	if len(keyFiles) == 0 {
+		// Assume that there being no key files means there is nothing to do.
+		return nil, ErrNoSealedKey
+	}
 
-	shimBase := "shim" + GetEfiArchitecture() + ".efi"
+	pctx := new(pcrProfileComputeContext)
+
+	shimBase := shim.basename()
 
 	var roots []*secboot_efi.ImageLoadEvent
 
-	for _, path := range []string{
-		filepath.Join(shimSource, shimBase+".signed"),
-		filepath.Join(esp, "EFI", vendor, shimBase)} {
+	var shimPaths []string
+	if config.ShimRoots != ShimRootsTarget {
+		shimPaths = append(shimPaths, filepath.Join(shimSource, shimBase+".signed"))
+	}
+	if config.ShimRoots != ShimRootsSource && !config.CommittedOnly {
+		shimPaths = append(shimPaths, filepath.Join(esp, "EFI", shim.Vendor, shimBase))
+		for _, backup := range km.backups {
+			shimPaths = append(shimPaths, filepath.Join(backup.esp, "EFI", shim.Vendor, shimBase))
+		}
+	}
+
+	for _, path := range shimPaths {
 		_, err := appFs.Stat(path)
-		if os.IsNotExist(err) {
+		switch {
+		case os.IsNotExist(err):
 			continue
+		case err != nil:
+			return nil, &ResealError{StagePCRProfile, fmt.Errorf("cannot stat shim %s: %w", path, err)}
 		}
 
 		roots = append(roots, &secboot_efi.ImageLoadEvent{
 			Source: secboot_efi.Firmware,
-			Image:  newTrustedEFIImage(assets, context, path)})
+			Image:  newTrustedEFIImage(assets, pctx, path)})
 	}
 
 	var kernels []*secboot_efi.ImageLoadEvent
+	var cmdlines []string
+	seenCmdlines := make(map[string]bool)
+	addCmdline := func(cmdline string) {
+		if !seenCmdlines[cmdline] {
+			seenCmdlines[cmdline] = true
+			cmdlines = append(cmdlines, cmdline)
+		}
+	}
 
-	for _, x := range []struct {
+	type kernelDir struct {
 		dir   string
 		files []string
-	}{
-		{
-			dir:   km.sourceDir,
-			files: km.sourceKernels,
-		},
-		{
-			dir:   km.targetDir,
-			files: km.targetKernels,
-		},
-	} {
+	}
+	kernelDirs := []kernelDir{{dir: km.sourceDir, files: km.kernelsToInstall()}}
+	if !config.CommittedOnly {
+		for _, m := range km.managers() {
+			kernelDirs = append(kernelDirs, kernelDir{dir: m.targetDir, files: m.targetKernels})
+		}
+	}
+
+	for _, x := range kernelDirs {
 		for _, n := range x.files {
 			path := filepath.Join(x.dir, n)
 
 			kernels = append(kernels, &secboot_efi.ImageLoadEvent{
 				Source: secboot_efi.Shim,
-				Image:  newTrustedEFIImage(assets, context, path)})
+				Image:  newTrustedEFIImage(assets, pctx, path)})
+
+			cmdline, err := km.kernelCmdline(n)
+			if err != nil {
+				return nil, &ResealError{StagePCRProfile, err}
+			}
+			addCmdline(cmdline)
 		}
 	}
 
+	for _, cmdline := range config.KernelCmdlines {
+		addCmdline(cmdline)
+	}
+
 	for _, root := range roots {
 		root.Next = kernels
 	}
 
-	authKey, err := getPolicyAuthKeyFromKernel()
+	pcrProfile, computed, err := computePCRProtectionProfile(roots, cmdlines, config)
 	if err != nil {
-		return fmt.Errorf("cannot obtain auth key from kernel: %w", err)
+		return nil, &ResealError{StagePCRProfile, fmt.Errorf("cannot compute PCR profile: %w", err)}
 	}
 
-	pcrProfile, err := computePCRProtectionProfile(roots)
-	if err != nil {
-		return fmt.Errorf("cannot compute PCR profile: %w", err)
+	if leaked := pctx.leaked(); len(leaked) > 0 {
+		return nil, &ResealError{StagePCRProfile, fmt.Errorf("leaked open files from computing PCR profile: %v", leaked)}
 	}
 
-	if context.nOpen != 0 {
-		return errors.New("leaked open files from computing PCR profile")
+	if failed := pctx.failed(); len(failed) > 0 {
+		return nil, &ResealError{StageIntegrity, fmt.Errorf("some assets failed an integrity check: %v", failed)}
+	}
+
+	var inputsDigest []byte
+	if config.OncePerBoot {
+		inputsDigest, err = resealInputsDigest(esp, pcrProfile, keyFiles, config)
+		if err != nil {
+			return computed, err
+		}
+		if resealedThisBoot(inputsDigest) {
+			log.Println("Keys already resealed with identical inputs during this boot")
+			return computed, nil
+		}
 	}
 
-	if len(context.failedPaths) > 0 {
-		return fmt.Errorf("some assets failed an integrity check: %v", context.failedPaths)
+	if config.SkipUnchanged {
+		var changed []string
+		for _, name := range keyFiles {
+			if sealedProfileUnchanged(esp, name, computed.Values) {
+				log.Printf("%s is already sealed against the computed PCR profile\n", name)
+				continue
+			}
+			changed = append(changed, name)
+		}
+		if len(changed) == 0 {
+			return computed, ErrResealNotNeeded
+		}
+		keyFiles = changed
 	}
 
-	k, err := sbtpmReadSealedKeyObjectFromFile(filepath.Join(esp, keyFilePath))
-	if err != nil {
-		return fmt.Errorf("cannot read sealed key file: %w", err)
+	if err := ctx.Err(); err != nil {
+		return computed, err
 	}
 
 	// XXX: Connection is required because we do integrity checks
 	// on the key data. Should probably switch to using the /dev/tpmrm0
-	// device here.
+	// device here, but secboot has no public API for connecting to
+	// another device and initializing the connection's session.
 	tpm, err := sbtpmConnectToDefaultTPM()
 	if err != nil {
-		return err
+		return computed, &ResealError{StageTPM, err}
 	}
 	defer tpm.Close()
 
-	if err := sbtpmSealedKeyObjectUpdatePCRProtectionPolicy(k, tpm, authKey, pcrProfile); err != nil {
-		return fmt.Errorf("cannot update PCR profile: %w", err)
+	// Update every key even if some of them fail.
+	var errs []error
+	for _, name := range keyFiles {
+		if err := ctx.Err(); err != nil {
+			for _, err := range errs {
+				log.Println(err)
+			}
+			return computed, err
+		}
+		if err := resealKeyFile(esp, name, tpm, pcrProfile, config); err != nil {
+			errs = append(errs, fmt.Errorf("cannot reseal %s: %w", name, err))
+			continue
+		}
+		if config.SkipUnchanged {
+			if err := recordSealedProfile(esp, name, computed.Values); err != nil {
+				log.Printf("cannot record PCR profile of %s: %v\n", name, err)
+			}
+		}
 	}
 
-	w := secboot_tpm2.NewFileSealedKeyObjectWriter(filepath.Join(esp, keyFilePath))
-	if err := sbtpmSealedKeyObjectWriteAtomic(k, w); err != nil {
-		return fmt.Errorf("cannot write updated sealed key object: %w", err)
+	switch len(errs) {
+	case 0:
+		if config.OncePerBoot {
+			if err := recordReseal(inputsDigest); err != nil {
+				log.Println("cannot record reseal:", err)
+			}
+		}
+		return computed, nil
+	case 1:
+		return computed, errs[0]
+	default:
+		var msgs []string
+		stage := resealStage(errs[0])
+		for _, err := range errs {
+			msgs = append(msgs, err.Error())
+			if resealStage(err) != stage {
+				stage = 0
+			}
+		}
+		err := errors.New(strings.Join(msgs, "; "))
+		if stage == 0 {
+			return computed, err
+		}
+		return computed, &ResealError{stage, err}
 	}
+}
 
-	return nil
+// selectLogAlgorithm returns the digest algorithm that TrustCurrentBoot should use
+// to match boot assets against events in the supplied TCG log. The algorithm used
+// for computing PCR profiles is preferred, but if the log doesn't contain digests
+// for it then the strongest algorithm that the log has in common with logAlgorithms
+// is used instead.
+func selectLogAlgorithm(eventLog *tcglog.Log) (tpm2.HashAlgorithmId, error) {
+	if eventLog.Algorithms.Contains(pcrAlgorithm) {
+		return pcrAlgorithm, nil
+	}
+
+	for _, alg := range logAlgorithms {
+		if !alg.Available() || !eventLog.Algorithms.Contains(alg) {
+			continue
+		}
+		log.Printf("TCG log does not contain %v digests, using %v instead\n", pcrAlgorithm, alg)
+		return alg, nil
+	}
+
+	return tpm2.HashAlgorithmNull, fmt.Errorf("TCG log has no digest algorithm in common with %v (log contains %v)", logAlgorithms, eventLog.Algorithms)
 }
 
-// TrustCurrentBoot adds the assets used in the current boot to the list of boot
-// assets trusted for adding to PCR profiles with ResealKey. It works by mapping
-// EV_EFI_BOOT_SERVICES_APPLICATION events from the TCG log to files stored in the
-// ESP.
-func TrustCurrentBoot(assets *TrustedAssets, esp string) error {
-	f, err := appFs.Open("/sys/kernel/security/tpm0/binary_bios_measurements")
-	if err != nil {
-		return err
+// securityFSPath is the mount point of securityfs, where the kernel exposes
+// the TCG log of each TPM device.
+const securityFSPath = "/sys/kernel/security"
+
+// TCGLogSource selects the TCG log of the current boot to read.
+type TCGLogSource struct {
+	// Path is the path of the TCG log. If empty, the log is read from
+	// securityfs.
+	Path string
+
+	// TPMDevice is the name of the TPM device in securityfs whose log is read
+	// if Path is empty, for example, "tpm1". If empty, the log of the first
+	// TPM device that has one is read.
+	TPMDevice string
+}
+
+// candidates returns the paths of the TCG logs to try, in order.
+func (s TCGLogSource) candidates() []string {
+	switch {
+	case s.Path != "":
+		return []string{s.Path}
+	case s.TPMDevice != "":
+		return []string{filepath.Join(securityFSPath, s.TPMDevice, "binary_bios_measurements")}
 	}
-	defer f.Close()
 
-	eventLog, err := tcglog.ReadLog(f, &tcglog.LogOptions{})
-	if err != nil {
-		return fmt.Errorf("cannot read TCG log: %v", err)
+	// If securityfs can't be read, opening the log of tpm0 will fail too
+	entries, _ := appFs.ReadDir(securityFSPath)
+	indices := []int{0}
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "tpm") {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimPrefix(e.Name(), "tpm")); err == nil && n > 0 {
+			indices = append(indices, n)
+		}
+	}
+	sort.Ints(indices)
+
+	var paths []string
+	for _, n := range indices {
+		paths = append(paths, filepath.Join(securityFSPath, fmt.Sprintf("tpm%d", n), "binary_bios_measurements"))
 	}
+	return paths
+}
+
+// MeasuredImage is an EFI image that was measured into PCR 4 by the firmware
+// or shim during the current boot.
+type MeasuredImage struct {
+	// Path is the path of the image relative to the root of the filesystem it
+	// was loaded from, or empty if it wasn't loaded from a filesystem.
+	Path string
 
+	DevicePath efi.DevicePath   // DevicePath is the device path of the image
+	Digests    tcglog.DigestMap // Digests are the measured PE image digests
+}
+
+// readTCGLog reads the TCG log of the current boot from the first of the
+// candidate paths of source that exists.
+func readTCGLog(source TCGLogSource) (*tcglog.Log, error) {
+	paths := source.candidates()
+	for _, path := range paths {
+		f, err := appFs.Open(path)
+		switch {
+		case os.IsNotExist(err):
+			continue
+		case err != nil:
+			return nil, err
+		}
+		defer f.Close()
+
+		eventLog, err := tcglog.ReadLog(f, &tcglog.LogOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("cannot read TCG log %s: %v", path, err)
+		}
+		return eventLog, nil
+	}
+
+	return nil, fmt.Errorf("cannot find TCG log, tried %s", strings.Join(paths, ", "))
+}
+
+// measuredImages returns the images from the EV_EFI_BOOT_SERVICES_APPLICATION
+// events in PCR 4 of the supplied TCG log, in the order they were measured.
+func measuredImages(eventLog *tcglog.Log) []MeasuredImage {
+	var images []MeasuredImage
 	for _, event := range eventLog.Events {
 		if event.PCRIndex != 4 {
 			continue
@@ -343,20 +1218,81 @@ func TrustCurrentBoot(assets *TrustedAssets, esp string) error {
 			continue
 		}
 
-		fpdp, ok := data.DevicePath[len(data.DevicePath)-1].(efi.FilePathDevicePathNode)
-		if !ok {
+		image := MeasuredImage{DevicePath: data.DevicePath, Digests: event.Digests}
+		if len(data.DevicePath) > 0 {
+			if fpdp, ok := data.DevicePath[len(data.DevicePath)-1].(efi.FilePathDevicePathNode); ok {
+				components := strings.Split(string(fpdp), "\\")
+				image.Path = strings.Join(components, string(os.PathSeparator))
+			}
+		}
+		images = append(images, image)
+	}
+	return images
+}
+
+// ParseBootMeasurements returns the PE images that were measured into PCR 4
+// during the current boot according to the TCG log, which can be compared
+// against the boot assets to diagnose why a sealed key cannot be unsealed.
+func ParseBootMeasurements(source TCGLogSource) ([]MeasuredImage, error) {
+	eventLog, err := readTCGLog(source)
+	if err != nil {
+		return nil, err
+	}
+	return measuredImages(eventLog), nil
+}
+
+// ImageDigestMismatch describes a measured image whose PE image digest on the
+// ESP differs from the digest that was measured during the current boot.
+type ImageDigestMismatch struct {
+	Path     string // Path is the path of the image on the ESP
+	Expected []byte // Expected is the digest from the TCG log
+	Computed []byte // Computed is the digest of the image on the ESP
+}
+
+// CurrentBootReport describes the images measured during the current boot
+// that TrustCurrentBoot could not trust.
+type CurrentBootReport struct {
+	// Missing are the paths of measured images that don't exist on the ESP
+	Missing []string
+
+	// Mismatches are the measured images that differ from the images on the
+	// ESP, eg, because they were tampered with or updated in place.
+	Mismatches []ImageDigestMismatch
+}
+
+// TrustCurrentBoot adds the assets used in the current boot to the list of boot
+// assets trusted for adding to PCR profiles with ResealKey. It works by mapping
+// EV_EFI_BOOT_SERVICES_APPLICATION events from the TCG log to files stored in the
+// ESP. The TCG log is read from the specified source.
+//
+// Measured images that don't exist on the ESP or that differ from the images on
+// the ESP are not trusted, and are returned in the report so that the caller
+// can warn that fewer assets may be trusted than were used to boot.
+func TrustCurrentBoot(assets *TrustedAssets, esp string, source TCGLogSource) (*CurrentBootReport, error) {
+	eventLog, err := readTCGLog(source)
+	if err != nil {
+		return nil, err
+	}
+
+	alg, err := selectLogAlgorithm(eventLog)
+	if err != nil {
+		return nil, err
+	}
+
+	report := new(CurrentBootReport)
+	for _, image := range measuredImages(eventLog) {
+		if image.Path == "" {
 			// Ignore application not stored in a filesystem
 			continue
 		}
-
-		components := strings.Split(string(fpdp), "\\")
-		path := strings.Join(components, string(os.PathSeparator))
+		path := image.Path
 
 		err := func() error {
 			f, err := appFs.Open(filepath.Join(esp, path))
 			switch {
 			case os.IsNotExist(err):
 				log.Println("Missing file:", filepath.Join(esp, path))
+				report.Missing = append(report.Missing, filepath.Join(esp, path))
 				return nil
 			case err != nil:
 				return err
@@ -364,7 +1300,7 @@ func TrustCurrentBoot(assets *TrustedAssets, esp string) error {
 
 			peHashMatch := false
 
-			hf, err := newHashedFile(f, assets.alg(), func(leafHashes [][]byte) {
+			hf, err := newHashedFile(f, assets.alg(), assets.blockSize(), func(leafHashes [][]byte) {
 				if !peHashMatch {
 					return
 				}
@@ -376,20 +1312,26 @@ func TrustCurrentBoot(assets *TrustedAssets, esp string) error {
 			}
 			defer hf.Close()
 
-			digest, err := efiComputePeImageDigest(crypto.SHA256, hf, hf.Size())
+			digest, err := efiComputePeImageDigest(alg.GetHash(), hf, hf.Size())
 			if err != nil {
 				return fmt.Errorf("cannot compute PE image hash: %v", err)
 			}
-			if bytes.Equal(digest, event.Digests[tpm2.HashAlgorithmSHA256]) {
+			if bytes.Equal(digest, image.Digests[alg]) {
 				peHashMatch = true
+			} else {
+				log.Println("PE image digest mismatch:", filepath.Join(esp, path))
+				report.Mismatches = append(report.Mismatches, ImageDigestMismatch{
+					Path:     filepath.Join(esp, path),
+					Expected: image.Digests[alg],
+					Computed: digest})
 			}
 
 			return nil
 		}()
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	return nil
+	return report, nil
 }
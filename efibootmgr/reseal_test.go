@@ -6,10 +6,18 @@ package efibootmgr
 
 import (
 	"bytes"
+	"context"
 	"crypto"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/canonical/go-efilib"
 	"github.com/canonical/go-tpm2"
@@ -92,11 +100,19 @@ func (*resealSuite) mockUnixKeyctlInt(fn func(cmd, arg2, arg3, arg4, arg5 int) (
 	}
 }
 
-func (*resealSuite) mockEfiArch(arch string) (restore func()) {
-	orig := appArchitecture
-	appArchitecture = arch
+func (*resealSuite) mockPCRAlgorithm(alg tpm2.HashAlgorithmId) (restore func()) {
+	orig := pcrAlgorithm
+	pcrAlgorithm = alg
 	return func() {
-		appArchitecture = orig
+		pcrAlgorithm = orig
+	}
+}
+
+func (*resealSuite) mockEfiArch(arch EFIArch) (restore func()) {
+	orig := architectureOverride()
+	SetArchitecture(arch)
+	return func() {
+		SetArchitecture(orig)
 	}
 
 }
@@ -117,7 +133,7 @@ func (s *resealSuite) TestTrustedEfiImageOk(c *check.C) {
 	c.Assert(err, check.IsNil)
 
 	c.Check(f.Close(), check.IsNil)
-	c.Check(context.nOpen, check.Equals, 0)
+	c.Check(context.leaked(), check.IsNil)
 	c.Check(context.failedPaths, check.IsNil)
 }
 
@@ -134,16 +150,138 @@ func (s *resealSuite) TestTrustedEfiImageBad(c *check.C) {
 	c.Assert(err, check.IsNil)
 
 	c.Check(f.Close(), check.IsNil)
-	c.Check(context.nOpen, check.Equals, 0)
+	c.Check(context.leaked(), check.IsNil)
 	c.Check(context.failedPaths, check.DeepEquals, []string{"/foo"})
 }
 
+func (s *resealSuite) TestTrustedEfiImageMissing(c *check.C) {
+	assets, err := ReadTrustedAssets()
+	c.Assert(err, check.IsNil)
+
+	context := new(pcrProfileComputeContext)
+	img := newTrustedEFIImage(assets, context, "/foo")
+
+	_, err = img.Open()
+	c.Check(err, check.ErrorMatches, "boot asset /foo is missing: open /foo: file does not exist")
+	c.Check(errors.Is(err, os.ErrNotExist), check.Equals, true)
+	c.Check(context.leaked(), check.IsNil)
+	c.Check(context.failedPaths, check.IsNil)
+}
+
+func (s *resealSuite) TestTrustedEfiImageLeak(c *check.C) {
+	s.writeFile(c, "/foo", 0, 43, 50)
+	s.writeFile(c, "/bar", 3, 97, 100)
+
+	assets, err := ReadTrustedAssets()
+	c.Assert(err, check.IsNil)
+	c.Check(assets.TrustNewFromDir("/"), check.IsNil)
+
+	context := new(pcrProfileComputeContext)
+	foo := newTrustedEFIImage(assets, context, "/foo")
+	bar := newTrustedEFIImage(assets, context, "/bar")
+
+	f1, err := foo.Open()
+	c.Assert(err, check.IsNil)
+	f2, err := foo.Open()
+	c.Assert(err, check.IsNil)
+	f3, err := bar.Open()
+	c.Assert(err, check.IsNil)
+	c.Check(context.leaked(), check.DeepEquals, []string{"/bar", "/foo"})
+
+	c.Check(f1.Close(), check.IsNil)
+	c.Check(f3.Close(), check.IsNil)
+	c.Check(context.leaked(), check.DeepEquals, []string{"/foo"})
+
+	c.Check(f2.Close(), check.IsNil)
+	c.Check(context.leaked(), check.IsNil)
+}
+
+func (s *resealSuite) TestTrustedEfiImageParallel(c *check.C) {
+	s.writeFile(c, "/foo", 0, 43, 50)
+	s.writeFile(c, "/bar", 3, 97, 100)
+
+	assets, err := ReadTrustedAssets()
+	c.Assert(err, check.IsNil)
+	c.Check(assets.TrustNewFromDir("/"), check.IsNil)
+	c.Check(s.fs.WriteFile("/baz", []byte("untrusted"), 0644), check.IsNil)
+
+	context := new(pcrProfileComputeContext)
+
+	paths := []string{"/foo", "/bar", "/baz"}
+	errs := make([]error, 10*len(paths))
+
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f, err := newTrustedEFIImage(assets, context, paths[i%len(paths)]).Open()
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			if _, err := f.ReadAt(make([]byte, 5), 0); err != nil {
+				errs[i] = err
+			}
+			f.Close()
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		c.Check(err, check.IsNil)
+	}
+	c.Check(context.leaked(), check.IsNil)
+	c.Check(context.failed(), check.HasLen, 10)
+	for _, path := range context.failed() {
+		c.Check(path, check.Equals, "/baz")
+	}
+}
+
+func (s *resealSuite) TestResolveLink(c *check.C) {
+	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
+	s.symlink(c, "../../sda1", "/dev/disk/by-partuuid/94725587-885d-4bde-bc61-078e0010057d")
+	s.symlink(c, "/dev/disk/by-partuuid/94725587-885d-4bde-bc61-078e0010057d", "/dev/disk/by-label/cloudimg-rootfs-enc")
+
+	path, err := resolveLink("/dev/disk/by-label/cloudimg-rootfs-enc")
+	c.Check(err, check.IsNil)
+	c.Check(path, check.Equals, "/dev/sda1")
+}
+
+func (s *resealSuite) TestResolveLinkLoop(c *check.C) {
+	s.symlink(c, "/dev/disk/by-label/b", "/dev/disk/by-label/a")
+	s.symlink(c, "a", "/dev/disk/by-label/b")
+
+	_, err := resolveLink("/dev/disk/by-label/a")
+	c.Check(err, check.ErrorMatches, "readlink /dev/disk/by-label/a: too many levels of symbolic links")
+	c.Check(errors.Is(err, syscall.ELOOP), check.Equals, true)
+}
+
 type testResealKeyData struct {
-	arch         string
+	arch         EFIArch
 	auxiliaryKey []byte
 	devicePaths  []string
 	shims        [][]byte
 	kernels      [][]byte
+
+	maxInstalledKernels int
+	cmdlineTransform    func(version, cmdline string) (string, error)
+	pcr12               []tpm2.Digest
+	pcrs                []int
+	kernelCmdlines      []string
+	profileJSON         string
+	keyringPrefix       string
+	rootfsLabel         string
+	shimRoots           ShimRoots
+	epoch               uint32
+	committedOnly       bool
+	oncePerBoot         bool
+	policyAuthKeyDir    string
+	skipUnchanged       bool
+	backupESPs          []string
+	skipped             bool
+	cancel              bool
+	expectedErr         error
 }
 
 func (s *resealSuite) testResealKey(c *check.C, data *testResealKeyData) {
@@ -156,8 +294,14 @@ func (s *resealSuite) testResealKey(c *check.C, data *testResealKeyData) {
 	restore := s.mockEfiArch(data.arch)
 	defer restore()
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	restore = s.mockSbefiAddBootManagerProfile(func(profile *secboot_tpm2.PCRProtectionProfile, params *secboot_efi.BootManagerProfileParams) error {
 		c.Assert(profile, check.NotNil)
+		if data.cancel {
+			cancel()
+		}
 		c.Check(params.PCRAlgorithm, check.Equals, tpm2.HashAlgorithmSHA256)
 
 		c.Assert(params.LoadSequences, check.HasLen, len(data.shims))
@@ -232,7 +376,13 @@ func (s *resealSuite) testResealKey(c *check.C, data *testResealKeyData) {
 
 	n := 0
 	restore = s.mockSbGetAuxiliaryKeyFromKernel(func(prefix, devicePath string, remove bool) (secboot.AuxiliaryKey, error) {
-		c.Check(prefix, check.Equals, "ubuntu-fde")
+		c.Check(data.policyAuthKeyDir, check.Equals, "", check.Commentf("unexpected read from kernel keyring"))
+
+		expectedPrefix := data.keyringPrefix
+		if expectedPrefix == "" {
+			expectedPrefix = "ubuntu-fde"
+		}
+		c.Check(prefix, check.Equals, expectedPrefix)
 		c.Check(devicePath, check.Equals, data.devicePaths[n])
 		c.Check(remove, check.Equals, false)
 
@@ -268,20 +418,37 @@ func (s *resealSuite) testResealKey(c *check.C, data *testResealKeyData) {
 	})
 	defer restore()
 
+	var updatedProfile *secboot_tpm2.PCRProtectionProfile
 	restore = s.mockSbtpmSealedKeyObjectUpdatePCRProtectionPolicy(func(k *secboot_tpm2.SealedKeyObject, tpm *secboot_tpm2.Connection, authKey secboot_tpm2.PolicyAuthKey, profile *secboot_tpm2.PCRProtectionProfile) error {
 		c.Check(k, check.Equals, expectedSko)
 		c.Check(tpm, check.Equals, expectedTpm)
 		c.Check(authKey, check.DeepEquals, secboot_tpm2.PolicyAuthKey(data.auxiliaryKey))
 		c.Assert(profile, check.NotNil)
+		updatedProfile = profile
 
 		pcrs, _, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
 		c.Check(err, check.IsNil)
-		c.Check(pcrs.Equal(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{4, 7, 12}}}), check.Equals, true)
+		expectedPCRs := data.pcrs
+		if expectedPCRs == nil {
+			expectedPCRs = []int{4, 7, 12}
+		}
+		c.Check(pcrs.Equal(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: expectedPCRs}}), check.Equals, true)
+
+		if data.pcr12 != nil {
+			values, err := profile.ComputePCRValues(nil)
+			c.Check(err, check.IsNil)
+			var pcr12 []tpm2.Digest
+			for _, v := range values {
+				pcr12 = append(pcr12, v[tpm2.HashAlgorithmSHA256][12])
+			}
+			c.Check(pcr12, check.DeepEquals, data.pcr12)
+		}
 		return nil
 	})
 	defer restore()
 
 	restore = s.mockSbtpmSealedKeyObjectWriteAtomic(func(k *secboot_tpm2.SealedKeyObject, w secboot.KeyDataWriter) error {
+		c.Check(data.skipped, check.Equals, false)
 		c.Check(k, check.Equals, expectedSko)
 		fw, ok := w.(*secboot_tpm2.FileSealedKeyObjectWriter)
 		c.Check(ok, check.Equals, true)
@@ -310,10 +477,44 @@ func (s *resealSuite) testResealKey(c *check.C, data *testResealKeyData) {
 
 	bm, err := NewBootManagerForVariables(&mockvars)
 	c.Assert(err, check.IsNil)
-	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", "ubuntu", &bm)
+	km, err := NewKernelManagerForESPs(append([]string{"/boot/efi"}, data.backupESPs...), "/usr/lib/linux", ShimConfig{Vendor: "ubuntu"}, &bm)
 	c.Assert(err, check.IsNil)
-
-	c.Check(ResealKey(assets, km, "/boot/efi", "/usr/lib/nullboot/shim", "ubuntu"), check.IsNil)
+	km.MaxInstalledKernels = data.maxInstalledKernels
+	km.CmdlineTransform = data.cmdlineTransform
+
+	profileJSON := new(bytes.Buffer)
+	computed, err := ResealKeyWithProfile(ctx, assets, km, "/boot/efi", "/usr/lib/nullboot/shim", ShimConfig{Vendor: "ubuntu"}, ResealConfig{
+		PCRs:             data.pcrs,
+		KernelCmdlines:   data.kernelCmdlines,
+		ProfileJSON:      profileJSON,
+		KeyringPrefix:    data.keyringPrefix,
+		RootfsLabel:      data.rootfsLabel,
+		ShimRoots:        data.shimRoots,
+		Epoch:            data.epoch,
+		CommittedOnly:    data.committedOnly,
+		OncePerBoot:      data.oncePerBoot,
+		PolicyAuthKeyDir: data.policyAuthKeyDir,
+		SkipUnchanged:    data.skipUnchanged})
+	c.Check(err, check.Equals, data.expectedErr)
+	if updatedProfile != nil {
+		// The returned profile is the one the key was resealed with.
+		c.Assert(computed, check.NotNil)
+		pcrs, digests, err := updatedProfile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+		c.Check(err, check.IsNil)
+		c.Check(computed.Selection.Equal(pcrs), check.Equals, true)
+		c.Check(computed.Digests, check.DeepEquals, digests)
+		values, err := updatedProfile.ComputePCRValues(nil)
+		c.Check(err, check.IsNil)
+		c.Check(computed.Values, check.DeepEquals, values)
+	}
+	if data.skipped {
+		c.Check(expectedTpm, check.IsNil)
+	} else if len(data.devicePaths) > 0 || data.policyAuthKeyDir != "" {
+		c.Check(expectedTpm, check.NotNil)
+	}
+	if data.profileJSON != "" {
+		c.Check(profileJSON.String(), check.Equals, data.profileJSON)
+	}
 }
 
 func (s *resealSuite) TestResealKeyNoFDE(c *check.C) {
@@ -322,7 +523,7 @@ func (s *resealSuite) TestResealKeyNoFDE(c *check.C) {
 	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
 	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel-efi.1.0-2-generic", []byte("kernel2"), 0600), check.IsNil)
 
-	s.testResealKey(c, &testResealKeyData{})
+	s.testResealKey(c, &testResealKeyData{expectedErr: ErrNoSealedKey})
 }
 
 func (s *resealSuite) TestResealKeyBeforeNewKernel(c *check.C) {
@@ -381,38 +582,43 @@ func (s *resealSuite) TestResealKeyAfterNewKernel(c *check.C) {
 	})
 }
 
-func (s *resealSuite) TestResealKeyBeforeNewShim(c *check.C) {
+func (s *resealSuite) TestResealKeyMaxInstalledKernels(c *check.C) {
 	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
 	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
 
 	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
 	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
-	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim2"), 0600), check.IsNil)
-	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic", []byte("kernel2"), 0600), check.IsNil)
 	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-2-generic", []byte("kernel2"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-3-generic", []byte("kernel3"), 0600), check.IsNil)
 
 	s.testResealKey(c, &testResealKeyData{
 		arch:         "x64",
 		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
 		devicePaths:  []string{"/dev/sda1"},
 		shims: [][]byte{
-			[]byte("shim2"),
+			[]byte("shim1"),
 			[]byte("shim1"),
 		},
 		kernels: [][]byte{
-			[]byte("kernel1"),
-			[]byte("kernel1"),
+			[]byte("kernel3"),
+			[]byte("kernel2"),
+			[]byte("kernel2"),
 		},
+		maxInstalledKernels: 2,
 	})
 }
 
-func (s *resealSuite) TestResealKeyAfterNewShim(c *check.C) {
+func (s *resealSuite) TestResealKeyKernelCmdline(c *check.C) {
 	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
 	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
 
+	c.Check(s.fs.WriteFile("/etc/kernel/cmdline", []byte("root=magic\n"), 0644), check.IsNil)
 	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
-	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim2"), 0600), check.IsNil)
-	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim2"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim1"), 0600), check.IsNil)
 	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
 	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
 
@@ -421,25 +627,29 @@ func (s *resealSuite) TestResealKeyAfterNewShim(c *check.C) {
 		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
 		devicePaths:  []string{"/dev/sda1"},
 		shims: [][]byte{
-			[]byte("shim2"),
-			[]byte("shim2"),
+			[]byte("shim1"),
+			[]byte("shim1"),
 		},
 		kernels: [][]byte{
 			[]byte("kernel1"),
 			[]byte("kernel1"),
 		},
+		pcr12: []tpm2.Digest{
+			decodeHexString(c, "00644e7853dbe7452f146a4f1b1c8cf124d602115c1b0529e77eee03db252697"),
+		},
 	})
 }
 
-func (s *resealSuite) TestResealKeyBeforeRemoveKernel(c *check.C) {
+func (s *resealSuite) TestResealKeyKernelCmdlineTransform(c *check.C) {
 	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
 	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
 
+	c.Check(s.fs.WriteFile("/etc/kernel/cmdline", []byte("root=magic\n"), 0644), check.IsNil)
 	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
 	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
 	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim1"), 0600), check.IsNil)
 	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
-	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic", []byte("kernel2"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
 	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-2-generic", []byte("kernel2"), 0600), check.IsNil)
 
 	s.testResealKey(c, &testResealKeyData{
@@ -451,22 +661,35 @@ func (s *resealSuite) TestResealKeyBeforeRemoveKernel(c *check.C) {
 			[]byte("shim1"),
 		},
 		kernels: [][]byte{
-			[]byte("kernel2"),
 			[]byte("kernel2"),
 			[]byte("kernel1"),
+			[]byte("kernel1"),
+		},
+		cmdlineTransform: func(version, cmdline string) (string, error) {
+			switch version {
+			case "1.0-2-generic":
+				return cmdline + " console=ttyS0", nil
+			default:
+				return "", nil
+			}
+		},
+		pcr12: []tpm2.Digest{
+			decodeHexString(c, "0d4490169a9f8d61f20edc7d94ef04d4a021dd15aa2ad89da50c4c826fdfebb9"),
+			decodeHexString(c, "3d458cfe55cc03ea1f443f1562beec8df51c75e14a9fcf9a7234a13f198e7969"),
 		},
 	})
 }
 
-func (s *resealSuite) TestResealKeyAfterRemoveKernel(c *check.C) {
+func (s *resealSuite) TestResealKeyKernelCmdlineCandidates(c *check.C) {
 	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
 	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
 
+	c.Check(s.fs.WriteFile("/etc/kernel/cmdline", []byte("root=magic\n"), 0644), check.IsNil)
 	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
 	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
 	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim1"), 0600), check.IsNil)
-	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic", []byte("kernel2"), 0600), check.IsNil)
-	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-2-generic", []byte("kernel2"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
 
 	s.testResealKey(c, &testResealKeyData{
 		arch:         "x64",
@@ -477,78 +700,137 @@ func (s *resealSuite) TestResealKeyAfterRemoveKernel(c *check.C) {
 			[]byte("shim1"),
 		},
 		kernels: [][]byte{
-			[]byte("kernel2"),
-			[]byte("kernel2"),
+			[]byte("kernel1"),
+			[]byte("kernel1"),
+		},
+		kernelCmdlines: []string{"root=magic", "root=magic verbose"},
+		pcr12: []tpm2.Digest{
+			decodeHexString(c, "00644e7853dbe7452f146a4f1b1c8cf124d602115c1b0529e77eee03db252697"),
+			decodeHexString(c, "95a5dcfd69e691670756fe173c252f815fb1939dad5cafd7c1b09eb92afae573"),
 		},
 	})
 }
 
-func (s *resealSuite) TestResealKeyDifferentAuxiliaryKey(c *check.C) {
+func (s *resealSuite) TestResealKeyProfileJSON(c *check.C) {
 	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
 	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
 
 	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
 	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
-	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim2"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim1"), 0600), check.IsNil)
 	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
 	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
 
 	s.testResealKey(c, &testResealKeyData{
 		arch:         "x64",
-		auxiliaryKey: []byte{5, 6, 7, 8, 9},
+		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
 		devicePaths:  []string{"/dev/sda1"},
 		shims: [][]byte{
-			[]byte("shim2"),
+			[]byte("shim1"),
 			[]byte("shim1"),
 		},
 		kernels: [][]byte{
 			[]byte("kernel1"),
 			[]byte("kernel1"),
 		},
+		profileJSON: `{
+  "branches": [
+    {
+      "values": [
+        {
+          "pcr": 4,
+          "alg": "sha256",
+          "digest": "0000000000000000000000000000000000000000000000000000000000000000"
+        },
+        {
+          "pcr": 7,
+          "alg": "sha256",
+          "digest": "0000000000000000000000000000000000000000000000000000000000000000"
+        },
+        {
+          "pcr": 12,
+          "alg": "sha256",
+          "digest": "3d458cfe55cc03ea1f443f1562beec8df51c75e14a9fcf9a7234a13f198e7969"
+        }
+      ]
+    }
+  ]
+}`,
 	})
 }
 
-func (s *resealSuite) TestResealKeyDifferentBlockDevice(c *check.C) {
-	c.Check(s.fs.WriteFile("/dev/vda14", nil, os.ModeDevice|0660), check.IsNil)
-	s.symlink(c, "/dev/vda14", "/dev/disk/by-label/cloudimg-rootfs-enc")
+func (s *resealSuite) TestResealKeyCustomKeyringPrefixAndLabel(c *check.C) {
+	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/my-rootfs")
 
 	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
 	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
-	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim2"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim1"), 0600), check.IsNil)
 	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
 	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
 
 	s.testResealKey(c, &testResealKeyData{
 		arch:         "x64",
 		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
-		devicePaths:  []string{"/dev/vda14"},
+		devicePaths:  []string{"/dev/sda1"},
 		shims: [][]byte{
-			[]byte("shim2"),
+			[]byte("shim1"),
 			[]byte("shim1"),
 		},
 		kernels: [][]byte{
 			[]byte("kernel1"),
 			[]byte("kernel1"),
 		},
+		keyringPrefix: "my-fde",
+		rootfsLabel:   "my-rootfs",
 	})
 }
 
-func (s *resealSuite) TestResealKeyDifferentArch(c *check.C) {
+func (s *resealSuite) TestResealKeyPolicyAuthKeyDir(c *check.C) {
+	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/var/lib/nullboot/keys/cloudimg-rootfs.auth-key", []byte{1, 2, 3, 4, 5, 6}, 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+
+	// The volume is not unlocked, so there is no by-label symlink and no key in
+	// the kernel keyring.
+	s.testResealKey(c, &testResealKeyData{
+		arch:         "x64",
+		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
+		shims: [][]byte{
+			[]byte("shim1"),
+			[]byte("shim1"),
+		},
+		kernels: [][]byte{
+			[]byte("kernel1"),
+			[]byte("kernel1"),
+		},
+		policyAuthKeyDir: "/var/lib/nullboot/keys",
+	})
+}
+
+func (s *resealSuite) TestResealKeyBackupESP(c *check.C) {
 	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
 	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
 
 	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
-	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimaa64.efi", []byte("shim1"), 0600), check.IsNil)
-	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimaa64.efi.signed", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi2/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim2"), 0600), check.IsNil)
 	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
-	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi2/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
 	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-2-generic", []byte("kernel2"), 0600), check.IsNil)
 
+	// The assets on the backup ESP are roots and kernels of the boot chains
+	// as well as those on the primary ESP.
 	s.testResealKey(c, &testResealKeyData{
-		arch:         "aa64",
+		arch:         "x64",
 		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
 		devicePaths:  []string{"/dev/sda1"},
 		shims: [][]byte{
+			[]byte("shim2"),
 			[]byte("shim1"),
 			[]byte("shim1"),
 		},
@@ -557,15 +839,13 @@ func (s *resealSuite) TestResealKeyDifferentArch(c *check.C) {
 			[]byte("kernel1"),
 			[]byte("kernel1"),
 		},
+		backupESPs: []string{"/boot/efi2"},
 	})
 }
 
-func (s *resealSuite) TestResealKeyGetAuxiliaryKeyFromKernelBug(c *check.C) {
+func (s *resealSuite) TestResealKeyTargetShimRootOnly(c *check.C) {
 	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
-	c.Check(s.fs.WriteFile("/dev/sda15", nil, os.ModeDevice|0660), check.IsNil)
 	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
-	s.symlink(c, "/dev/sda1", "/dev/disk/by-partuuid/94725587-885d-4bde-bc61-078e0010057d")
-	s.symlink(c, "/dev/sda15", "/dev/disk/by-partuuid/848b8304-0f20-42e9-9806-b447ce344d85")
 
 	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
 	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
@@ -576,26 +856,19 @@ func (s *resealSuite) TestResealKeyGetAuxiliaryKeyFromKernelBug(c *check.C) {
 	s.testResealKey(c, &testResealKeyData{
 		arch:         "x64",
 		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
-		devicePaths:  []string{"/dev/sda1", "/dev/disk/by-partuuid/94725587-885d-4bde-bc61-078e0010057d"},
+		devicePaths:  []string{"/dev/sda1"},
 		shims: [][]byte{
-			[]byte("shim2"),
 			[]byte("shim1"),
 		},
 		kernels: [][]byte{
 			[]byte("kernel1"),
 			[]byte("kernel1"),
 		},
+		shimRoots: ShimRootsTarget,
 	})
 }
 
-type testResealKeyUnhappyData struct {
-	noAuxKey        bool
-	fileLeak        bool
-	untrustedAssets bool
-	noTpm           bool
-}
-
-func (s *resealSuite) testResealKeyUnhappy(c *check.C, data *testResealKeyUnhappyData) error {
+func (s *resealSuite) TestResealKeyCommittedOnly(c *check.C) {
 	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
 	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
 
@@ -603,71 +876,614 @@ func (s *resealSuite) testResealKeyUnhappy(c *check.C, data *testResealKeyUnhapp
 	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
 	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim2"), 0600), check.IsNil)
 	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
-	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
-
-	restore := s.mockEfiArch("x64")
-	defer restore()
-
-	restore = s.mockSbefiAddBootManagerProfile(func(profile *secboot_tpm2.PCRProtectionProfile, params *secboot_efi.BootManagerProfileParams) error {
-		if data.fileLeak {
-			params.LoadSequences[0].Image.Open()
-		}
-		for _, e := range params.LoadSequences {
-			f, err := e.Image.Open()
-			c.Assert(err, check.IsNil)
-			f.Close()
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-2-generic", []byte("kernel2"), 0600), check.IsNil)
 
-			for _, e := range e.Next {
-				f, err := e.Image.Open()
-				c.Assert(err, check.IsNil)
-				f.Close()
-			}
-		}
-		return nil
+	// The full transition profile includes the old and new assets.
+	s.testResealKey(c, &testResealKeyData{
+		arch:         "x64",
+		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
+		devicePaths:  []string{"/dev/sda1"},
+		shims: [][]byte{
+			[]byte("shim2"),
+			[]byte("shim1"),
+		},
+		kernels: [][]byte{
+			[]byte("kernel2"),
+			[]byte("kernel1"),
+		},
 	})
-	defer restore()
-
-	restore = s.mockSbefiAddSecureBootPolicyProfile(func(profile *secboot_tpm2.PCRProtectionProfile, params *secboot_efi.SecureBootPolicyProfileParams) error {
-		for _, e := range params.LoadSequences {
-			f, err := e.Image.Open()
-			c.Assert(err, check.IsNil)
-			f.Close()
 
-			for _, e := range e.Next {
-				f, err := e.Image.Open()
-				c.Assert(err, check.IsNil)
-				f.Close()
-			}
-		}
-		return nil
+	// The committed-only profile includes only the new assets.
+	s.testResealKey(c, &testResealKeyData{
+		arch:         "x64",
+		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
+		devicePaths:  []string{"/dev/sda1"},
+		shims: [][]byte{
+			[]byte("shim2"),
+		},
+		kernels: [][]byte{
+			[]byte("kernel2"),
+		},
+		committedOnly: true,
 	})
-	defer restore()
+}
 
-	restore = s.mockSbGetAuxiliaryKeyFromKernel(func(prefix, devicePath string, remove bool) (secboot.AuxiliaryKey, error) {
-		if data.noAuxKey {
-			return nil, secboot.ErrKernelKeyNotFound
-		}
-		return nil, nil
+func (s *resealSuite) TestResealKeyUnhappyCommittedOnlyTargetShimRoot(c *check.C) {
+	err := s.testResealKeyUnhappy(c, &testResealKeyUnhappyData{
+		shimRoots:     ShimRootsTarget,
+		committedOnly: true,
 	})
-	defer restore()
+	c.Check(err, check.ErrorMatches, "cannot include only committed assets with only the target shim as a root")
+	checkResealStage(c, err, StageConfig)
+}
 
-	restore = s.mockSbtpmConnectToDefaultTPM(func() (*secboot_tpm2.Connection, error) {
-		if data.noTpm {
-			return nil, secboot_tpm2.ErrNoTPM2Device
-		}
-		tcti, err := linux.OpenDevice("/dev/null")
-		c.Assert(err, check.IsNil)
+func (s *resealSuite) TestResealKeyOncePerBoot(c *check.C) {
+	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
 
-		return &secboot_tpm2.Connection{TPMContext: tpm2.NewTPMContext(tcti)}, nil
-	})
-	defer restore()
+	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/proc/sys/kernel/random/boot_id", []byte("9f6e1d3b-3d0c-4b8e-a8b4-4a5c2f9d2a11\n"), 0444), check.IsNil)
 
-	restore = s.mockSbtpmReadSealedKeyObjectFromFile(func(path string) (*secboot_tpm2.SealedKeyObject, error) {
-		return &secboot_tpm2.SealedKeyObject{}, nil
+	data := &testResealKeyData{
+		arch:         "x64",
+		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
+		devicePaths:  []string{"/dev/sda1"},
+		shims: [][]byte{
+			[]byte("shim1"),
+			[]byte("shim1"),
+		},
+		kernels: [][]byte{
+			[]byte("kernel1"),
+			[]byte("kernel1"),
+		},
+		oncePerBoot: true,
+	}
+
+	// The first reseal during this boot happens.
+	s.testResealKey(c, data)
+
+	// A second reseal with the same boot ID and inputs is skipped.
+	data.skipped = true
+	s.testResealKey(c, data)
+
+	// A reseal with different inputs happens.
+	data.skipped = false
+	data.kernelCmdlines = []string{"root=magic"}
+	s.testResealKey(c, data)
+
+	// A reseal during another boot happens.
+	c.Check(s.fs.WriteFile("/proc/sys/kernel/random/boot_id", []byte("0c4d8b1e-52a7-4f0e-9b3c-7e1d2f6a8c55\n"), 0444), check.IsNil)
+	s.testResealKey(c, data)
+
+	data.skipped = true
+	s.testResealKey(c, data)
+
+	// A key file that was re-provisioned with the same name is resealed.
+	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("other key data"), 0600), check.IsNil)
+	data.skipped = false
+	s.testResealKey(c, data)
+
+	data.skipped = true
+	s.testResealKey(c, data)
+}
+
+func (s *resealSuite) TestResealKeySkipUnchanged(c *check.C) {
+	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
+
+	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+
+	data := &testResealKeyData{
+		arch:         "x64",
+		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
+		devicePaths:  []string{"/dev/sda1"},
+		shims: [][]byte{
+			[]byte("shim1"),
+			[]byte("shim1"),
+		},
+		kernels: [][]byte{
+			[]byte("kernel1"),
+			[]byte("kernel1"),
+		},
+		skipUnchanged: true,
+	}
+
+	// The first reseal happens and records the profile.
+	s.testResealKey(c, data)
+	_, err := s.fs.Stat("/var/lib/nullboot/sealed-profiles/cloudimg-rootfs.sealed-key")
+	c.Check(err, check.IsNil)
+
+	// A second reseal with the same profile doesn't update the key.
+	data.skipped = true
+	data.expectedErr = ErrResealNotNeeded
+	s.testResealKey(c, data)
+
+	// A reseal with a different profile happens.
+	data.skipped = false
+	data.expectedErr = nil
+	data.kernelCmdlines = []string{"root=magic"}
+	s.testResealKey(c, data)
+
+	// A key file that was updated by something else is resealed.
+	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("other key data"), 0600), check.IsNil)
+	s.testResealKey(c, data)
+
+	data.skipped = true
+	data.expectedErr = ErrResealNotNeeded
+	s.testResealKey(c, data)
+}
+
+func (s *resealSuite) TestResealKeyContextCancel(c *check.C) {
+	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
+
+	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+
+	// Cancelling while the PCR profile is computed prevents any key from
+	// being resealed.
+	s.testResealKey(c, &testResealKeyData{
+		arch:         "x64",
+		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
+		devicePaths:  []string{"/dev/sda1"},
+		shims: [][]byte{
+			[]byte("shim1"),
+			[]byte("shim1"),
+		},
+		kernels: [][]byte{
+			[]byte("kernel1"),
+			[]byte("kernel1"),
+		},
+		cancel:      true,
+		skipped:     true,
+		expectedErr: context.Canceled,
+	})
+}
+
+func (s *resealSuite) TestResealKeyUnhappyInvalidShimRoots(c *check.C) {
+	err := s.testResealKeyUnhappy(c, &testResealKeyUnhappyData{
+		shimRoots: 3,
+	})
+	c.Check(err, check.ErrorMatches, "invalid shim roots selection 3")
+	checkResealStage(c, err, StageConfig)
+}
+
+func (s *resealSuite) testResealKeyEpoch(c *check.C, epoch uint32, pcr12 tpm2.Digest) {
+	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
+
+	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+
+	s.testResealKey(c, &testResealKeyData{
+		arch:         "x64",
+		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
+		devicePaths:  []string{"/dev/sda1"},
+		shims: [][]byte{
+			[]byte("shim1"),
+			[]byte("shim1"),
+		},
+		kernels: [][]byte{
+			[]byte("kernel1"),
+			[]byte("kernel1"),
+		},
+		epoch: epoch,
+		pcr12: []tpm2.Digest{pcr12},
+	})
+}
+
+func (s *resealSuite) TestResealKeyEpoch0(c *check.C) {
+	s.testResealKeyEpoch(c, 0, decodeHexString(c, "3d458cfe55cc03ea1f443f1562beec8df51c75e14a9fcf9a7234a13f198e7969"))
+}
+
+func (s *resealSuite) TestResealKeyEpoch1(c *check.C) {
+	s.testResealKeyEpoch(c, 1, decodeHexString(c, "486b106959e77e23f464fb8f443b36d47c32d396c08591c634fe92847c5b65c9"))
+}
+
+func (s *resealSuite) TestResealKeyCustomPCRs(c *check.C) {
+	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
+
+	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+
+	s.testResealKey(c, &testResealKeyData{
+		arch:         "x64",
+		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
+		devicePaths:  []string{"/dev/sda1"},
+		shims: [][]byte{
+			[]byte("shim1"),
+			[]byte("shim1"),
+		},
+		kernels: [][]byte{
+			[]byte("kernel1"),
+			[]byte("kernel1"),
+		},
+		pcrs: []int{4, 12},
+	})
+}
+
+func (s *resealSuite) TestResealKeyBeforeNewShim(c *check.C) {
+	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
+
+	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim2"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+
+	s.testResealKey(c, &testResealKeyData{
+		arch:         "x64",
+		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
+		devicePaths:  []string{"/dev/sda1"},
+		shims: [][]byte{
+			[]byte("shim2"),
+			[]byte("shim1"),
+		},
+		kernels: [][]byte{
+			[]byte("kernel1"),
+			[]byte("kernel1"),
+		},
+	})
+}
+
+func (s *resealSuite) TestResealKeyAfterNewShim(c *check.C) {
+	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
+
+	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim2"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim2"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+
+	s.testResealKey(c, &testResealKeyData{
+		arch:         "x64",
+		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
+		devicePaths:  []string{"/dev/sda1"},
+		shims: [][]byte{
+			[]byte("shim2"),
+			[]byte("shim2"),
+		},
+		kernels: [][]byte{
+			[]byte("kernel1"),
+			[]byte("kernel1"),
+		},
+	})
+}
+
+func (s *resealSuite) TestResealKeyBeforeRemoveKernel(c *check.C) {
+	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
+
+	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic", []byte("kernel2"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-2-generic", []byte("kernel2"), 0600), check.IsNil)
+
+	s.testResealKey(c, &testResealKeyData{
+		arch:         "x64",
+		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
+		devicePaths:  []string{"/dev/sda1"},
+		shims: [][]byte{
+			[]byte("shim1"),
+			[]byte("shim1"),
+		},
+		kernels: [][]byte{
+			[]byte("kernel2"),
+			[]byte("kernel2"),
+			[]byte("kernel1"),
+		},
+	})
+}
+
+func (s *resealSuite) TestResealKeyAfterRemoveKernel(c *check.C) {
+	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
+
+	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-2-generic", []byte("kernel2"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-2-generic", []byte("kernel2"), 0600), check.IsNil)
+
+	s.testResealKey(c, &testResealKeyData{
+		arch:         "x64",
+		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
+		devicePaths:  []string{"/dev/sda1"},
+		shims: [][]byte{
+			[]byte("shim1"),
+			[]byte("shim1"),
+		},
+		kernels: [][]byte{
+			[]byte("kernel2"),
+			[]byte("kernel2"),
+		},
+	})
+}
+
+func (s *resealSuite) TestResealKeyDifferentAuxiliaryKey(c *check.C) {
+	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
+
+	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim2"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+
+	s.testResealKey(c, &testResealKeyData{
+		arch:         "x64",
+		auxiliaryKey: []byte{5, 6, 7, 8, 9},
+		devicePaths:  []string{"/dev/sda1"},
+		shims: [][]byte{
+			[]byte("shim2"),
+			[]byte("shim1"),
+		},
+		kernels: [][]byte{
+			[]byte("kernel1"),
+			[]byte("kernel1"),
+		},
+	})
+}
+
+func (s *resealSuite) TestResealKeyDifferentBlockDevice(c *check.C) {
+	c.Check(s.fs.WriteFile("/dev/vda14", nil, os.ModeDevice|0660), check.IsNil)
+	s.symlink(c, "/dev/vda14", "/dev/disk/by-label/cloudimg-rootfs-enc")
+
+	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim2"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+
+	s.testResealKey(c, &testResealKeyData{
+		arch:         "x64",
+		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
+		devicePaths:  []string{"/dev/vda14"},
+		shims: [][]byte{
+			[]byte("shim2"),
+			[]byte("shim1"),
+		},
+		kernels: [][]byte{
+			[]byte("kernel1"),
+			[]byte("kernel1"),
+		},
+	})
+}
+
+func (s *resealSuite) TestResealKeyDifferentArch(c *check.C) {
+	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
+
+	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimaa64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimaa64.efi.signed", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-2-generic", []byte("kernel2"), 0600), check.IsNil)
+
+	s.testResealKey(c, &testResealKeyData{
+		arch:         "aa64",
+		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
+		devicePaths:  []string{"/dev/sda1"},
+		shims: [][]byte{
+			[]byte("shim1"),
+			[]byte("shim1"),
+		},
+		kernels: [][]byte{
+			[]byte("kernel2"),
+			[]byte("kernel1"),
+			[]byte("kernel1"),
+		},
+	})
+}
+
+func (s *resealSuite) TestResealKeyGetAuxiliaryKeyFromKernelBug(c *check.C) {
+	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
+	c.Check(s.fs.WriteFile("/dev/sda15", nil, os.ModeDevice|0660), check.IsNil)
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-partuuid/94725587-885d-4bde-bc61-078e0010057d")
+	s.symlink(c, "/dev/sda15", "/dev/disk/by-partuuid/848b8304-0f20-42e9-9806-b447ce344d85")
+
+	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim2"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+
+	s.testResealKey(c, &testResealKeyData{
+		arch:         "x64",
+		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
+		devicePaths:  []string{"/dev/sda1", "/dev/disk/by-partuuid/94725587-885d-4bde-bc61-078e0010057d"},
+		shims: [][]byte{
+			[]byte("shim2"),
+			[]byte("shim1"),
+		},
+		kernels: [][]byte{
+			[]byte("kernel1"),
+			[]byte("kernel1"),
+		},
+	})
+}
+
+func (s *resealSuite) TestResealKeyGetAuxiliaryKeyFromKernelBugByUUID(c *check.C) {
+	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
+	c.Check(s.fs.WriteFile("/dev/sda15", nil, os.ModeDevice|0660), check.IsNil)
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
+	s.symlink(c, "/dev/sda15", "/dev/disk/by-uuid/1d7b-4a2c")
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-uuid/94ad43d4-1e2c-4c7b-a81a-3a2d0ff8e0e4")
+
+	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim2"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+
+	s.testResealKey(c, &testResealKeyData{
+		arch:         "x64",
+		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
+		devicePaths:  []string{"/dev/sda1", "/dev/disk/by-uuid/94ad43d4-1e2c-4c7b-a81a-3a2d0ff8e0e4"},
+		shims: [][]byte{
+			[]byte("shim2"),
+			[]byte("shim1"),
+		},
+		kernels: [][]byte{
+			[]byte("kernel1"),
+			[]byte("kernel1"),
+		},
+	})
+}
+
+func (s *resealSuite) TestResealKeyGetAuxiliaryKeyFromKernelBugAllAliases(c *check.C) {
+	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-partuuid/94725587-885d-4bde-bc61-078e0010057d")
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-uuid/94ad43d4-1e2c-4c7b-a81a-3a2d0ff8e0e4")
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_drive-scsi0-part1")
+
+	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim2"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+
+	s.testResealKey(c, &testResealKeyData{
+		arch:         "x64",
+		auxiliaryKey: []byte{1, 2, 3, 4, 5, 6},
+		devicePaths: []string{
+			"/dev/sda1",
+			"/dev/disk/by-partuuid/94725587-885d-4bde-bc61-078e0010057d",
+			"/dev/disk/by-uuid/94ad43d4-1e2c-4c7b-a81a-3a2d0ff8e0e4",
+			"/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_drive-scsi0-part1",
+		},
+		shims: [][]byte{
+			[]byte("shim2"),
+			[]byte("shim1"),
+		},
+		kernels: [][]byte{
+			[]byte("kernel1"),
+			[]byte("kernel1"),
+		},
+	})
+}
+
+type testResealKeyUnhappyData struct {
+	noAuxKey        bool
+	fileLeak        bool
+	untrustedAssets bool
+	noTpm           bool
+	authKeyMismatch bool
+	pcrs            []int
+	shimRoots       ShimRoots
+	committedOnly   bool
+	statErrs        map[string]error
+
+	policyAuthKeyDir string
+}
+
+func checkResealStage(c *check.C, err error, stage ResealStage) {
+	var rerr *ResealError
+	c.Assert(errors.As(err, &rerr), check.Equals, true, check.Commentf("%v is not a ResealError", err))
+	c.Check(rerr.Stage, check.Equals, stage)
+}
+
+func (s *resealSuite) testResealKeyUnhappy(c *check.C, data *testResealKeyUnhappyData) error {
+	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
+
+	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim2"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+
+	restore := s.mockEfiArch("x64")
+	defer restore()
+
+	restore = s.mockSbefiAddBootManagerProfile(func(profile *secboot_tpm2.PCRProtectionProfile, params *secboot_efi.BootManagerProfileParams) error {
+		if data.fileLeak {
+			params.LoadSequences[0].Image.Open()
+		}
+		for _, e := range params.LoadSequences {
+			f, err := e.Image.Open()
+			c.Assert(err, check.IsNil)
+			f.Close()
+
+			for _, e := range e.Next {
+				f, err := e.Image.Open()
+				c.Assert(err, check.IsNil)
+				f.Close()
+			}
+		}
+		return nil
+	})
+	defer restore()
+
+	restore = s.mockSbefiAddSecureBootPolicyProfile(func(profile *secboot_tpm2.PCRProtectionProfile, params *secboot_efi.SecureBootPolicyProfileParams) error {
+		for _, e := range params.LoadSequences {
+			f, err := e.Image.Open()
+			c.Assert(err, check.IsNil)
+			f.Close()
+
+			for _, e := range e.Next {
+				f, err := e.Image.Open()
+				c.Assert(err, check.IsNil)
+				f.Close()
+			}
+		}
+		return nil
+	})
+	defer restore()
+
+	restore = s.mockSbGetAuxiliaryKeyFromKernel(func(prefix, devicePath string, remove bool) (secboot.AuxiliaryKey, error) {
+		if data.noAuxKey {
+			return nil, secboot.ErrKernelKeyNotFound
+		}
+		return nil, nil
+	})
+	defer restore()
+
+	restore = s.mockSbtpmConnectToDefaultTPM(func() (*secboot_tpm2.Connection, error) {
+		if data.noTpm {
+			return nil, secboot_tpm2.ErrNoTPM2Device
+		}
+		tcti, err := linux.OpenDevice("/dev/null")
+		c.Assert(err, check.IsNil)
+
+		return &secboot_tpm2.Connection{TPMContext: tpm2.NewTPMContext(tcti)}, nil
+	})
+	defer restore()
+
+	restore = s.mockSbtpmReadSealedKeyObjectFromFile(func(path string) (*secboot_tpm2.SealedKeyObject, error) {
+		return &secboot_tpm2.SealedKeyObject{}, nil
 	})
 	defer restore()
 
 	restore = s.mockSbtpmSealedKeyObjectUpdatePCRProtectionPolicy(func(k *secboot_tpm2.SealedKeyObject, tpm *secboot_tpm2.Connection, authKey secboot_tpm2.PolicyAuthKey, profile *secboot_tpm2.PCRProtectionProfile) error {
+		if data.authKeyMismatch {
+			return authKeyMismatchError()
+		}
 		return nil
 	})
 	defer restore()
@@ -695,24 +1511,38 @@ func (s *resealSuite) testResealKeyUnhappy(c *check.C, data *testResealKeyUnhapp
 
 	bm, err := NewBootManagerForVariables(&mockvars)
 	c.Assert(err, check.IsNil)
-	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", "ubuntu", &bm)
+	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", ShimConfig{Vendor: "ubuntu"}, &bm)
 	c.Assert(err, check.IsNil)
 
-	return ResealKey(assets, km, "/boot/efi", "/usr/lib/nullboot/shim", "ubuntu")
+	if data.statErrs != nil {
+		appFs = statErrorFS{appFs.(MapFS), data.statErrs}
+	}
+
+	return ResealKey(assets, km, "/boot/efi", "/usr/lib/nullboot/shim", ShimConfig{Vendor: "ubuntu"}, ResealConfig{PCRs: data.pcrs, ShimRoots: data.shimRoots, CommittedOnly: data.committedOnly, PolicyAuthKeyDir: data.policyAuthKeyDir})
 }
 
 func (s *resealSuite) TestResealKeyUnhappyNoAuxiliaryKey(c *check.C) {
 	err := s.testResealKeyUnhappy(c, &testResealKeyUnhappyData{
 		noAuxKey: true,
 	})
-	c.Check(err, check.ErrorMatches, "cannot obtain auth key from kernel: cannot read key from kernel: cannot find key in kernel keyring")
+	c.Check(err, check.ErrorMatches, "cannot reseal cloudimg-rootfs.sealed-key: cannot obtain auth key from kernel: cannot read key from kernel: cannot find key in kernel keyring")
+	checkResealStage(c, err, StageAuthKey)
+}
+
+func (s *resealSuite) TestResealKeyUnhappyNoAuthKeyFile(c *check.C) {
+	err := s.testResealKeyUnhappy(c, &testResealKeyUnhappyData{
+		policyAuthKeyDir: "/var/lib/nullboot/keys",
+	})
+	c.Check(err, check.ErrorMatches, "cannot reseal cloudimg-rootfs.sealed-key: cannot read auth key file: open /var/lib/nullboot/keys/cloudimg-rootfs.auth-key: file does not exist")
+	checkResealStage(c, err, StageAuthKey)
 }
 
 func (s *resealSuite) TestResealKeyUnhappyFileLeak(c *check.C) {
 	err := s.testResealKeyUnhappy(c, &testResealKeyUnhappyData{
 		fileLeak: true,
 	})
-	c.Check(err, check.ErrorMatches, "leaked open files from computing PCR profile")
+	c.Check(err, check.ErrorMatches, "leaked open files from computing PCR profile: \\[/usr/lib/nullboot/shim/shimx64.efi.signed\\]")
+	checkResealStage(c, err, StagePCRProfile)
 }
 
 func (s *resealSuite) TestResealKeyUnhappyUntrustedAssets(c *check.C) {
@@ -720,6 +1550,7 @@ func (s *resealSuite) TestResealKeyUnhappyUntrustedAssets(c *check.C) {
 		untrustedAssets: true,
 	})
 	c.Check(err, check.ErrorMatches, "some assets failed an integrity check: \\[/boot/efi/EFI/ubuntu/shimx64.efi /boot/efi/EFI/ubuntu/shimx64.efi\\]")
+	checkResealStage(c, err, StageIntegrity)
 }
 
 func (s *resealSuite) TestResealKeyUnhappyNoTPM(c *check.C) {
@@ -727,6 +1558,210 @@ func (s *resealSuite) TestResealKeyUnhappyNoTPM(c *check.C) {
 		noTpm: true,
 	})
 	c.Check(err, check.ErrorMatches, "no TPM2 device is available")
+	checkResealStage(c, err, StageTPM)
+}
+
+func (s *resealSuite) TestResealKeyUnhappyAuthKeyMismatch(c *check.C) {
+	err := s.testResealKeyUnhappy(c, &testResealKeyUnhappyData{
+		authKeyMismatch: true,
+	})
+	c.Check(err, check.ErrorMatches, "cannot reseal cloudimg-rootfs.sealed-key: auth key mismatch: the sealed key object expects a different auth key")
+	checkResealStage(c, err, StageAuthKey)
+}
+
+func (s *resealSuite) TestResealKeyUnhappyUnsupportedPCR(c *check.C) {
+	err := s.testResealKeyUnhappy(c, &testResealKeyUnhappyData{
+		pcrs: []int{4, 8},
+	})
+	c.Check(err, check.ErrorMatches, "cannot seal against PCR 8: only PCRs \\[4 7 12\\] are supported")
+	checkResealStage(c, err, StageConfig)
+}
+
+func (s *resealSuite) TestResealKeyUnhappyKeyDirPermissionDenied(c *check.C) {
+	err := s.testResealKeyUnhappy(c, &testResealKeyUnhappyData{
+		statErrs: map[string]error{"/boot/efi/device/fde": unix.EACCES},
+	})
+	c.Check(err, check.ErrorMatches, "cannot determine sealed key files: readdir /boot/efi/device/fde: permission denied")
+	checkResealStage(c, err, StageKeyFiles)
+	c.Check(err, check.Not(check.Equals), ErrNoSealedKey)
+}
+
+func (s *resealSuite) TestResealKeyUnhappyShimPermissionDenied(c *check.C) {
+	err := s.testResealKeyUnhappy(c, &testResealKeyUnhappyData{
+		statErrs: map[string]error{"/usr/lib/nullboot/shim/shimx64.efi.signed": unix.EACCES},
+	})
+	c.Check(err, check.ErrorMatches, "cannot stat shim /usr/lib/nullboot/shim/shimx64.efi.signed: stat /usr/lib/nullboot/shim/shimx64.efi.signed: permission denied")
+	checkResealStage(c, err, StagePCRProfile)
+}
+
+type testResealKeyMultipleVolumesData struct {
+	auxiliaryKeys map[string][]byte
+	updated       []string
+}
+
+func (s *resealSuite) testResealKeyMultipleVolumes(c *check.C, data *testResealKeyMultipleVolumesData) error {
+	c.Check(s.fs.WriteFile("/dev/sda1", nil, os.ModeDevice|0660), check.IsNil)
+	c.Check(s.fs.WriteFile("/dev/sda2", nil, os.ModeDevice|0660), check.IsNil)
+	s.symlink(c, "/dev/sda1", "/dev/disk/by-label/cloudimg-rootfs-enc")
+	s.symlink(c, "/dev/sda2", "/dev/disk/by-label/var-enc")
+
+	c.Check(s.fs.WriteFile("/boot/efi/device/fde/cloudimg-rootfs.sealed-key", []byte("key data"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/device/fde/var.sealed-key", []byte("key data"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/device/fde/README", []byte("not a key"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/usr/lib/linux/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+
+	restore := s.mockEfiArch("x64")
+	defer restore()
+
+	restore = s.mockSbefiAddBootManagerProfile(func(profile *secboot_tpm2.PCRProtectionProfile, params *secboot_efi.BootManagerProfileParams) error {
+		profile.AddPCRValue(tpm2.HashAlgorithmSHA256, 4, make([]byte, 32))
+		return nil
+	})
+	defer restore()
+
+	restore = s.mockSbefiAddSecureBootPolicyProfile(func(profile *secboot_tpm2.PCRProtectionProfile, params *secboot_efi.SecureBootPolicyProfileParams) error {
+		profile.AddPCRValue(tpm2.HashAlgorithmSHA256, 7, make([]byte, 32))
+		return nil
+	})
+	defer restore()
+
+	restore = s.mockSbGetAuxiliaryKeyFromKernel(func(prefix, devicePath string, remove bool) (secboot.AuxiliaryKey, error) {
+		key, ok := data.auxiliaryKeys[devicePath]
+		if !ok {
+			return nil, secboot.ErrKernelKeyNotFound
+		}
+		return key, nil
+	})
+	defer restore()
+
+	connections := 0
+	restore = s.mockSbtpmConnectToDefaultTPM(func() (*secboot_tpm2.Connection, error) {
+		connections++
+		tcti, err := linux.OpenDevice("/dev/null")
+		c.Assert(err, check.IsNil)
+		return &secboot_tpm2.Connection{TPMContext: tpm2.NewTPMContext(tcti)}, nil
+	})
+	defer restore()
+
+	keyPaths := make(map[*secboot_tpm2.SealedKeyObject]string)
+	restore = s.mockSbtpmReadSealedKeyObjectFromFile(func(path string) (*secboot_tpm2.SealedKeyObject, error) {
+		k := new(secboot_tpm2.SealedKeyObject)
+		keyPaths[k] = path
+		return k, nil
+	})
+	defer restore()
+
+	var pcrProfile *secboot_tpm2.PCRProtectionProfile
+	restore = s.mockSbtpmSealedKeyObjectUpdatePCRProtectionPolicy(func(k *secboot_tpm2.SealedKeyObject, tpm *secboot_tpm2.Connection, authKey secboot_tpm2.PolicyAuthKey, profile *secboot_tpm2.PCRProtectionProfile) error {
+		if pcrProfile == nil {
+			pcrProfile = profile
+		}
+		c.Check(profile, check.Equals, pcrProfile)
+		return nil
+	})
+	defer restore()
+
+	restore = s.mockSbtpmSealedKeyObjectWriteAtomic(func(k *secboot_tpm2.SealedKeyObject, w secboot.KeyDataWriter) error {
+		data.updated = append(data.updated, keyPaths[k])
+		return nil
+	})
+	defer restore()
+
+	restore = s.mockUnixKeyctlInt(func(cmd, arg2, arg3, arg4, arg5 int) (int, error) {
+		return 0, nil
+	})
+	defer restore()
+
+	assets, err := ReadTrustedAssets()
+	c.Assert(err, check.IsNil)
+	c.Check(assets.TrustNewFromDir("/boot/efi/EFI/ubuntu"), check.IsNil)
+	c.Check(assets.TrustNewFromDir("/usr/lib/nullboot/shim"), check.IsNil)
+	c.Check(assets.TrustNewFromDir("/usr/lib/linux"), check.IsNil)
+
+	km, err := NewKernelManager("/boot/efi", "/usr/lib/linux", ShimConfig{Vendor: "ubuntu"}, nil)
+	c.Assert(err, check.IsNil)
+
+	err = ResealKey(assets, km, "/boot/efi", "/usr/lib/nullboot/shim", ShimConfig{Vendor: "ubuntu"}, ResealConfig{})
+	c.Check(connections, check.Equals, 1)
+	return err
+}
+
+func (s *resealSuite) TestResealKeyMultipleVolumes(c *check.C) {
+	data := &testResealKeyMultipleVolumesData{
+		auxiliaryKeys: map[string][]byte{
+			"/dev/sda1": {1, 2, 3, 4},
+			"/dev/sda2": {5, 6, 7, 8},
+		},
+	}
+	c.Check(s.testResealKeyMultipleVolumes(c, data), check.IsNil)
+	c.Check(data.updated, check.DeepEquals, []string{
+		"/boot/efi/device/fde/cloudimg-rootfs.sealed-key",
+		"/boot/efi/device/fde/var.sealed-key",
+	})
+}
+
+func (s *resealSuite) TestResealKeyMultipleVolumesOneFails(c *check.C) {
+	data := &testResealKeyMultipleVolumesData{
+		auxiliaryKeys: map[string][]byte{
+			"/dev/sda2": {5, 6, 7, 8},
+		},
+	}
+	err := s.testResealKeyMultipleVolumes(c, data)
+	c.Check(err, check.ErrorMatches,
+		"cannot reseal cloudimg-rootfs.sealed-key: cannot obtain auth key from kernel: cannot read key from kernel: cannot find key in kernel keyring")
+	checkResealStage(c, err, StageAuthKey)
+	c.Check(data.updated, check.DeepEquals, []string{"/boot/efi/device/fde/var.sealed-key"})
+}
+
+func (s *resealSuite) TestResealKeyMultipleVolumesAllFail(c *check.C) {
+	data := &testResealKeyMultipleVolumesData{}
+	err := s.testResealKeyMultipleVolumes(c, data)
+	c.Check(err, check.ErrorMatches,
+		"cannot reseal cloudimg-rootfs.sealed-key: .*; cannot reseal var.sealed-key: .*")
+	checkResealStage(c, err, StageAuthKey)
+	c.Check(data.updated, check.IsNil)
+}
+
+// authKeyMismatchError returns an error like the one secboot returns from a
+// PCR policy update with the wrong auth key. The message of InvalidKeyDataError
+// is unexported, so it is added by wrapping.
+func authKeyMismatchError() error {
+	return fmt.Errorf("%w: dynamic authorization policy signing %s", secboot_tpm2.InvalidKeyDataError{}, authKeyMismatchMessage)
+}
+
+// TestAuthKeyMismatchMessage checks authKeyMismatchMessage against the source
+// of the secboot version in go.mod, as a mismatch can't be produced without a
+// TPM.
+func (s *resealSuite) TestAuthKeyMismatchMessage(c *check.C) {
+	out, err := exec.Command("go", "list", "-m", "-f", "{{.Dir}}", "github.com/snapcore/secboot").Output()
+	if err != nil {
+		c.Skip(fmt.Sprintf("cannot locate secboot source: %v", err))
+	}
+	dir := strings.TrimSpace(string(out))
+
+	paths, err := filepath.Glob(filepath.Join(dir, "tpm2", "keydata_v*.go"))
+	c.Assert(err, check.IsNil)
+	c.Assert(paths, check.Not(check.HasLen), 0)
+
+	for _, path := range paths {
+		src, err := ioutil.ReadFile(path)
+		c.Assert(err, check.IsNil)
+		if !bytes.Contains(src, []byte("ValidateAuthKey(")) {
+			continue
+		}
+		c.Check(bytes.Contains(src, []byte(`keyDataError{errors.New("dynamic authorization policy signing `+authKeyMismatchMessage+`")}`)), check.Equals, true,
+			check.Commentf("%s no longer reports an auth key mismatch with %q", path, authKeyMismatchMessage))
+	}
+}
+
+func (s *resealSuite) TestIsAuthKeyMismatch(c *check.C) {
+	c.Check(isAuthKeyMismatch(authKeyMismatchError()), check.Equals, true)
+	c.Check(isAuthKeyMismatch(secboot_tpm2.InvalidKeyDataError{}), check.Equals, false)
+	c.Check(isAuthKeyMismatch(errors.New("private key doesn't match public key")), check.Equals, false)
+	c.Check(isAuthKeyMismatch(nil), check.Equals, false)
 }
 
 // The TCG log writing code is borrowed from github.com:snapcore/secboot tools/make-efi-testdata/logs.go
@@ -754,7 +1789,16 @@ type logWriter struct {
 	events []*tcglog.Event
 }
 
-func newCryptoAgileLogWriter() *logWriter {
+func newCryptoAgileLogWriter(algs ...tpm2.HashAlgorithmId) *logWriter {
+	if len(algs) == 0 {
+		algs = []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1, tpm2.HashAlgorithmSHA256}
+	}
+
+	var digestSizes []tcglog.EFISpecIdEventAlgorithmSize
+	for _, alg := range algs {
+		digestSizes = append(digestSizes, tcglog.EFISpecIdEventAlgorithmSize{AlgorithmId: alg, DigestSize: uint16(alg.Size())})
+	}
+
 	event := &tcglog.Event{
 		PCRIndex:  0,
 		EventType: tcglog.EventTypeNoAction,
@@ -762,12 +1806,10 @@ func newCryptoAgileLogWriter() *logWriter {
 		Data: &tcglog.SpecIdEvent03{
 			SpecVersionMajor: 2,
 			UintnSize:        2,
-			DigestSizes: []tcglog.EFISpecIdEventAlgorithmSize{
-				{AlgorithmId: tpm2.HashAlgorithmSHA1, DigestSize: uint16(tpm2.HashAlgorithmSHA1.Size())},
-				{AlgorithmId: tpm2.HashAlgorithmSHA256, DigestSize: uint16(tpm2.HashAlgorithmSHA256.Size())}}}}
+			DigestSizes:      digestSizes}}
 
 	return &logWriter{
-		algs:   []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1, tpm2.HashAlgorithmSHA256},
+		algs:   algs,
 		events: []*tcglog.Event{event}}
 }
 
@@ -790,8 +1832,12 @@ func (w *logWriter) hashLogExtendEvent(data eventData, event *event) {
 
 }
 
-func (s *resealSuite) writeMockTcglog(c *check.C) {
-	w := newCryptoAgileLogWriter()
+func (s *resealSuite) writeMockTcglog(c *check.C, algs ...tpm2.HashAlgorithmId) {
+	s.writeMockTcglogToPath(c, "/sys/kernel/security/tpm0/binary_bios_measurements", algs...)
+}
+
+func (s *resealSuite) writeMockTcglogToPath(c *check.C, path string, algs ...tpm2.HashAlgorithmId) {
+	w := newCryptoAgileLogWriter(algs...)
 
 	{
 		data := &tcglog.SeparatorEventData{Value: tcglog.SeparatorEventNormalValue}
@@ -854,7 +1900,8 @@ func (s *resealSuite) writeMockTcglog(c *check.C) {
 			Data:      data})
 	}
 
-	f, err := s.fs.OpenFile("/sys/kernel/security/tpm0/binary_bios_measurements", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	c.Assert(s.fs.MkdirAll(filepath.Dir(path), 0755), check.IsNil)
+	f, err := s.fs.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	c.Assert(err, check.IsNil)
 	defer f.Close()
 
@@ -896,7 +1943,10 @@ func (s *resealSuite) TestTrustCurrentBoot(c *check.C) {
 
 	assets := newTrustedAssets()
 
-	c.Check(TrustCurrentBoot(assets, "/boot/efi"), check.IsNil)
+	report, err := TrustCurrentBoot(assets, "/boot/efi", TCGLogSource{})
+	c.Check(err, check.IsNil)
+	c.Check(report.Missing, check.IsNil)
+	c.Check(report.Mismatches, check.IsNil)
 
 	c.Check(assets.loaded.Hashes, check.DeepEquals, [][]byte{
 		decodeHexString(c, "efbef08d5d3787d609ec6b55fabc36c7f212140b97a88606a39dc8f732368147"),
@@ -906,6 +1956,92 @@ func (s *resealSuite) TestTrustCurrentBoot(c *check.C) {
 		decodeHexString(c, "7e8c4310bd1e228888917fb5f87920426dbecd64ea7d6c2256740f80e39dcf6f")})
 }
 
+func (s *resealSuite) TestParseBootMeasurements(c *check.C) {
+	s.writeMockTcglog(c)
+
+	images, err := ParseBootMeasurements(TCGLogSource{})
+	c.Assert(err, check.IsNil)
+	c.Assert(images, check.HasLen, 2)
+
+	c.Check(images[0].Path, check.Equals, "/EFI/ubuntu/shimx64.efi")
+	c.Check(images[0].DevicePath, check.HasLen, 6)
+	c.Check(images[0].DevicePath[5], check.Equals, efi.FilePathDevicePathNode("\\EFI\\ubuntu\\shimx64.efi"))
+	c.Check(images[1].Path, check.Equals, "/EFI/ubuntu/kernel.efi-1.0-1-generic")
+	for i, data := range []string{"mock shim PE", "mock kernel PE"} {
+		for _, alg := range []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1, tpm2.HashAlgorithmSHA256} {
+			h := alg.NewHash()
+			h.Write([]byte(data))
+			c.Check(images[i].Digests[alg], check.DeepEquals, tcglog.Digest(h.Sum(nil)), check.Commentf("image %d, alg %v", i, alg))
+		}
+	}
+}
+
+func (s *resealSuite) TestParseBootMeasurementsNoLog(c *check.C) {
+	c.Assert(s.fs.MkdirAll("/sys/kernel/security/tpm1", 0755), check.IsNil)
+	c.Assert(s.fs.MkdirAll("/sys/kernel/security/tpm10", 0755), check.IsNil)
+	c.Assert(s.fs.MkdirAll("/sys/kernel/security/tpm2", 0755), check.IsNil)
+
+	_, err := ParseBootMeasurements(TCGLogSource{})
+	c.Check(err, check.ErrorMatches, "cannot find TCG log, tried "+
+		"/sys/kernel/security/tpm0/binary_bios_measurements, "+
+		"/sys/kernel/security/tpm1/binary_bios_measurements, "+
+		"/sys/kernel/security/tpm2/binary_bios_measurements, "+
+		"/sys/kernel/security/tpm10/binary_bios_measurements")
+
+	_, err = ParseBootMeasurements(TCGLogSource{Path: "/run/tcg.log"})
+	c.Check(err, check.ErrorMatches, "cannot find TCG log, tried /run/tcg.log")
+}
+
+func (s *resealSuite) TestParseBootMeasurementsOtherTPM(c *check.C) {
+	s.writeMockTcglogToPath(c, "/sys/kernel/security/tpm1/binary_bios_measurements")
+
+	for _, source := range []TCGLogSource{{}, {TPMDevice: "tpm1"}} {
+		images, err := ParseBootMeasurements(source)
+		c.Check(err, check.IsNil)
+		c.Check(images, check.HasLen, 2)
+	}
+
+	_, err := ParseBootMeasurements(TCGLogSource{TPMDevice: "tpm0"})
+	c.Check(err, check.ErrorMatches, "cannot find TCG log, tried /sys/kernel/security/tpm0/binary_bios_measurements")
+}
+
+func (s *resealSuite) TestTrustCurrentBootNonstandardLogPath(c *check.C) {
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+
+	s.writeMockTcglogToPath(c, "/mnt/securityfs/tpm0/binary_bios_measurements")
+
+	restore := s.mockEfiComputePeImageDigest(func(alg crypto.Hash, r io.ReaderAt, sz int64) ([]byte, error) {
+		r2 := io.NewSectionReader(r, 0, sz)
+		b, err := ioutil.ReadAll(r2)
+		c.Check(err, check.IsNil)
+
+		switch {
+		case bytes.Equal(b, []byte("shim1")):
+			return decodeHexString(c, "93c294bd9d372cf76e3cfd6f66a93fd2586aeb0406677ea0df104349b2ec093d"), nil
+		case bytes.Equal(b, []byte("kernel1")):
+			return decodeHexString(c, "54a5737f95928a359ba326bda6405a8e91fd06869cdb76f7f53aae83c1050308"), nil
+		default:
+			c.Fatal("invalid file")
+		}
+		return nil, nil
+	})
+	defer restore()
+
+	assets := newTrustedAssets()
+
+	_, err := TrustCurrentBoot(assets, "/boot/efi", TCGLogSource{})
+	c.Check(err, check.ErrorMatches,
+		"cannot find TCG log, tried /sys/kernel/security/tpm0/binary_bios_measurements")
+	report, err := TrustCurrentBoot(assets, "/boot/efi", TCGLogSource{Path: "/mnt/securityfs/tpm0/binary_bios_measurements"})
+	c.Check(err, check.IsNil)
+	c.Check(report.Missing, check.IsNil)
+
+	c.Check(assets.loaded.Hashes, check.DeepEquals, [][]byte{
+		decodeHexString(c, "efbef08d5d3787d609ec6b55fabc36c7f212140b97a88606a39dc8f732368147"),
+		decodeHexString(c, "7e8c4310bd1e228888917fb5f87920426dbecd64ea7d6c2256740f80e39dcf6f")})
+}
+
 func (s *resealSuite) TestTrustCurrentBootRejectPeHashMismatch(c *check.C) {
 	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
 	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
@@ -932,7 +2068,13 @@ func (s *resealSuite) TestTrustCurrentBootRejectPeHashMismatch(c *check.C) {
 
 	assets := newTrustedAssets()
 
-	c.Check(TrustCurrentBoot(assets, "/boot/efi"), check.IsNil)
+	report, err := TrustCurrentBoot(assets, "/boot/efi", TCGLogSource{})
+	c.Check(err, check.IsNil)
+	c.Check(report.Missing, check.IsNil)
+	c.Check(report.Mismatches, check.DeepEquals, []ImageDigestMismatch{{
+		Path:     "/boot/efi/EFI/ubuntu/shimx64.efi",
+		Expected: decodeHexString(c, "93c294bd9d372cf76e3cfd6f66a93fd2586aeb0406677ea0df104349b2ec093d"),
+		Computed: decodeHexString(c, "93c294bd9d372cf76e3cfd6f66a93fd2586aeb0406677ea0df104349b2ec093f")}})
 
 	c.Check(assets.loaded.Hashes, check.DeepEquals, [][]byte{
 		decodeHexString(c, "7e8c4310bd1e228888917fb5f87920426dbecd64ea7d6c2256740f80e39dcf6f")})
@@ -965,10 +2107,71 @@ func (s *resealSuite) TestTrustCurrentBootRejectMissing(c *check.C) {
 
 	assets := newTrustedAssets()
 
-	c.Check(TrustCurrentBoot(assets, "/boot/efi"), check.IsNil)
+	report, err := TrustCurrentBoot(assets, "/boot/efi", TCGLogSource{})
+	c.Check(err, check.IsNil)
+	c.Check(report.Missing, check.DeepEquals, []string{"/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic"})
 
 	c.Check(assets.loaded.Hashes, check.DeepEquals, [][]byte{
 		decodeHexString(c, "efbef08d5d3787d609ec6b55fabc36c7f212140b97a88606a39dc8f732368147")})
 	c.Check(assets.newAssets, check.DeepEquals, [][]byte{
 		decodeHexString(c, "efbef08d5d3787d609ec6b55fabc36c7f212140b97a88606a39dc8f732368147")})
 }
+
+func (s *resealSuite) TestTrustCurrentBootLogAlgorithmFallback(c *check.C) {
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+
+	s.writeMockTcglog(c)
+
+	restore := s.mockPCRAlgorithm(tpm2.HashAlgorithmSHA384)
+	defer restore()
+
+	restore = s.mockEfiComputePeImageDigest(func(alg crypto.Hash, r io.ReaderAt, sz int64) ([]byte, error) {
+		c.Check(alg, check.Equals, crypto.SHA256)
+
+		r2 := io.NewSectionReader(r, 0, sz)
+		b, err := ioutil.ReadAll(r2)
+		c.Check(err, check.IsNil)
+
+		switch {
+		case bytes.Equal(b, []byte("shim1")):
+			return decodeHexString(c, "93c294bd9d372cf76e3cfd6f66a93fd2586aeb0406677ea0df104349b2ec093d"), nil
+		case bytes.Equal(b, []byte("kernel1")):
+			return decodeHexString(c, "54a5737f95928a359ba326bda6405a8e91fd06869cdb76f7f53aae83c1050308"), nil
+		default:
+			c.Fatal("invalid file")
+		}
+		return nil, nil
+	})
+	defer restore()
+
+	assets := newTrustedAssets()
+
+	report, err := TrustCurrentBoot(assets, "/boot/efi", TCGLogSource{})
+	c.Check(err, check.IsNil)
+	c.Check(report.Missing, check.IsNil)
+
+	c.Check(assets.loaded.Hashes, check.DeepEquals, [][]byte{
+		decodeHexString(c, "efbef08d5d3787d609ec6b55fabc36c7f212140b97a88606a39dc8f732368147"),
+		decodeHexString(c, "7e8c4310bd1e228888917fb5f87920426dbecd64ea7d6c2256740f80e39dcf6f")})
+}
+
+func (s *resealSuite) TestTrustCurrentBootLogAlgorithmNoneInCommon(c *check.C) {
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim1"), 0600), check.IsNil)
+	c.Check(s.fs.WriteFile("/boot/efi/EFI/ubuntu/kernel.efi-1.0-1-generic", []byte("kernel1"), 0600), check.IsNil)
+
+	s.writeMockTcglog(c, tpm2.HashAlgorithmSHA1)
+
+	restore := s.mockEfiComputePeImageDigest(func(alg crypto.Hash, r io.ReaderAt, sz int64) ([]byte, error) {
+		c.Error("unexpected PE image digest computation")
+		return nil, nil
+	})
+	defer restore()
+
+	assets := newTrustedAssets()
+
+	_, err := TrustCurrentBoot(assets, "/boot/efi", TCGLogSource{})
+	c.Check(err, check.ErrorMatches,
+		`TCG log has no digest algorithm in common with \[TPM_ALG_SHA512 TPM_ALG_SHA384 TPM_ALG_SHA256\] \(log contains \[TPM_ALG_SHA1\]\)`)
+	c.Check(assets.loaded.Hashes, check.IsNil)
+}
@@ -5,14 +5,29 @@
 package efibootmgr
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"golang.org/x/text/encoding/unicode"
 	"golang.org/x/text/transform"
 	"io"
+	"io/ioutil"
+	"log"
+	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"unicode/utf16"
+
+	"github.com/canonical/go-efilib"
 )
 
 // BootEntry is a boot entry.
@@ -21,31 +36,142 @@ type BootEntry struct {
 	Label       string
 	Options     string
 	Description string
+
+	// Attributes are the load option attributes of the entry. If zero, the
+	// entry is an active boot entry.
+	Attributes efi.LoadOptionAttributes
+
+	// DevicePath selects the form of the device path of the entry.
+	DevicePath DevicePathMode
+}
+
+// ShimConfig describes where shim is installed on the ESP.
+type ShimConfig struct {
+	Vendor   string // name of the vendor directory on the ESP, for example, "ubuntu"
+	Basename string // filename of shim in the vendor directory, defaults to shim<arch>.efi
+
+	// TrustedSigners, if set, enables checking that the Authenticode signature of
+	// each image chains to one of these certificates before it is installed.
+	TrustedSigners *x509.CertPool
+
+	// NXCompat selects whether the images are checked for NX compatibility
+	// before they are installed.
+	NXCompat NXCompatCheck
+
+	// SbatPolicyVariables, if set, enables requesting that shim applies its
+	// latest SBAT revocations on the next boot, if the shim source directory
+	// ships revocations that are newer than the ones currently applied.
+	SbatPolicyVariables EFIVariables
+}
+
+// shimGUID is the vendor GUID of shim's variables
+var shimGUID = efi.MakeGUID(0x605dab50, 0xe046, 0x4300, 0xabb6, [...]uint8{0x3d, 0xd8, 0x10, 0xdd, 0x8b, 0x23})
+
+// sbatPolicyLatest is the value of shim's SbatPolicy variable that requests
+// applying the latest revocations built into shim.
+const sbatPolicyLatest = 1
+
+// shimFilesPath is where the files installed to each ESP by InstallShim are
+// recorded, so that the ones no longer shipped with shim can be removed.
+const shimFilesPath = "/var/lib/nullboot/shim-files"
+
+// sbatRevocationFiles are the names of the files in the shim source directory
+// that contain the latest SBAT revocations of shim.
+var sbatRevocationFiles = []string{"revocations.sbat", "sbat_level.txt"}
+
+// basename returns the filename of shim in the vendor directory. The signed shim
+// in the source directory is expected to have the same name with a ".signed" suffix.
+func (c ShimConfig) basename() string {
+	if c.Basename != "" {
+		return c.Basename
+	}
+	return GetEfiArchitecture().ShimBasename()
 }
 
 // architectureMaps maps from GOARCH to host
-var architectureMap = map[string]string{
-	"386":      "ia32",
-	"amd64":    "x64",
-	"arm":      "arm",
-	"arm64":    "aa64",
-	"riscv":    "riscv32",
-	"riscv64":  "riscv64",
-	"riscv128": "riscv128",
+var architectureMap = map[string]EFIArch{
+	"386":      ArchIA32,
+	"amd64":    ArchX64,
+	"arm":      ArchARM,
+	"arm64":    ArchAA64,
+	"loong64":  ArchLoongArch64,
+	"riscv":    ArchRISCV32,
+	"riscv64":  ArchRISCV64,
+	"riscv128": ArchRISCV128,
 }
 
-// appArchitecture can be overriden in a test case for testing purposes
-var appArchitecture = ""
+// appArchitecture overrides the EFI architecture of the target system if
+// not empty. Access it through SetArchitecture and architectureOverride.
+var (
+	appArchitectureMu sync.RWMutex
+	appArchitecture   EFIArch
+)
+
+// SetArchitecture overrides the EFI architecture returned by
+// GetEfiArchitecture, for example to install for a different target system.
+// An empty architecture resets it to the architecture of the running system.
+func SetArchitecture(arch EFIArch) {
+	appArchitectureMu.Lock()
+	defer appArchitectureMu.Unlock()
+	appArchitecture = arch
+}
+
+// architectureOverride returns the architecture set with SetArchitecture.
+func architectureOverride() EFIArch {
+	appArchitectureMu.RLock()
+	defer appArchitectureMu.RUnlock()
+	return appArchitecture
+}
 
 // GetEfiArchitecture returns the EFI architecture for the target system
-func GetEfiArchitecture() string {
-	if appArchitecture != "" {
-		return appArchitecture
+func GetEfiArchitecture() EFIArch {
+	if arch := architectureOverride(); arch != "" {
+		return arch
+	}
+	return efiArchitectureForFirmware(runtime.GOARCH)
+}
+
+// fwPlatformSizePath is the sysfs file holding the word size of the firmware
+const fwPlatformSizePath = "/sys/firmware/efi/fw_platform_size"
+
+// firmwareArchitectureMap maps an EFI architecture to its counterpart for
+// the other firmware word size, keyed by the word size
+var firmwareArchitectureMap = map[string]map[EFIArch]EFIArch{
+	"32": {ArchX64: ArchIA32, ArchAA64: ArchARM},
+	"64": {ArchIA32: ArchX64, ArchARM: ArchAA64},
+}
+
+// efiArchitectureForFirmware returns the EFI architecture for the specified
+// GOARCH, corrected for the word size of the running firmware. This handles
+// systems that run a 32-bit EFI on a 64-bit CPU. If the firmware word size
+// cannot be determined, the architecture for GOARCH is returned.
+func efiArchitectureForFirmware(goarch string) EFIArch {
+	arch := efiArchitectureForGOARCH(goarch)
+
+	f, err := appFs.Open(fwPlatformSizePath)
+	if err != nil {
+		return arch
+	}
+	defer f.Close()
+	size, err := ioutil.ReadAll(f)
+	if err != nil {
+		return arch
 	}
-	return architectureMap[runtime.GOARCH]
+
+	if fwArch, ok := firmwareArchitectureMap[strings.TrimSpace(string(size))][arch]; ok {
+		return fwArch
+	}
+	return arch
+}
+
+// efiArchitectureForGOARCH returns the EFI architecture for the specified GOARCH,
+// or an empty string if it is unknown.
+func efiArchitectureForGOARCH(goarch string) EFIArch {
+	return architectureMap[goarch]
 }
 
-// WriteShimFallbackToFile opens the specified path in UTF-16LE and then calls WriteShimFallback
+// WriteShimFallbackToFile opens the specified path in UTF-16LE, writes a byte order mark
+// and then calls WriteShimFallback
 func WriteShimFallbackToFile(path string, entries []BootEntry) error {
 	file, err := appFs.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
 	if err != nil {
@@ -58,7 +184,7 @@ func WriteShimFallbackToFile(path string, entries []BootEntry) error {
 			appFs.Remove(name)
 		}
 	}()
-	writer := transform.NewWriter(file, unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewEncoder())
+	writer := transform.NewWriter(file, unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder())
 	if err = WriteShimFallback(writer, entries); err != nil {
 		return err
 	}
@@ -76,11 +202,20 @@ func WriteShimFallback(w io.Writer, entries []BootEntry) error {
 	// need to write out the lines in reverse boot order.
 	for i := len(entries); i > 0; i-- {
 		entry := entries[i-1]
-		if strings.Contains(entry.Filename, ",") ||
-			strings.Contains(entry.Label, ",") ||
-			strings.Contains(entry.Options, ",") ||
-			strings.Contains(entry.Description, ",") {
-			return fmt.Errorf("entry '%s' contains ',' in one of the attributes, this is not supported", entry.Label)
+		// shim splits each line at the first three commas and doesn't
+		// support quoting, so only the description, which extends to the
+		// end of the line, may contain commas.
+		for _, field := range []struct{ name, value string }{
+			{"filename", entry.Filename},
+			{"label", entry.Label},
+			{"options", entry.Options},
+		} {
+			if strings.Contains(field.value, ",") {
+				return fmt.Errorf("entry '%s' contains ',' in its %s, which the shim fallback loader cannot parse", entry.Label, field.name)
+			}
+		}
+		if strings.ContainsAny(entry.Description, "\r\n") {
+			return fmt.Errorf("entry '%s' contains a line break in its description, this is not supported", entry.Label)
 		}
 
 		// We have an empty space after Options, because if there is no space in the options, shim
@@ -98,28 +233,60 @@ func WriteShimFallback(w io.Writer, entries []BootEntry) error {
 	return nil
 }
 
-// InstallShim installs the shim into the given ESP for the given vendor
+// InstallShim installs the shim into the given ESP using the given shim configuration
 // It returns true if it installed the shim.
-func InstallShim(esp string, source string, vendor string) (bool, error) {
+func InstallShim(esp string, source string, config ShimConfig) (bool, error) {
 	if err := appFs.MkdirAll(path.Join(esp, "EFI", "BOOT"), 0644); err != nil {
 		return false, fmt.Errorf("Could not create BOOT directory on ESP: %w", err)
 	}
-	if err := appFs.MkdirAll(path.Join(esp, "EFI", vendor), 0644); err != nil {
+	if err := appFs.MkdirAll(path.Join(esp, "EFI", config.Vendor), 0644); err != nil {
 		return false, fmt.Errorf("Could not create vendor directory on ESP: %w", err)
 	}
 
 	updatedAny := false
-	shim := "shim" + GetEfiArchitecture() + ".efi"
-	fb := "fb" + GetEfiArchitecture() + ".efi"
-	mm := "mm" + GetEfiArchitecture() + ".efi"
-	removable := "BOOT" + strings.ToUpper(GetEfiArchitecture()) + ".EFI"
+	shim := config.basename()
+	arch := GetEfiArchitecture()
+	fb := arch.FallbackBasename()
+	mm := arch.MokManagerBasename()
+	removable := arch.RemovableBasename()
+	grub := arch.GrubBasename()
 	copies := map[string]string{
-		path.Join(esp, "EFI", "BOOT", removable): shim + ".signed",
-		path.Join(esp, "EFI", "BOOT", fb):        fb,
-		path.Join(esp, "EFI", "BOOT", mm):        mm,
-		path.Join(esp, "EFI", vendor, shim):      shim + ".signed",
-		path.Join(esp, "EFI", vendor, fb):        fb,
-		path.Join(esp, "EFI", vendor, mm):        mm,
+		path.Join(esp, "EFI", "BOOT", removable):   shim + ".signed",
+		path.Join(esp, "EFI", config.Vendor, shim): shim + ".signed",
+	}
+	// The fallback loader, MokManager and grub are optional, but if they are
+	// shipped alongside shim, keep them in sync
+	for _, optional := range []string{fb, mm, grub} {
+		if _, err := appFs.Stat(path.Join(source, optional)); err == nil {
+			copies[path.Join(esp, "EFI", "BOOT", optional)] = optional
+			copies[path.Join(esp, "EFI", config.Vendor, optional)] = optional
+		} else if !os.IsNotExist(err) {
+			return false, fmt.Errorf("Could not check for %s: %w", optional, err)
+		}
+	}
+	if config.TrustedSigners != nil {
+		verified := make(map[string]bool)
+		for _, src := range copies {
+			if verified[src] {
+				continue
+			}
+			if err := verifyImageFile(path.Join(source, src), config.TrustedSigners); err != nil {
+				return false, fmt.Errorf("Could not verify signature of %s: %w", src, err)
+			}
+			verified[src] = true
+		}
+	}
+	if config.NXCompat != NXCompatIgnore {
+		checked := make(map[string]bool)
+		for _, src := range copies {
+			if checked[src] {
+				continue
+			}
+			if err := checkImageNXCompat(path.Join(source, src), config.NXCompat); err != nil {
+				return false, fmt.Errorf("Could not check NX compatibility of %s: %w", src, err)
+			}
+			checked[src] = true
+		}
 	}
 	for dst, src := range copies {
 		updated, err := MaybeUpdateFile(dst, path.Join(source, src))
@@ -128,5 +295,220 @@ func InstallShim(esp string, source string, vendor string) (bool, error) {
 		}
 		updatedAny = updatedAny || updated
 	}
+	removed, err := removeStaleShimFiles(esp, copies)
+	if err != nil {
+		return updatedAny, err
+	}
+	updatedAny = updatedAny || removed
+	if config.SbatPolicyVariables != nil {
+		if err := stageSbatPolicy(config.SbatPolicyVariables, source); err != nil {
+			return updatedAny, err
+		}
+	}
 	return updatedAny, nil
 }
+
+// readShimFiles returns the files installed by InstallShim, relative to the
+// ESP they were installed to, keyed by the ESP.
+func readShimFiles() (map[string][]string, error) {
+	files := make(map[string][]string)
+	f, err := appFs.Open(shimFilesPath)
+	switch {
+	case os.IsNotExist(err):
+		return files, nil
+	case err != nil:
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(&files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// removeStaleShimFiles removes the files that were previously installed to
+// the ESP by InstallShim but are not in copies anymore, and records the
+// files in copies as installed. It returns true if it removed any file.
+func removeStaleShimFiles(esp string, copies map[string]string) (bool, error) {
+	files, err := readShimFiles()
+	if err != nil {
+		return false, fmt.Errorf("Could not read installed shim files: %w", err)
+	}
+
+	var installed []string
+	for dst := range copies {
+		rel, err := filepath.Rel(esp, dst)
+		if err != nil {
+			return false, err
+		}
+		installed = append(installed, rel)
+	}
+	sort.Strings(installed)
+
+	removedAny := false
+	for _, rel := range files[esp] {
+		if _, ok := copies[path.Join(esp, rel)]; ok {
+			continue
+		}
+		switch err := appFs.Remove(path.Join(esp, rel)); {
+		case os.IsNotExist(err):
+		case err != nil:
+			return removedAny, fmt.Errorf("Could not remove stale %s: %w", rel, err)
+		default:
+			log.Printf("Removed stale %s", rel)
+			removedAny = true
+		}
+	}
+
+	files[esp] = installed
+	data, err := json.Marshal(files)
+	if err != nil {
+		return removedAny, err
+	}
+	if err := appFs.MkdirAll(filepath.Dir(shimFilesPath), 0755); err != nil {
+		return removedAny, fmt.Errorf("Could not make directory: %w", err)
+	}
+	if _, err := maybeWriteFile(shimFilesPath, data); err != nil {
+		return removedAny, fmt.Errorf("Could not record installed shim files: %w", err)
+	}
+	return removedAny, nil
+}
+
+// InstallShimToESPs installs the shim into each of the given mirrored ESPs, see
+// InstallShim. It returns true if it installed the shim to any of them.
+func InstallShimToESPs(esps []string, source string, config ShimConfig) (bool, error) {
+	updatedAny := false
+	for _, esp := range esps {
+		updated, err := InstallShim(esp, source, config)
+		updatedAny = updatedAny || updated
+		if err != nil {
+			return updatedAny, fmt.Errorf("Could not install shim to %s: %w", esp, err)
+		}
+	}
+	return updatedAny, nil
+}
+
+// stageSbatPolicy sets shim's SbatPolicy variable to apply the latest
+// revocations if the revocations in the shim source directory differ from the
+// ones currently applied, as reported by shim in SbatLevelRT.
+func stageSbatPolicy(efivars EFIVariables, source string) error {
+	var revocations []byte
+	for _, name := range sbatRevocationFiles {
+		file, err := appFs.Open(path.Join(source, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Could not open SBAT revocations: %w", err)
+		}
+		revocations, err = ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("Could not read SBAT revocations: %w", err)
+		}
+		break
+	}
+	if revocations == nil {
+		return nil
+	}
+
+	current, _, err := efivars.GetVariable(shimGUID, "SbatLevelRT")
+	switch {
+	case err == efi.ErrVarNotExist:
+	case err != nil:
+		return fmt.Errorf("cannot read SbatLevelRT: %w", err)
+	case bytes.Equal(bytes.TrimRight(current, "\x00\n"), bytes.TrimRight(revocations, "\x00\n")):
+		return nil
+	}
+
+	policy, _, err := efivars.GetVariable(shimGUID, "SbatPolicy")
+	switch {
+	case err == efi.ErrVarNotExist:
+	case err != nil:
+		return fmt.Errorf("cannot read SbatPolicy: %w", err)
+	case bytes.Equal(policy, []byte{sbatPolicyLatest}):
+		return nil
+	}
+
+	attrs := efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess
+	if err := efivars.SetVariable(shimGUID, "SbatPolicy", []byte{sbatPolicyLatest}, attrs); err != nil {
+		return fmt.Errorf("cannot set SbatPolicy: %w", err)
+	}
+	log.Print("Requested shim to apply the latest SBAT revocations on next boot")
+	return nil
+}
+
+// RequestMOKEnrollment requests that MokManager enrolls the DER encoded X.509
+// certificate in the machine owner key list on the next boot, by setting
+// shim's MokNew and MokAuth variables. MokManager prompts for the password
+// before enrolling the certificate. Any pending enrollment request is
+// replaced.
+func RequestMOKEnrollment(efivars EFIVariables, derCert []byte, password string) error {
+	if _, err := x509.ParseCertificate(derCert); err != nil {
+		return fmt.Errorf("cannot parse certificate: %w", err)
+	}
+	if password == "" {
+		return errors.New("cannot request MOK enrollment without a password")
+	}
+
+	db := efi.SignatureDatabase{
+		{
+			Type:       efi.CertX509Guid,
+			Signatures: []*efi.SignatureData{{Owner: shimGUID, Data: derCert}},
+		},
+	}
+	mokNew, err := db.Bytes()
+	if err != nil {
+		return fmt.Errorf("cannot encode MokNew: %w", err)
+	}
+
+	// MokManager checks the password against the SHA-256 digest of the
+	// request followed by the UCS-2 encoded password.
+	h := crypto.SHA256.New()
+	h.Write(mokNew)
+	binary.Write(h, binary.LittleEndian, utf16.Encode([]rune(password)))
+	mokAuth := h.Sum(nil)
+
+	attrs := efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess
+	if err := efivars.SetVariable(shimGUID, "MokNew", mokNew, attrs); err != nil {
+		return fmt.Errorf("cannot set MokNew: %w", err)
+	}
+	if err := efivars.SetVariable(shimGUID, "MokAuth", mokAuth, attrs); err != nil {
+		return fmt.Errorf("cannot set MokAuth: %w", err)
+	}
+	log.Print("Requested MokManager to enroll the certificate on next boot")
+	return nil
+}
+
+// DetectShimTampering indicates whether the shim installed in the vendor directory
+// of the given ESP is not one of the trusted boot assets, which means that it may
+// have been replaced since it was last trusted.
+func DetectShimTampering(esp string, config ShimConfig, assets *TrustedAssets) (bool, error) {
+	trusted, err := assets.isTrustedFile(path.Join(esp, "EFI", config.Vendor, config.basename()))
+	if err != nil {
+		return false, fmt.Errorf("cannot check installed shim: %w", err)
+	}
+	return !trusted, nil
+}
+
+// VerifyShimConsistency checks that the shim installed to the removable media
+// path of the given ESP is identical to the one in the vendor directory.
+func VerifyShimConsistency(esp, vendor string) error {
+	removable := path.Join(esp, "EFI", "BOOT", GetEfiArchitecture().RemovableBasename())
+	shim := path.Join(esp, "EFI", vendor, ShimConfig{Vendor: vendor}.basename())
+
+	removableSz, removableHashes, err := hashFileBlocks(removable, crypto.SHA256)
+	if err != nil {
+		return fmt.Errorf("cannot hash %s: %w", removable, err)
+	}
+	shimSz, shimHashes, err := hashFileBlocks(shim, crypto.SHA256)
+	if err != nil {
+		return fmt.Errorf("cannot hash %s: %w", shim, err)
+	}
+
+	if removableSz != shimSz || !reflect.DeepEqual(removableHashes, shimHashes) {
+		return fmt.Errorf("%s differs from %s", removable, shim)
+	}
+	return nil
+}
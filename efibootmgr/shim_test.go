@@ -5,35 +5,132 @@
 package efibootmgr
 
 import (
+	"github.com/canonical/go-efilib"
 	"github.com/spf13/afero"
 
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"os"
+	"path"
+	"reflect"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetEfiArchitecture(t *testing.T) {
-	appArchitecture = ""
+	SetArchitecture("")
 	arch := GetEfiArchitecture()
 	if arch == "" {
 		t.Fatalf("Unknown architecture: '%s'", runtime.GOARCH)
 	}
 }
+
+func TestSetArchitecture(t *testing.T) {
+	defer SetArchitecture("")
+	appFs = MapFS{afero.NewMemMapFs()}
+
+	SetArchitecture("riscv64")
+	if arch := GetEfiArchitecture(); arch != "riscv64" {
+		t.Errorf("Expected overridden architecture riscv64, got %s", arch)
+	}
+
+	SetArchitecture("")
+	if arch, want := GetEfiArchitecture(), efiArchitectureForGOARCH(runtime.GOARCH); arch != want {
+		t.Errorf("Expected host architecture %s after reset, got %s", want, arch)
+	}
+}
+
+func TestEfiArchitectureForFirmware(t *testing.T) {
+	tests := []struct {
+		name         string
+		goarch       string
+		platformSize string
+		want         EFIArch
+	}{
+		{"absent", "amd64", "", "x64"},
+		{"amd64-on-32", "amd64", "32\n", "ia32"},
+		{"amd64-on-64", "amd64", "64\n", "x64"},
+		{"386-on-64", "386", "64\n", "x64"},
+		{"arm64-on-32", "arm64", "32\n", "arm"},
+		{"riscv64-on-64", "riscv64", "64\n", "riscv64"},
+		{"invalid", "amd64", "garbage\n", "x64"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			memFs := afero.NewMemMapFs()
+			appFs = MapFS{memFs}
+			if tc.platformSize != "" {
+				afero.WriteFile(memFs, fwPlatformSizePath, []byte(tc.platformSize), 0444)
+			}
+
+			if got := efiArchitectureForFirmware(tc.goarch); got != tc.want {
+				t.Errorf("Expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestGetEfiArchitectureOverridesFirmware(t *testing.T) {
+	defer SetArchitecture("")
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	afero.WriteFile(memFs, fwPlatformSizePath, []byte("32\n"), 0444)
+
+	SetArchitecture("x64")
+	if arch := GetEfiArchitecture(); arch != "x64" {
+		t.Errorf("Expected overridden architecture x64, got %s", arch)
+	}
+}
+
+func TestEfiArchitectureForGOARCH(t *testing.T) {
+	tests := []struct {
+		goarch string
+		want   EFIArch
+	}{
+		{"386", "ia32"},
+		{"amd64", "x64"},
+		{"arm", "arm"},
+		{"arm64", "aa64"},
+		{"loong64", "loongarch64"},
+		{"riscv64", "riscv64"},
+		{"s390x", ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.goarch, func(t *testing.T) {
+			if got := efiArchitectureForGOARCH(tc.goarch); got != tc.want {
+				t.Errorf("Expected '%s', got '%s'", tc.want, got)
+			}
+		})
+	}
+}
+
 func TestWriteShimFallback(t *testing.T) {
-	appArchitecture = "x64"
+	SetArchitecture("x64")
 	tests := []struct {
 		label string
 		input []BootEntry
 		want  string
 	}{
-		{"basic", []BootEntry{{"shimx64.efi", "ubuntu", "", "This is the boot entry for ubuntu"}}, "shimx64.efi,ubuntu,,This is the boot entry for ubuntu\n"},
+		{"basic", []BootEntry{{Filename: "shimx64.efi", Label: "ubuntu", Description: "This is the boot entry for ubuntu"}}, "shimx64.efi,ubuntu,,This is the boot entry for ubuntu\n"},
 		{"fwupd", []BootEntry{
-			{"shimx64.efi", "ubuntu", "", "This is the boot entry for ubuntu"},
-			{"shimx64.efi", "Linux-Firmware-Updater", "\\fwupdx64.efi", "This is the boot entry for Linux-Firmware-Updater"},
+			{Filename: "shimx64.efi", Label: "ubuntu", Description: "This is the boot entry for ubuntu"},
+			{Filename: "shimx64.efi", Label: "Linux-Firmware-Updater", Options: "\\fwupdx64.efi", Description: "This is the boot entry for Linux-Firmware-Updater"},
 		},
 			"shimx64.efi,Linux-Firmware-Updater,\\fwupdx64.efi ,This is the boot entry for Linux-Firmware-Updater\n" +
 				"shimx64.efi,ubuntu,,This is the boot entry for ubuntu\n",
 		},
+		{"description with commas", []BootEntry{{Filename: "shimx64.efi", Label: "ubuntu", Options: "\\kernel.efi", Description: "Ubuntu, the default entry"}}, "shimx64.efi,ubuntu,\\kernel.efi ,Ubuntu, the default entry\n"},
 	}
 
 	for _, tc := range tests {
@@ -51,12 +148,85 @@ func TestWriteShimFallback(t *testing.T) {
 	}
 }
 
+// parseShimFallback parses a BOOT*.CSV the way shim's fallback loader does,
+// splitting each line at the first three commas.
+func parseShimFallback(data string) []BootEntry {
+	var entries []BootEntry
+	for _, line := range strings.Split(strings.TrimSuffix(data, "\n"), "\n") {
+		fields := strings.SplitN(line, ",", 4)
+		entries = append([]BootEntry{{
+			Filename:    fields[0],
+			Label:       fields[1],
+			Options:     strings.TrimSuffix(fields[2], " "),
+			Description: fields[3],
+		}}, entries...)
+	}
+	return entries
+}
+
+func TestWriteShimFallbackToFile(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+	memFs.MkdirAll("/boot/efi/EFI/ubuntu", 0755)
+
+	if err := WriteShimFallbackToFile("/boot/efi/EFI/ubuntu/BOOTX64.CSV", []BootEntry{{Filename: "shimx64.efi", Label: "ubuntu", Description: "d"}}); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	data, err := afero.ReadFile(memFs, "/boot/efi/EFI/ubuntu/BOOTX64.CSV")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte{0xff, 0xfe}) {
+		t.Fatalf("Expected file to start with a UTF-16LE BOM, got %x", data)
+	}
+	if want := []byte{0xff, 0xfe, 's', 0, 'h', 0, 'i', 0, 'm', 0}; !bytes.HasPrefix(data, want) {
+		t.Errorf("Expected file to start with %x, got %x", want, data)
+	}
+}
+
+func TestWriteShimFallback_roundTrip(t *testing.T) {
+	input := []BootEntry{
+		{Filename: "shimx64.efi", Label: "Ubuntu with kernel 1.0-12-generic", Options: "\\kernel.efi-1.0-12-generic root=magic", Description: "Ubuntu entry, kernel 1.0-12-generic"},
+		{Filename: "shimx64.efi", Label: "ubuntu", Description: "This is the boot entry for ubuntu"},
+	}
+
+	var w bytes.Buffer
+	if err := WriteShimFallback(&w, input); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if got := parseShimFallback(w.String()); !reflect.DeepEqual(got, input) {
+		t.Errorf("Expected %+v, got %+v", input, got)
+	}
+}
+
+func TestWriteShimFallback_unsupported(t *testing.T) {
+	for _, tc := range []struct {
+		label string
+		entry BootEntry
+		want  string
+	}{
+		{"filename", BootEntry{Filename: "shim,x64.efi", Label: "ubuntu"}, "entry 'ubuntu' contains ',' in its filename, which the shim fallback loader cannot parse"},
+		{"label", BootEntry{Filename: "shimx64.efi", Label: "ubuntu,"}, "entry 'ubuntu,' contains ',' in its label, which the shim fallback loader cannot parse"},
+		{"options", BootEntry{Filename: "shimx64.efi", Label: "ubuntu", Options: "\\kernel.efi console=ttyS0,115200"}, "entry 'ubuntu' contains ',' in its options, which the shim fallback loader cannot parse"},
+		{"description", BootEntry{Filename: "shimx64.efi", Label: "ubuntu", Description: "two\nlines"}, "entry 'ubuntu' contains a line break in its description, this is not supported"},
+	} {
+		t.Run(tc.label, func(t *testing.T) {
+			var w bytes.Buffer
+			err := WriteShimFallback(&w, []BootEntry{tc.entry})
+			if err == nil || err.Error() != tc.want {
+				t.Errorf("Expected error %q, got %v", tc.want, err)
+			}
+		})
+	}
+}
+
 func TestInstallShim_NoKernelsAvailable(t *testing.T) {
-	appArchitecture = "x64"
+	SetArchitecture("x64")
 	memFs := afero.NewMemMapFs()
 	appFs = MapFS{memFs}
 
-	updated, err := InstallShim("/boot/efi", "/usr/lib/nullboot/shim-signed", "ubuntu")
+	updated, err := InstallShim("/boot/efi", "/usr/lib/nullboot/shim-signed", ShimConfig{Vendor: "ubuntu"})
 	if updated {
 		t.Errorf("Unexpected update")
 	}
@@ -66,7 +236,7 @@ func TestInstallShim_NoKernelsAvailable(t *testing.T) {
 }
 
 func TestInstallShim_BasicUpdate(t *testing.T) {
-	appArchitecture = "x64"
+	SetArchitecture("x64")
 	memFs := afero.NewMemMapFs()
 	appFs = MapFS{memFs}
 
@@ -75,7 +245,7 @@ func TestInstallShim_BasicUpdate(t *testing.T) {
 	afero.WriteFile(memFs, "/usr/lib/nullboot/shim-signed/mmx64.efi", []byte("mm"), 0644)
 	afero.WriteFile(memFs, "/boot/efi/EFI/BOOT/BOOTX64.EFI", []byte("old shim"), 0644)
 
-	updated, err := InstallShim("/boot/efi", "/usr/lib/nullboot/shim-signed", "ubuntu")
+	updated, err := InstallShim("/boot/efi", "/usr/lib/nullboot/shim-signed", ShimConfig{Vendor: "ubuntu"})
 	if err != nil {
 		t.Errorf("Expected success, got error: %v", err)
 	}
@@ -96,4 +266,390 @@ func TestInstallShim_BasicUpdate(t *testing.T) {
 			t.Error(err)
 		}
 	}
+	if _, err := memFs.Stat("/boot/efi/EFI/ubuntu/grubx64.efi"); !os.IsNotExist(err) {
+		t.Errorf("Expected grub to not be installed, got: %v", err)
+	}
+}
+
+func TestInstallShim_OnlyShim(t *testing.T) {
+	SetArchitecture("x64")
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+
+	afero.WriteFile(memFs, "/usr/lib/nullboot/shim-signed/shimx64.efi.signed", []byte("shim"), 0644)
+
+	updated, err := InstallShim("/boot/efi", "/usr/lib/nullboot/shim-signed", ShimConfig{Vendor: "ubuntu"})
+	if err != nil {
+		t.Errorf("Expected success, got error: %v", err)
+	}
+	if !updated {
+		t.Errorf("Expected successful update")
+	}
+
+	for _, dir := range []string{"/boot/efi/EFI/BOOT", "/boot/efi/EFI/ubuntu"} {
+		entries, err := afero.ReadDir(memFs, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		want := []string{"shimx64.efi"}
+		if dir == "/boot/efi/EFI/BOOT" {
+			want = []string{"BOOTX64.EFI"}
+		}
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("Expected %v in %s, got %v", want, dir, names)
+		}
+		if err := CheckFilesEqual(memFs, path.Join(dir, want[0]), "/usr/lib/nullboot/shim-signed/shimx64.efi.signed"); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestInstallShim_RemovesStale(t *testing.T) {
+	SetArchitecture("x64")
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+
+	afero.WriteFile(memFs, "/usr/lib/nullboot/shim-signed/shimx64.efi.signed", []byte("shim"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/nullboot/shim-signed/fbx64.efi", []byte("fb"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/nullboot/shim-signed/mmx64.efi", []byte("mm"), 0644)
+	// Not installed by us, so must be left alone
+	afero.WriteFile(memFs, "/boot/efi/EFI/BOOT/foreign.efi", []byte("foreign"), 0644)
+
+	if _, err := InstallShim("/boot/efi", "/usr/lib/nullboot/shim-signed", ShimConfig{Vendor: "ubuntu"}); err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	for _, dst := range []string{"/boot/efi/EFI/BOOT/mmx64.efi", "/boot/efi/EFI/ubuntu/mmx64.efi"} {
+		if _, err := memFs.Stat(dst); err != nil {
+			t.Errorf("Expected %s to be installed, got: %v", dst, err)
+		}
+	}
+
+	// MokManager is no longer shipped alongside shim
+	memFs.Remove("/usr/lib/nullboot/shim-signed/mmx64.efi")
+
+	updated, err := InstallShim("/boot/efi", "/usr/lib/nullboot/shim-signed", ShimConfig{Vendor: "ubuntu"})
+	if err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+	if !updated {
+		t.Errorf("Expected successful update")
+	}
+	for _, dst := range []string{"/boot/efi/EFI/BOOT/mmx64.efi", "/boot/efi/EFI/ubuntu/mmx64.efi"} {
+		if _, err := memFs.Stat(dst); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got: %v", dst, err)
+		}
+	}
+	for _, dst := range []string{"/boot/efi/EFI/BOOT/BOOTX64.EFI", "/boot/efi/EFI/BOOT/fbx64.efi", "/boot/efi/EFI/BOOT/foreign.efi",
+		"/boot/efi/EFI/ubuntu/shimx64.efi", "/boot/efi/EFI/ubuntu/fbx64.efi"} {
+		if _, err := memFs.Stat(dst); err != nil {
+			t.Errorf("Expected %s to be kept, got: %v", dst, err)
+		}
+	}
+
+	files, err := readShimFiles()
+	if err != nil {
+		t.Fatalf("Could not read installed shim files: %v", err)
+	}
+	want := map[string][]string{
+		"/boot/efi": {"EFI/BOOT/BOOTX64.EFI", "EFI/BOOT/fbx64.efi", "EFI/ubuntu/fbx64.efi", "EFI/ubuntu/shimx64.efi"},
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("Expected installed shim files %v, got %v", want, files)
+	}
+
+	updated, err = InstallShim("/boot/efi", "/usr/lib/nullboot/shim-signed", ShimConfig{Vendor: "ubuntu"})
+	if err != nil || updated {
+		t.Errorf("Expected no update, got %v, %v", updated, err)
+	}
+}
+
+func TestInstallShimToESPs(t *testing.T) {
+	SetArchitecture("x64")
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+
+	afero.WriteFile(memFs, "/usr/lib/nullboot/shim-signed/shimx64.efi.signed", []byte("shim"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/BOOT/BOOTX64.EFI", []byte("shim"), 0644)
+
+	// Only the backup ESP needs updating
+	updated, err := InstallShimToESPs([]string{"/boot/efi", "/boot/efi2"}, "/usr/lib/nullboot/shim-signed", ShimConfig{Vendor: "ubuntu"})
+	if err != nil {
+		t.Errorf("Expected success, got error: %v", err)
+	}
+	if !updated {
+		t.Errorf("Expected successful update")
+	}
+
+	for _, dst := range []string{"/boot/efi/EFI/BOOT/BOOTX64.EFI", "/boot/efi/EFI/ubuntu/shimx64.efi", "/boot/efi2/EFI/BOOT/BOOTX64.EFI", "/boot/efi2/EFI/ubuntu/shimx64.efi"} {
+		if err := CheckFilesEqual(memFs, dst, "/usr/lib/nullboot/shim-signed/shimx64.efi.signed"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	updated, err = InstallShimToESPs([]string{"/boot/efi", "/boot/efi2"}, "/usr/lib/nullboot/shim-signed", ShimConfig{Vendor: "ubuntu"})
+	if err != nil || updated {
+		t.Errorf("Expected no update, got %v, %v", updated, err)
+	}
+}
+
+func TestInstallShim_SbatPolicy(t *testing.T) {
+	SetArchitecture("x64")
+	revocations := []byte("sbat,1,2023012900\nshim,2\ngrub,3\n")
+	for _, tc := range []struct {
+		label       string
+		revocations string
+		vars        map[efi.VariableDescriptor]mockEFIVariable
+		wantPolicy  []byte
+	}{
+		{"stage", "revocations.sbat", map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: shimGUID, Name: "SbatLevelRT"}: {[]byte("sbat,1,2022111500\nshim,2\ngrub,2\n"), 6},
+		}, []byte{1}},
+		{"sbat_level.txt", "sbat_level.txt", nil, []byte{1}},
+		{"already applied", "revocations.sbat", map[efi.VariableDescriptor]mockEFIVariable{
+			{GUID: shimGUID, Name: "SbatLevelRT"}: {append(append([]byte{}, revocations...), 0), 6},
+		}, nil},
+		{"no revocations", "", nil, nil},
+	} {
+		t.Run(tc.label, func(t *testing.T) {
+			memFs := afero.NewMemMapFs()
+			appFs = MapFS{memFs}
+			afero.WriteFile(memFs, "/usr/lib/nullboot/shim-signed/shimx64.efi.signed", []byte("shim"), 0644)
+			if tc.revocations != "" {
+				afero.WriteFile(memFs, "/usr/lib/nullboot/shim-signed/"+tc.revocations, revocations, 0644)
+			}
+			mockvars := MockEFIVariables{tc.vars}
+
+			if _, err := InstallShim("/boot/efi", "/usr/lib/nullboot/shim-signed", ShimConfig{Vendor: "ubuntu", SbatPolicyVariables: &mockvars}); err != nil {
+				t.Fatalf("Expected success, got error: %v", err)
+			}
+
+			policy, ok := mockvars.store[efi.VariableDescriptor{GUID: shimGUID, Name: "SbatPolicy"}]
+			switch {
+			case tc.wantPolicy == nil && ok:
+				t.Errorf("Unexpected SbatPolicy %v", policy.data)
+			case tc.wantPolicy != nil && !ok:
+				t.Errorf("SbatPolicy was not set")
+			case tc.wantPolicy != nil:
+				if !bytes.Equal(policy.data, tc.wantPolicy) {
+					t.Errorf("Expected SbatPolicy %v, got %v", tc.wantPolicy, policy.data)
+				}
+				if want := efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess; policy.attrs != want {
+					t.Errorf("Expected attributes %v, got %v", want, policy.attrs)
+				}
+			}
+		})
+	}
+}
+
+func TestInstallShim_WithGrub(t *testing.T) {
+	SetArchitecture("x64")
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+
+	afero.WriteFile(memFs, "/usr/lib/nullboot/shim-signed/shimx64.efi.signed", []byte("shim"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/nullboot/shim-signed/fbx64.efi", []byte("fb"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/nullboot/shim-signed/mmx64.efi", []byte("mm"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/nullboot/shim-signed/grubx64.efi", []byte("grub"), 0644)
+
+	updated, err := InstallShim("/boot/efi", "/usr/lib/nullboot/shim-signed", ShimConfig{Vendor: "ubuntu"})
+	if err != nil {
+		t.Errorf("Expected success, got error: %v", err)
+	}
+	if !updated {
+		t.Errorf("Expected successful update")
+	}
+
+	copies := map[string]string{
+		"/boot/efi/EFI/BOOT/BOOTX64.EFI":   "/usr/lib/nullboot/shim-signed/shimx64.efi.signed",
+		"/boot/efi/EFI/BOOT/grubx64.efi":   "/usr/lib/nullboot/shim-signed/grubx64.efi",
+		"/boot/efi/EFI/ubuntu/shimx64.efi": "/usr/lib/nullboot/shim-signed/shimx64.efi.signed",
+		"/boot/efi/EFI/ubuntu/grubx64.efi": "/usr/lib/nullboot/shim-signed/grubx64.efi",
+	}
+	for dst, src := range copies {
+		if err := CheckFilesEqual(memFs, dst, src); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// A grub update on its own is reported as an update
+	afero.WriteFile(memFs, "/usr/lib/nullboot/shim-signed/grubx64.efi", []byte("new grub"), 0644)
+
+	updated, err = InstallShim("/boot/efi", "/usr/lib/nullboot/shim-signed", ShimConfig{Vendor: "ubuntu"})
+	if err != nil {
+		t.Errorf("Expected success, got error: %v", err)
+	}
+	if !updated {
+		t.Errorf("Expected successful update")
+	}
+	for dst, src := range copies {
+		if err := CheckFilesEqual(memFs, dst, src); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestInstallShim_CustomVendorAndBasename(t *testing.T) {
+	SetArchitecture("x64")
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+
+	afero.WriteFile(memFs, "/usr/lib/nullboot/shim-signed/shimx64-derivative.efi.signed", []byte("shim"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/nullboot/shim-signed/fbx64.efi", []byte("fb"), 0644)
+	afero.WriteFile(memFs, "/usr/lib/nullboot/shim-signed/mmx64.efi", []byte("mm"), 0644)
+
+	updated, err := InstallShim("/boot/efi", "/usr/lib/nullboot/shim-signed", ShimConfig{Vendor: "derivative", Basename: "shimx64-derivative.efi"})
+	if err != nil {
+		t.Errorf("Expected success, got error: %v", err)
+	}
+	if !updated {
+		t.Errorf("Expected successful update")
+	}
+
+	copies := map[string]string{
+		"/boot/efi/EFI/BOOT/BOOTX64.EFI":                  "/usr/lib/nullboot/shim-signed/shimx64-derivative.efi.signed",
+		"/boot/efi/EFI/derivative/shimx64-derivative.efi": "/usr/lib/nullboot/shim-signed/shimx64-derivative.efi.signed",
+		"/boot/efi/EFI/derivative/fbx64.efi":              "/usr/lib/nullboot/shim-signed/fbx64.efi",
+		"/boot/efi/EFI/derivative/mmx64.efi":              "/usr/lib/nullboot/shim-signed/mmx64.efi",
+	}
+	for dst, src := range copies {
+		if err := CheckFilesEqual(memFs, dst, src); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestRequestMOKEnrollment(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Test MOK"},
+		NotBefore:    time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockvars := MockEFIVariables{}
+	if err := RequestMOKEnrollment(&mockvars, der, "pw"); err != nil {
+		t.Fatalf("Expected success, got error: %v", err)
+	}
+
+	attrs := efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess
+	mokNew, ok := mockvars.store[efi.VariableDescriptor{GUID: shimGUID, Name: "MokNew"}]
+	if !ok {
+		t.Fatal("MokNew was not set")
+	}
+	if mokNew.attrs != attrs {
+		t.Errorf("Expected MokNew attributes %v, got %v", attrs, mokNew.attrs)
+	}
+	db, err := efi.ReadSignatureDatabase(bytes.NewReader(mokNew.data))
+	if err != nil {
+		t.Fatalf("Could not decode MokNew: %v", err)
+	}
+	want := efi.SignatureDatabase{
+		{Type: efi.CertX509Guid, Header: []byte{}, Signatures: []*efi.SignatureData{{Owner: shimGUID, Data: der}}},
+	}
+	if !reflect.DeepEqual(db, want) {
+		t.Errorf("Expected MokNew %v, got %v", want, db)
+	}
+
+	mokAuth, ok := mockvars.store[efi.VariableDescriptor{GUID: shimGUID, Name: "MokAuth"}]
+	if !ok {
+		t.Fatal("MokAuth was not set")
+	}
+	if mokAuth.attrs != attrs {
+		t.Errorf("Expected MokAuth attributes %v, got %v", attrs, mokAuth.attrs)
+	}
+	if want := sha256.Sum256(append(append([]byte{}, mokNew.data...), 'p', 0, 'w', 0)); !bytes.Equal(mokAuth.data, want[:]) {
+		t.Errorf("Expected MokAuth %x, got %x", want, mokAuth.data)
+	}
+}
+
+func TestRequestMOKEnrollmentInvalid(t *testing.T) {
+	mockvars := MockEFIVariables{}
+	if err := RequestMOKEnrollment(&mockvars, []byte("not a certificate"), "pw"); err == nil || !strings.HasPrefix(err.Error(), "cannot parse certificate: ") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if len(mockvars.store) != 0 {
+		t.Errorf("Expected no variables to be set, got %v", mockvars.store)
+	}
+}
+
+func TestDetectShimTampering(t *testing.T) {
+	SetArchitecture("x64")
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+
+	afero.WriteFile(memFs, "/usr/lib/nullboot/shim/shimx64.efi.signed", []byte("shim"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim"), 0644)
+
+	assets := newTrustedAssets()
+	if err := assets.TrustNewFromDir("/usr/lib/nullboot/shim"); err != nil {
+		t.Fatalf("Could not trust assets: %v", err)
+	}
+
+	tampered, err := DetectShimTampering("/boot/efi", ShimConfig{Vendor: "ubuntu"}, assets)
+	if err != nil {
+		t.Errorf("Expected success, got error: %v", err)
+	}
+	if tampered {
+		t.Errorf("Trusted shim was flagged as tampered")
+	}
+
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/shimx64.efi", []byte("evil shim"), 0644)
+
+	tampered, err = DetectShimTampering("/boot/efi", ShimConfig{Vendor: "ubuntu"}, assets)
+	if err != nil {
+		t.Errorf("Expected success, got error: %v", err)
+	}
+	if !tampered {
+		t.Errorf("Untrusted shim was not flagged as tampered")
+	}
+
+	memFs.Remove("/boot/efi/EFI/ubuntu/shimx64.efi")
+
+	if _, err := DetectShimTampering("/boot/efi", ShimConfig{Vendor: "ubuntu"}, assets); !os.IsNotExist(errors.Unwrap(err)) {
+		t.Errorf("Expected not exist error, got: %v", err)
+	}
+}
+
+func TestVerifyShimConsistency(t *testing.T) {
+	SetArchitecture("x64")
+	memFs := afero.NewMemMapFs()
+	appFs = MapFS{memFs}
+
+	afero.WriteFile(memFs, "/boot/efi/EFI/BOOT/BOOTX64.EFI", []byte("shim"), 0644)
+	afero.WriteFile(memFs, "/boot/efi/EFI/ubuntu/shimx64.efi", []byte("shim"), 0644)
+
+	if err := VerifyShimConsistency("/boot/efi", "ubuntu"); err != nil {
+		t.Errorf("Expected success, got error: %v", err)
+	}
+
+	afero.WriteFile(memFs, "/boot/efi/EFI/BOOT/BOOTX64.EFI", []byte("shim\x00"), 0644)
+
+	if err := VerifyShimConsistency("/boot/efi", "ubuntu"); err == nil || err.Error() != "/boot/efi/EFI/BOOT/BOOTX64.EFI differs from /boot/efi/EFI/ubuntu/shimx64.efi" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	afero.WriteFile(memFs, "/boot/efi/EFI/BOOT/BOOTX64.EFI", []byte("mihs"), 0644)
+
+	if err := VerifyShimConsistency("/boot/efi", "ubuntu"); err == nil || err.Error() != "/boot/efi/EFI/BOOT/BOOTX64.EFI differs from /boot/efi/EFI/ubuntu/shimx64.efi" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	memFs.Remove("/boot/efi/EFI/ubuntu/shimx64.efi")
+
+	if err := VerifyShimConsistency("/boot/efi", "ubuntu"); !os.IsNotExist(errors.Unwrap(err)) {
+		t.Errorf("Expected not exist error, got: %v", err)
+	}
 }